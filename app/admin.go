@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gocraft/web"
+	"gopkg.in/redis.v5"
+)
+
+// 管理员交易控制：暂停或恢复单个或全部交易对的撮合、批量撤单、紧急停止
+// 批量撤单作为批次排队，由execCancelJobs移到待撤单队列，再由execCancel按redis.batch.cancel分批调用chaincode解锁
+// 紧急停止后各任务处理完当前批次即暂停，解除后继续；停止期间不接受挂单和改单，不处理死信和对账修正，撤单在解除后处理
+// 管理操作由Audit中间件记录审计日志
+
+// KillSwitch 紧急停止的状态
+type KillSwitch struct {
+	Operator string `json:"operator"`
+	Reason   string `json:"reason"`
+	Time     int64  `json:"time"`
+	Date     string `json:"date"`
+}
+
+var (
+	errMarketNotHalted      = errors.New("Market is not halted.")
+	errKillSwitchNotEngaged = errors.New("Kill switch is not engaged.")
+)
+
+// readAdminReason 请求内容中的操作原因 {"reason":""}，请求内容可以为空
+func readAdminReason(req *web.Request) (string, error) {
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil || len(reqBody) == 0 {
+		return "", err
+	}
+
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	err = json.Unmarshal(reqBody, &body)
+	return body.Reason, err
+}
+
+// pushHaltTickers 推送暂停状态变化的交易对行情
+func pushHaltTickers(pair string) {
+	pairs := []*Pair{}
+	if pair == HaltAllPairs {
+		pairs, _ = getPairs()
+	} else if base, quote, err := parsePairID(pair); err == nil {
+		pairs = append(pairs, &Pair{SrcCurrency: base, DesCurrency: quote})
+	}
+	for _, v := range pairs {
+		pushTicker(v.SrcCurrency, v.DesCurrency)
+	}
+}
+
+// haltMarket 管理员暂停撮合，pair为getHaltPairID或HaltAllPairs，覆盖熔断的暂停且不会自动恢复
+func haltMarket(pair, operator, reason string) (*MarketHalt, error) {
+	now := time.Now()
+	halt := &MarketHalt{
+		Pair:     pair,
+		Event:    HaltEventHalt,
+		Reason:   reason,
+		Operator: operator,
+		Time:     now.Unix(),
+		Date:     now.Format("2006-01-02 15:04:05"),
+	}
+	js, _ := json.Marshal(halt)
+
+	pipe := client.TxPipeline()
+	pipe.HSet(HaltsKey, pair, string(js))
+	addHaltEvent(pipe, halt)
+	_, err := pipe.Exec()
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Warningf("Matching of [%s] halted by [%s]: %s", pair, operator, reason)
+
+	pushHaltTickers(pair)
+	return halt, nil
+}
+
+// resumeMarketByAdmin 管理员恢复撮合，恢复全部交易对时同时解除各交易对的暂停，返回已恢复的交易对
+// 恢复单个交易对时全部交易对的暂停仍然有效
+func resumeMarketByAdmin(pair, operator, reason string) ([]string, error) {
+	pairs := []string{pair}
+	if pair == HaltAllPairs {
+		var err error
+		pairs, err = client.HKeys(HaltsKey).Result()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	resumed := []string{}
+	for _, v := range pairs {
+		// 多个管理员同时恢复时只记录一次
+		n, err := client.HDel(HaltsKey, v).Result()
+		if err != nil {
+			return resumed, err
+		}
+		if n == 0 {
+			continue
+		}
+
+		pipe := client.Pipeline()
+		addHaltEvent(pipe, &MarketHalt{
+			Pair:     v,
+			Event:    HaltEventResume,
+			Reason:   reason,
+			Operator: operator,
+			Time:     now.Unix(),
+			Date:     now.Format("2006-01-02 15:04:05"),
+		})
+		pipe.Exec()
+		myLogger.Infof("Matching of [%s] resumed by [%s].", v, operator)
+
+		resumed = append(resumed, v)
+		pushHaltTickers(v)
+	}
+	if len(resumed) == 0 && pair != HaltAllPairs {
+		return nil, errMarketNotHalted
+	}
+	return resumed, nil
+}
+
+// getBookOrders 交易对两个方向买卖队列和触发队列中的挂单
+func getBookOrders(base, quote string) ([]string, error) {
+	uuids := []string{}
+	for _, key := range []string{
+		getBSKey(base, quote), getStopKey(base, quote),
+		getBSKey(quote, base), getStopKey(quote, base),
+	} {
+		members, err := client.ZRange(key, 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		uuids = append(uuids, members...)
+	}
+	return uuids, nil
+}
+
+// getAllBookOrders 所有已登记交易方向的买卖队列和触发队列中的挂单
+func getAllBookOrders() ([]string, error) {
+	pairs, err := getPairs()
+	if err != nil {
+		return nil, err
+	}
+
+	uuids := []string{}
+	for _, v := range pairs {
+		for _, key := range []string{getBSKey(v.SrcCurrency, v.DesCurrency), getStopKey(v.SrcCurrency, v.DesCurrency)} {
+			members, err := client.ZRange(key, 0, -1).Result()
+			if err != nil {
+				return nil, err
+			}
+			uuids = append(uuids, members...)
+		}
+	}
+	return uuids, nil
+}
+
+// getKillSwitch 紧急停止的状态，未停止时为nil
+func getKillSwitch() (*KillSwitch, error) {
+	js, err := client.Get(KillSwitchKey).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ks KillSwitch
+	if err := json.Unmarshal([]byte(js), &ks); err != nil {
+		return nil, err
+	}
+	return &ks, nil
+}
+
+// isKillSwitchEngaged 是否紧急停止
+func isKillSwitchEngaged() bool {
+	ks, err := getKillSwitch()
+	return err == nil && ks != nil
+}
+
+// waitKillSwitch 任务每次处理前调用，紧急停止期间阻塞，解除后返回
+func waitKillSwitch(task string) {
+	stopped := false
+	for isKillSwitchEngaged() {
+		if !stopped {
+			myLogger.Warningf("Task [%s] stopped by kill switch.", task)
+			stopped = true
+		}
+		time.Sleep(time.Second)
+	}
+	if stopped {
+		myLogger.Infof("Task [%s] resumed.", task)
+	}
+}
+
+// engageKillSwitch 紧急停止所有任务
+func engageKillSwitch(operator, reason string) (*KillSwitch, error) {
+	now := time.Now()
+	ks := &KillSwitch{
+		Operator: operator,
+		Reason:   reason,
+		Time:     now.Unix(),
+		Date:     now.Format("2006-01-02 15:04:05"),
+	}
+	js, _ := json.Marshal(ks)
+	err := client.Set(KillSwitchKey, string(js), 0).Err()
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Warningf("Kill switch engaged by [%s]: %s", operator, reason)
+	return ks, nil
+}
+
+// releaseKillSwitch 解除紧急停止
+func releaseKillSwitch(operator string) error {
+	n, err := client.Del(KillSwitchKey).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errKillSwitchNotEngaged
+	}
+	myLogger.Infof("Kill switch released by [%s].", operator)
+	return nil
+}
+
+// HaltMarket 暂停交易对两个方向的撮合，请求内容 {"reason":""}
+func (a *AppREST) HaltMarket(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	base, quote, err := parsePairID(req.PathParams["pair"])
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+	a.haltMarket(rw, req, getHaltPairID(base, quote))
+}
+
+// HaltAllMarkets 暂停全部交易对的撮合，请求内容 {"reason":""}
+func (a *AppREST) HaltAllMarkets(rw web.ResponseWriter, req *web.Request) {
+	a.haltMarket(rw, req, HaltAllPairs)
+}
+
+func (a *AppREST) haltMarket(rw web.ResponseWriter, req *web.Request, pair string) {
+	myLogger.Info("REST processing halt market request...")
+
+	encoder := json.NewEncoder(rw)
+
+	reason, err := readAdminReason(req)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error unmarshalling halt request payload: %s", err)})
+		return
+	}
+	if reason == "" {
+		reason = "Halted by operator."
+	}
+
+	result, err := haltMarket(pair, a.Account, reason)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: result})
+}
+
+// ResumeMarket 恢复交易对两个方向的撮合，包括熔断的暂停，请求内容 {"reason":""}
+func (a *AppREST) ResumeMarket(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	base, quote, err := parsePairID(req.PathParams["pair"])
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+	a.resumeMarket(rw, req, getHaltPairID(base, quote))
+}
+
+// ResumeAllMarkets 恢复全部交易对的撮合，请求内容 {"reason":""}
+func (a *AppREST) ResumeAllMarkets(rw web.ResponseWriter, req *web.Request) {
+	a.resumeMarket(rw, req, HaltAllPairs)
+}
+
+func (a *AppREST) resumeMarket(rw web.ResponseWriter, req *web.Request, pair string) {
+	myLogger.Info("REST processing resume market request...")
+
+	encoder := json.NewEncoder(rw)
+
+	reason, err := readAdminReason(req)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error unmarshalling resume request payload: %s", err)})
+		return
+	}
+	if reason == "" {
+		reason = "Resumed by operator."
+	}
+
+	result, err := resumeMarketByAdmin(pair, a.Account, reason)
+	if err == errMarketNotHalted {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: result})
+}
+
+// CancelPairOrders 撤销交易对两个方向的所有挂单
+func (a *AppREST) CancelPairOrders(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	pair := req.PathParams["pair"]
+	if _, _, err := parsePairID(pair); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+	a.massCancel(rw, "", pair)
+}
+
+// CancelAccountOrders 撤销账户的所有挂单
+func (a *AppREST) CancelAccountOrders(rw web.ResponseWriter, req *web.Request) {
+	a.massCancel(rw, req.PathParams["account"], "")
+}
+
+// CancelAllOrders 撤销所有挂单
+func (a *AppREST) CancelAllOrders(rw web.ResponseWriter, req *web.Request) {
+	a.massCancel(rw, "", "")
+}
+
+// massCancel 批量撤单排队后返回批次进度，通过AdminCancelBatchStatus查询
+func (a *AppREST) massCancel(rw web.ResponseWriter, account, pair string) {
+	myLogger.Info("REST processing mass cancel request...")
+
+	encoder := json.NewEncoder(rw)
+
+	batch, err := queueCancelBatch(account, pair, a.Account)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+	encoder.Encode(restResult{OK: getCancelBatchProgress(batch)})
+}
+
+// KillSwitch 查看紧急停止的状态，未停止时为null
+func (a *AppREST) KillSwitch(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing kill switch request...")
+
+	encoder := json.NewEncoder(rw)
+
+	result, err := getKillSwitch()
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: result})
+}
+
+// EngageKillSwitch 紧急停止所有任务，请求内容 {"reason":""}
+func (a *AppREST) EngageKillSwitch(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing engage kill switch request...")
+
+	encoder := json.NewEncoder(rw)
+
+	reason, err := readAdminReason(req)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error unmarshalling kill switch request payload: %s", err)})
+		return
+	}
+
+	result, err := engageKillSwitch(a.Account, reason)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: result})
+}
+
+// ReleaseKillSwitch 解除紧急停止
+func (a *AppREST) ReleaseKillSwitch(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing release kill switch request...")
+
+	encoder := json.NewEncoder(rw)
+
+	err := releaseKillSwitch(a.Account)
+	if err == errKillSwitchNotEngaged {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: true})
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+const (
+	AmendPending = "pending" //等待chaincode锁定或解锁差额
+	AmendSuccess = "success" //改单完成
+	AmendFailed  = "failed"  //改单失败，挂单已还原
+)
+
+// Amendment 改单，ID为“挂单UUID@改单次数”，同时作为chaincode锁定记录的挂单号
+type Amendment struct {
+	ID          string  `json:"id"`
+	UUID        string  `json:"uuid"`        //挂单UUID
+	SrcCount    float64 `json:"srcCount"`    //改单后剩余的源币数量
+	DesCount    float64 `json:"desCount"`    //改单后剩余的目标币数量
+	Diff        float64 `json:"diff"`        //需锁定（大于0）或解锁（小于0）的源币数量
+	Requeue     bool    `json:"requeue"`     //是否重新排队，即失去时间优先级
+	OldScore    float64 `json:"oldScore"`    //改单失败时按原score还原
+	OldSrcCount float64 `json:"oldSrcCount"` //改单前剩余的源币数量，解锁失败时还原
+	OldDesCount float64 `json:"oldDesCount"` //改单前剩余的目标币数量
+	HiddenCount float64 `json:"hiddenCount"` //冰山单改单后的隐藏数量
+	OldHidden   float64 `json:"oldHidden"`   //冰山单改单前的隐藏数量
+	Status      string  `json:"status"`
+	Info        string  `json:"info"` //失败信息
+}
+
+var errAmendNothing = errors.New("Nothing to amend.")
+
+func getAmendment(id string) (*Amendment, error) {
+	js, err := client.HGet(AmendmentsKey, id).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var amend Amendment
+	err = json.Unmarshal([]byte(js), &amend)
+	if err != nil {
+		return nil, err
+	}
+	return &amend, nil
+}
+
+// amendOrder 修改挂单的剩余数量或价格
+// 同价减量：保留时间优先级，立即生效，并解锁差额
+// 改价或加量：失去时间优先级；需追加锁定时先移出买卖队列，锁定成功后再重新排队
+// 挂单在改单期间被撮合修改时，事务失败，需重新提交改单
+func amendOrder(uuid string, srcCount, desCount float64) (*Amendment, error) {
+	var amend *Amendment
+
+	err := updateOrder(uuid, func(order *Order, pipe *redis.Pipeline) error {
+		if order.Amending != "" {
+			return errors.New("Order is being amended.")
+		}
+		if order.Type != OrderTypeLimit && order.Type != OrderTypeStopLimit {
+			return errors.New("Only limit order can be amended.")
+		}
+		if isIceberg(order) {
+			return errors.New("Iceberg order can't be amended.")
+		}
+		key := getBookKey(order)
+		score, err := client.ZScore(key, uuid).Result()
+		if err != nil {
+			return errors.New("Order is not in the book.")
+		}
+
+		// 剩余锁定数量，部分成交后为锁定数量减去已撮合子单的消耗
+		locked := order.SrcCount
+		if order.LockedCount > 0 {
+			locked = order.LockedCount - order.FilledCost
+		}
+		samePrice := round(desCount/srcCount, 6) == round(order.DesCount/order.SrcCount, 6)
+		reduce := srcCount <= order.SrcCount
+		if order.IsBuyAll {
+			reduce = desCount <= order.DesCount
+		}
+		if samePrice && srcCount == order.SrcCount && desCount == order.DesCount {
+			return errAmendNothing
+		}
+		if !samePrice {
+			if err := checkPriceBand(order.SrcCurrency, order.DesCurrency, desCount/srcCount); err != nil {
+				return err
+			}
+		}
+
+		order.AmendCount++
+		amend = &Amendment{
+			ID:          fmt.Sprintf("%s@%d", uuid, order.AmendCount),
+			UUID:        uuid,
+			SrcCount:    srcCount,
+			DesCount:    desCount,
+			Diff:        round(srcCount-locked, 6),
+			Requeue:     !samePrice || !reduce,
+			OldScore:    score,
+			OldSrcCount: order.SrcCount,
+			OldDesCount: order.DesCount,
+			Status:      AmendPending,
+		}
+		if amend.Diff > 0 {
+			// 追加锁定期间移出买卖队列，避免按新数量撮合
+			amend.Requeue = true
+			pipe.ZRem(key, uuid)
+		} else {
+			applyAmendment(order, amend, pipe)
+		}
+		if amend.Diff != 0 {
+			order.Amending = amend.ID
+		} else {
+			amend.Status = AmendSuccess
+		}
+
+		js, _ := json.Marshal(amend)
+		pipe.HSet(AmendmentsKey, amend.ID, string(js))
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	addOrderHistory(uuid, EventAmend, amend.ID)
+
+	return amend, nil
+}
+
+// applyAmendment 按改单修改挂单数量和价格，需要时重新排队
+func applyAmendment(order *Order, amend *Amendment, pipe *redis.Pipeline) {
+	order.SrcCount = amend.SrcCount
+	order.DesCount = amend.DesCount
+	if isIceberg(order) {
+		// 冰山单按母单限价减量，可见部分的数量取整后不改变价格
+		order.HiddenCount = amend.HiddenCount
+	} else {
+		order.Price = amend.DesCount / amend.SrcCount
+	}
+
+	if amend.Requeue {
+		now := time.Now()
+		order.AmendedTime = now.Unix()
+		order.AmendedDate = now.Format("2006-01-02 15:04:05")
+		pipe.ZAdd(getBookKey(order), redis.Z{Member: order.UUID, Score: getBookScore(order)})
+	}
+}
+
+// submitAmendment 调用chaincode锁定或解锁改单差额，调用失败时改单失败
+// 不需锁定或解锁差额的改单只更新账本上的挂单快照
+func submitAmendment(amend *Amendment) error {
+	if amend.Status == AmendSuccess {
+		return saveAmendTerms(amend)
+	}
+	if amend.Status != AmendPending {
+		return nil
+	}
+
+	order, err := getOrder(amend.UUID)
+	if err != nil {
+		return err
+	}
+
+	srcMethod := "amendUnlock"
+	if amend.Diff > 0 {
+		srcMethod = "amendLock"
+	}
+	txid, err := lock(getAmendLockInfo(order, amend), amend.Diff > 0, srcMethod)
+	submitBatch(srcMethod, []string{amend.ID}, txid, err)
+	if err != nil {
+		finishAmendment(amend.ID, false, err.Error())
+	}
+	return err
+}
+
+// saveAmendTerms 已生效的改单更新账本上的挂单快照，如同价减量未改变锁定数量时
+// 快照只用于重建，保存失败不影响改单
+func saveAmendTerms(amend *Amendment) error {
+	order, err := getOrder(amend.UUID)
+	if err != nil {
+		return err
+	}
+
+	terms, _ := json.Marshal([]*LockInfo{&LockInfo{
+		Owner:    order.Account,
+		Currency: order.SrcCurrency,
+		OrderId:  amend.ID,
+		Terms:    getTermsSnapshot(order),
+	}})
+	_, err = saveOrderTerms(string(terms))
+	if err != nil {
+		myLogger.Errorf("Failed saving order terms of amendment [%s]: %s", amend.ID, err)
+	}
+	return nil
+}
+
+// getAmendLockInfo 改单需锁定或解锁的差额，同时传入改单完成后的挂单快照
+func getAmendLockInfo(order *Order, amend *Amendment) string {
+	count := int64(math.Abs(amend.Diff) * Multiple)
+
+	terms := *getTermsSnapshot(order)
+	terms.SrcCount = amend.SrcCount
+	terms.DesCount = amend.DesCount
+	if isIceberg(order) {
+		terms.HiddenCount = amend.HiddenCount
+	} else {
+		terms.Price = amend.DesCount / amend.SrcCount
+	}
+	if amend.Diff > 0 {
+		terms.LockedCount += float64(count) / Multiple
+	} else {
+		terms.LockedCount -= float64(count) / Multiple
+	}
+
+	locks := []*LockInfo{&LockInfo{
+		Owner:    order.Account,
+		Currency: order.SrcCurrency,
+		OrderId:  amend.ID,
+		Count:    count,
+		Terms:    &terms,
+	}}
+
+	lockInfos, _ := json.Marshal(&locks)
+	return string(lockInfos)
+}
+
+// finishAmendment chaincode处理改单差额后修改挂单和改单状态
+func finishAmendment(id string, success bool, info string) error {
+	amend, err := getAmendment(id)
+	if err != nil {
+		return err
+	}
+	if amend.Status != AmendPending {
+		return nil
+	}
+
+	err = updateOrder(amend.UUID, func(order *Order, pipe *redis.Pipeline) error {
+		if order.Amending != id {
+			return nil
+		}
+		order.Amending = ""
+
+		if success {
+			// 锁定数量按chaincode实际锁定或解锁的数量修改
+			count := float64(int64(math.Abs(amend.Diff)*Multiple)) / Multiple
+			lock := getRemainingLock(order)
+			if amend.Diff > 0 {
+				order.LockedCount += count
+				applyAmendment(order, amend, pipe)
+			} else {
+				order.LockedCount -= count
+			}
+			addRiskTotals(pipe, order, 0, 0, getRemainingLock(order)-lock)
+			amend.Status = AmendSuccess
+		} else {
+			if amend.Diff > 0 {
+				// 追加锁定失败，按原数量和原优先级还原
+				pipe.ZAdd(getBookKey(order), redis.Z{Member: order.UUID, Score: amend.OldScore})
+			} else {
+				// 解锁失败，差额仍锁定在挂单中，还原改单前的数量和价格
+				rollbackAmendment(order, amend, pipe)
+			}
+			amend.Status = AmendFailed
+			amend.Info = info
+		}
+
+		js, _ := json.Marshal(amend)
+		pipe.HSet(AmendmentsKey, amend.ID, string(js))
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if success {
+		addOrderHistory(amend.UUID, EventAmended, id)
+	} else {
+		addOrderHistory(amend.UUID, EventAmendFail, info)
+	}
+	return nil
+}
+
+// rollbackAmendment 还原已生效的减量改单，改单后已成交的部分不还原
+// 挂单已不在买卖队列中时不再排队，撤单或过期时一并解锁差额；已全部成交的差额由对账发现
+func rollbackAmendment(order *Order, amend *Amendment, pipe *redis.Pipeline) {
+	if amend.OldSrcCount <= 0 || amend.OldDesCount <= 0 {
+		return
+	}
+
+	price := amend.OldDesCount / amend.OldSrcCount
+	if isIceberg(order) {
+		price = order.Price
+		order.HiddenCount += amend.OldHidden - amend.HiddenCount
+	}
+	if order.IsBuyAll {
+		order.DesCount += amend.OldDesCount - amend.DesCount
+		order.SrcCount = order.DesCount / price
+	} else {
+		order.SrcCount += amend.OldSrcCount - amend.SrcCount
+		order.DesCount = order.SrcCount * price
+	}
+	order.Price = price
+
+	key := getBookKey(order)
+	if !isInZSet(key, order.UUID) {
+		myLogger.Warningf("Amendment [%s] rolled back after order [%s] left the book.", amend.ID, order.UUID)
+		return
+	}
+	if amend.Requeue {
+		pipe.ZAdd(key, redis.Z{Member: order.UUID, Score: amend.OldScore})
+	}
+}
+
+// amendSuccess chaincode锁定或解锁改单差额成功
+func amendSuccess(ids []string) {
+	for _, v := range ids {
+		finishAmendment(v, true, "")
+	}
+}
+
+// amendFail chaincode锁定或解锁改单差额失败
+// 解锁失败时差额仍锁定在挂单中，挂单还原为改单前的数量和价格
+func amendFail(fails []FailInfo) {
+	for _, v := range fails {
+		finishAmendment(v.Id, false, v.Info)
+	}
+}
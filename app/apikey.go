@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/spf13/viper"
+)
+
+// API Key：程序化交易不使用浏览器会话，请求带以下请求头
+//   X-API-Key        Key ID
+//   X-API-Timestamp  请求时间，Unix秒，与服务器时间相差不能超过app.apiKey.window
+//   X-API-Nonce      随机串，同一个Key在时间窗口内不能重复
+//   X-API-Signature  hex(HMAC-SHA256(secret, 方法\n路径和查询串\n时间\nnonce\n请求内容))
+// Key的权限范围：read 查询，trade 挂单、撤单和改单，withdraw 币的创建、发布和分发等资金划转
+// 会话登录拥有全部权限；Key的创建、查询和撤销只能用会话登录
+
+// API Key的权限范围
+const (
+	ScopeRead     = "read"
+	ScopeTrade    = "trade"
+	ScopeWithdraw = "withdraw"
+)
+
+var apiKeyScopes = map[string]bool{
+	ScopeRead:     true,
+	ScopeTrade:    true,
+	ScopeWithdraw: true,
+}
+
+var (
+	errInvalidSignature = errors.New("Invalid API key or signature.")
+	errExpiredTimestamp = errors.New("X-API-Timestamp is out of the allowed window.")
+	errReplayedNonce    = errors.New("X-API-Nonce has been used.")
+)
+
+// APIKey API Key，Secret只在创建时返回
+type APIKey struct {
+	ID         string   `json:"id"`
+	Account    string   `json:"account"`
+	Label      string   `json:"label"`
+	Scopes     []string `json:"scopes"`
+	Secret     string   `json:"secret,omitempty"`
+	CreateTime int64    `json:"createTime"`
+	CreateDate string   `json:"createDate"`
+}
+
+func getAccountAPIKeysKey(account string) string {
+	return APIKeysKey + "_" + account
+}
+
+func getAPINonceKey(id, nonce string) string {
+	return APINonceKey + "_" + id + "_" + nonce
+}
+
+// hasScope API Key是否有该权限
+func (k *APIKey) hasScope(scope string) bool {
+	for _, v := range k.Scopes {
+		if v == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// randomString 指定字节数的随机串
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// createAPIKey 为账户创建API Key，每个账户最多app.apiKey.maxKeys个
+func createAPIKey(account, label string, scopes []string) (*APIKey, error) {
+	if len(scopes) == 0 {
+		return nil, errors.New("Scopes can't be empty.")
+	}
+	seen := make(map[string]bool)
+	for _, v := range scopes {
+		if !apiKeyScopes[v] {
+			return nil, fmt.Errorf("Unknown scope [%s], must be read, trade or withdraw.", v)
+		}
+		if seen[v] {
+			return nil, fmt.Errorf("Duplicate scope [%s].", v)
+		}
+		seen[v] = true
+	}
+
+	count, err := client.SCard(getAccountAPIKeysKey(account)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if count >= viper.GetInt64("app.apiKey.maxKeys") {
+		return nil, errors.New("Too many API keys, revoke one first.")
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	key := &APIKey{
+		ID:         hex.EncodeToString(b),
+		Account:    account,
+		Label:      label,
+		Scopes:     scopes,
+		Secret:     secret,
+		CreateTime: now.Unix(),
+		CreateDate: now.Format("2006-01-02 15:04:05"),
+	}
+
+	js, _ := json.Marshal(key)
+	pipe := client.TxPipeline()
+	pipe.HSet(APIKeysKey, key.ID, string(js))
+	pipe.SAdd(getAccountAPIKeysKey(account), key.ID)
+	_, err = pipe.Exec()
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// getAPIKey 获取API Key，包含Secret
+func getAPIKey(id string) (*APIKey, error) {
+	js, err := client.HGet(APIKeysKey, id).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var key APIKey
+	if err := json.Unmarshal([]byte(js), &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// getAPIKeys 账户的所有API Key，不返回Secret
+func getAPIKeys(account string) ([]*APIKey, error) {
+	ids, err := getAllSetMember(getAccountAPIKeysKey(account))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*APIKey{}
+	for _, v := range ids {
+		key, err := getAPIKey(v)
+		if err != nil {
+			continue
+		}
+		key.Secret = ""
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// revokeAPIKey 撤销账户的API Key
+func revokeAPIKey(account, id string) error {
+	key, err := getAPIKey(id)
+	if err != nil || key.Account != account {
+		return errors.New("API key not found.")
+	}
+
+	pipe := client.TxPipeline()
+	pipe.HDel(APIKeysKey, id)
+	pipe.SRem(getAccountAPIKeysKey(account), id)
+	_, err = pipe.Exec()
+	return err
+}
+
+// signRequest 请求的签名
+func signRequest(secret, method, uri, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyAPIRequest 校验API Key请求的签名、时间和nonce，返回请求的API Key
+func verifyAPIRequest(req *web.Request) (*APIKey, error) {
+	id := req.Header.Get("X-API-Key")
+	timestamp := req.Header.Get("X-API-Timestamp")
+	nonce := req.Header.Get("X-API-Nonce")
+	signature := req.Header.Get("X-API-Signature")
+	if timestamp == "" || nonce == "" || signature == "" {
+		return nil, errors.New("X-API-Timestamp, X-API-Nonce and X-API-Signature are required.")
+	}
+
+	window := viper.GetInt64("app.apiKey.window")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errExpiredTimestamp
+	}
+	if diff := time.Now().Unix() - ts; diff > window || diff < -window {
+		return nil, errExpiredTimestamp
+	}
+
+	key, err := getAPIKey(id)
+	if err != nil {
+		return nil, errInvalidSignature
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	expected := signRequest(key.Secret, req.Method, req.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, errInvalidSignature
+	}
+
+	// nonce保留到时间窗口结束，之后的请求因时间超出窗口被拒绝
+	ok, err := client.SetNX(getAPINonceKey(id, nonce), 1, time.Duration(2*window)*time.Second).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errReplayedNonce
+	}
+
+	key.Secret = ""
+	return key, nil
+}
+
+// requireScope 需要登录且API Key有该权限，会话登录拥有全部权限
+func (a *AppREST) requireScope(scope string, rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if a.Account == "" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(rw).Encode(restResp{Status: FAILED, Result: respErr{Code: NOTLOGIN, Msg: errNotLogin.Error()}})
+		return
+	}
+	if a.APIKey != nil && !a.APIKey.hasScope(scope) {
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(restResult{Err: fmt.Sprintf("API key has no %s scope.", scope)})
+		return
+	}
+	next(rw, req)
+}
+
+// RequireRead 需要read权限
+func (a *AppREST) RequireRead(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	a.requireScope(ScopeRead, rw, req, next)
+}
+
+// RequireTrade 需要trade权限
+func (a *AppREST) RequireTrade(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	a.requireScope(ScopeTrade, rw, req, next)
+}
+
+// RequireWithdraw 需要withdraw权限
+func (a *AppREST) RequireWithdraw(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	a.requireScope(ScopeWithdraw, rw, req, next)
+}
+
+// RequireSession 只允许会话登录，API Key不能管理API Key
+func (a *AppREST) RequireSession(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if a.Account == "" || a.APIKey != nil {
+		rw.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(rw).Encode(restResp{Status: FAILED, Result: respErr{Code: NOTLOGIN, Msg: errNotLogin.Error()}})
+		return
+	}
+	next(rw, req)
+}
+
+// CreateAPIKey 创建API Key，请求内容 {"label":"","scopes":["read","trade"]}
+func (a *AppREST) CreateAPIKey(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing create api key request...")
+
+	encoder := json.NewEncoder(rw)
+
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: "Internal JSON error when reading request body."})
+
+		myLogger.Error("Internal JSON error when reading request body.")
+		return
+	}
+
+	var create struct {
+		Label  string   `json:"label"`
+		Scopes []string `json:"scopes"`
+	}
+	err = json.Unmarshal(reqBody, &create)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error unmarshalling api key request payload: %s", err)})
+		return
+	}
+
+	key, err := createAPIKey(a.Account, create.Label, create.Scopes)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: key})
+}
+
+// APIKeys 当前账户的API Key
+func (a *AppREST) APIKeys(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing get api keys request...")
+
+	encoder := json.NewEncoder(rw)
+
+	keys, err := getAPIKeys(a.Account)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: keys})
+}
+
+// RevokeAPIKey 撤销API Key
+func (a *AppREST) RevokeAPIKey(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing revoke api key request...")
+
+	encoder := json.NewEncoder(rw)
+
+	err := revokeAPIKey(a.Account, req.PathParams["id"])
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: req.PathParams["id"]})
+}
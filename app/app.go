@@ -2,16 +2,18 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"math"
 
 	"github.com/gocraft/web"
 	"github.com/hyperledger/fabric/core/util"
+	"github.com/spf13/viper"
 )
 
 // restResult defines the response payload for a general REST interface request.
@@ -45,27 +47,48 @@ const (
 
 // Order Order
 type Order struct {
-	UUID         string  `json:"uuid"`        //UUID
-	Account      string  `json:"account"`     //账户
-	SrcCurrency  string  `json:"srcCurrency"` //源币种代码
-	SrcCount     float64 `json:"srcCount"`    //源币种交易数量
-	DesCurrency  string  `json:"desCurrency"` //目标币种代码
-	DesCount     float64 `json:"desCount"`    //目标币种交易数量
-	IsBuyAll     bool    `json:"isBuyAll"`    //是否买入所有，即为true是以目标币全部兑完为主,否则算部分成交,买完为止；为false则是以源币全部兑完为主,否则算部分成交，卖完为止
-	ExpiredTime  int64   `json:"expiredTime"` //超时时间
-	ExpiredDate  string  `json:"expiredDate"`
-	PendingTime  int64   `json:"PendingTime"` //挂单时间
-	PendingDate  string  `json:"pendingDate"`
-	PendedTime   int64   `json:"PendedTime"` //挂单完成时间
-	PendedDate   string  `json:"pendedDate"`
-	MatchedTime  int64   `json:"matchedTime"` //撮合完成时间
-	MatchedDate  string  `json:"matchedDate"`
-	FinishedTime int64   `json:"finishedTime"` //交易完成时间
-	FinishedDate string  `json:"finishedDate"`
-	RawUUID      string  `json:"rawUUID"`   //母单UUID
-	Metadata     string  `json:"metadata"`  //存放其他数据，如挂单锁定失败信息
-	FinalCost    float64 `json:"finalCost"` //源币的最终消耗数量，主要用于买完（IsBuyAll=true）的最后一笔交易计算结余，此时SrcCount有可能大于FinalCost
-	Status       int     `json:"status"`    //状态 0：待交易，1：完成，2：过期，3：撤单
+	UUID          string  `json:"uuid"`        //UUID
+	Account       string  `json:"account"`     //账户
+	SrcCurrency   string  `json:"srcCurrency"` //源币种代码
+	SrcCount      float64 `json:"srcCount"`    //源币种交易数量
+	DesCurrency   string  `json:"desCurrency"` //目标币种代码
+	DesCount      float64 `json:"desCount"`    //目标币种交易数量
+	IsBuyAll      bool    `json:"isBuyAll"`    //是否买入所有，即为true是以目标币全部兑完为主,否则算部分成交,买完为止；为false则是以源币全部兑完为主,否则算部分成交，卖完为止
+	ExpiredTime   int64   `json:"expiredTime"` //超时时间
+	ExpiredDate   string  `json:"expiredDate"`
+	PendingTime   int64   `json:"PendingTime"` //挂单时间
+	PendingDate   string  `json:"pendingDate"`
+	PendedTime    int64   `json:"PendedTime"` //挂单完成时间
+	PendedDate    string  `json:"pendedDate"`
+	MatchedTime   int64   `json:"matchedTime"` //撮合完成时间
+	MatchedDate   string  `json:"matchedDate"`
+	FinishedTime  int64   `json:"finishedTime"` //交易完成时间
+	FinishedDate  string  `json:"finishedDate"`
+	RawUUID       string  `json:"rawUUID"`       //母单UUID
+	Metadata      string  `json:"metadata"`      //存放其他数据，如挂单锁定失败信息
+	FinalCost     float64 `json:"finalCost"`     //源币的最终消耗数量，主要用于买完（IsBuyAll=true）的最后一笔交易计算结余，此时SrcCount有可能大于FinalCost
+	Status        int     `json:"status"`        //状态 0：待交易，1：完成，2：过期，3：撤单
+	Type          string  `json:"type"`          //挂单类型 limit：限价单，market：市价单
+	Price         float64 `json:"price"`         //限价，每个源币最少换得的目标币数量，市价单为滑点上限对应的最差价格
+	Slippage      float64 `json:"slippage"`      //市价单允许的最大滑点，不超过配置的上限
+	LockedCount   float64 `json:"lockedCount"`   //挂单时锁定的源币数量
+	FilledCost    float64 `json:"filledCost"`    //已撮合的子单消耗的源币数量，撤单或过期时据此计算需解锁的结余
+	TimeInForce   string  `json:"timeInForce"`   //有效期类型 GTC，IOC，FOK，GTD
+	Reason        string  `json:"reason"`        //撤单或过期的原因
+	StopPrice     float64 `json:"stopPrice"`     //止损价，最新成交价跌到此价格及以下时触发
+	TriggeredTime int64   `json:"triggeredTime"` //止损单触发时间
+	TriggeredDate string  `json:"triggeredDate"`
+	DisplayCount  float64 `json:"displayCount"` //冰山单每次显示的数量
+	HiddenCount   float64 `json:"hiddenCount"`  //冰山单隐藏的剩余数量
+	RefilledTime  int64   `json:"refilledTime"` //冰山单最近一次补充可见部分的时间
+	RefilledDate  string  `json:"refilledDate"`
+	AmendCount    int     `json:"amendCount"`  //改单次数
+	Amending      string  `json:"amending"`    //等待chaincode处理差额的改单ID
+	AmendedTime   int64   `json:"amendedTime"` //最近一次改价或加量的时间
+	AmendedDate   string  `json:"amendedDate"`
+	ClientOrderID string  `json:"clientOrderId"` //客户端挂单ID，同一账户内唯一，重复提交时返回原挂单
+
+	History []OrderHistory `json:"history,omitempty"` //挂单历史，查询时返回，账本上的挂单快照中也保存
 }
 
 // Order Order
@@ -86,6 +109,8 @@ type OrderInt struct {
 	Metadata     string `json:"metadata"`     //存放其他数据，如挂单锁定失败信息
 	FinalCost    int64  `json:"finalCost"`    //源币的最终消耗数量，主要用于买完（IsBuyAll=true）的最后一笔交易计算结余，此时SrcCount有可能大于FinalCost
 	Status       int    `json:"status"`       //状态
+	Type         string `json:"type"`         //挂单类型
+	Price        int64  `json:"price"`        //限价
 }
 
 // NotFound NotFound
@@ -102,7 +127,7 @@ func (s *AppREST) SetResponseType(rw web.ResponseWriter, req *web.Request, next
 
 	// Enable CORS
 	rw.Header().Set("Access-Control-Allow-Origin", "*")
-	rw.Header().Set("Access-Control-Allow-Headers", "accept, content-type")
+	rw.Header().Set("Access-Control-Allow-Headers", "accept, authorization, content-type, idempotency-key, x-api-key, x-api-timestamp, x-api-nonce, x-api-signature")
 
 	next(rw, req)
 }
@@ -170,6 +195,7 @@ func (a *AppREST) Create(rw web.ResponseWriter, req *web.Request) {
 	}
 
 	// chaincode
+	currency.User = a.Account
 	txid, err := createCurrency(currency.ID, int64(round(currency.Count, 6)*Multiple), currency.User)
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
@@ -177,6 +203,7 @@ func (a *AppREST) Create(rw web.ResponseWriter, req *web.Request) {
 		// myLogger.Errorf("create Currency failed:%s", err)
 		return
 	}
+	watchTx(txid, currency.User)
 
 	rw.WriteHeader(http.StatusOK)
 	encoder.Encode(restResp{Status: SUCCESS, Result: struct{ Txid string }{Txid: txid}})
@@ -200,7 +227,7 @@ func (a *AppREST) CheckCreate(rw web.ResponseWriter, req *web.Request) {
 	}
 	// myLogger.Debugf("check create request parameter:txid = %s", txid)
 
-	v, ok := chaincodeResult[txid]
+	v, ok := getChaincodeResult(txid)
 	if !ok {
 		rw.WriteHeader(http.StatusOK)
 		encoder.Encode(restResult{OK: "0"})
@@ -296,13 +323,7 @@ func (a *AppREST) Asset(rw web.ResponseWriter, req *web.Request) {
 
 	encoder := json.NewEncoder(rw)
 
-	owner := req.PathParams["owner"]
-	if owner == "" {
-		rw.WriteHeader(http.StatusBadRequest)
-		encoder.Encode(restResult{Err: "owner can't be empty"})
-		// myLogger.Errorf("Get asset failed")
-		return
-	}
+	owner := a.Account
 
 	result, err := getAsset(owner)
 	if err != nil {
@@ -337,13 +358,7 @@ func (a *AppREST) MyCurrency(rw web.ResponseWriter, req *web.Request) {
 
 	encoder := json.NewEncoder(rw)
 
-	user := req.PathParams["user"]
-	if user == "" {
-		rw.WriteHeader(http.StatusBadRequest)
-		encoder.Encode(restResult{Err: "user can't be empty"})
-		// myLogger.Errorf("Get currency failed")
-		return
-	}
+	user := a.Account
 
 	result, err := getCurrencysByUser(user)
 	if err != nil {
@@ -378,13 +393,7 @@ func (a AppREST) MyTxs(rw web.ResponseWriter, req *web.Request) {
 
 	encoder := json.NewEncoder(rw)
 
-	user := req.PathParams["user"]
-	if user == "" {
-		rw.WriteHeader(http.StatusBadRequest)
-		encoder.Encode(restResult{Err: "user can't be empty"})
-		// myLogger.Errorf("Get currency failed")
-		return
-	}
+	user := a.Account
 
 	// 用户挂单集中于挂单成功队列和以用户名为key的队列中 且 不在以下三种状态的 status = 0
 	// 完成的挂单存在于交易执行成功队列中 status = 1
@@ -401,15 +410,8 @@ func (a AppREST) MyTxs(rw web.ResponseWriter, req *web.Request) {
 	var txs []Order
 	for _, v := range uuids {
 		order, _ := getOrder(v)
-		if ok, _ := isInSet(ExchangeSuccessKey, v); ok {
-			order.Status = 1
-		} else if ok, _ := isInSet(ExpiredSuccessOrderKey, v); ok {
-			order.Status = 2
-		} else if ok, _ := isInSet(CancelSuccessOrderKey, v); ok {
-			order.Status = 3
-		} else {
-			order.Status = 0
-		}
+		order.Status = getOrderStatus(v)
+		order.History, _ = getOrderHistory(v)
 
 		txs = append(txs, *order)
 	}
@@ -418,6 +420,38 @@ func (a AppREST) MyTxs(rw web.ResponseWriter, req *web.Request) {
 	encoder.Encode(restResult{OK: txs})
 }
 
+// ClientOrder 按客户端挂单ID查询挂单
+func (a *AppREST) ClientOrder(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing get client order request...")
+
+	encoder := json.NewEncoder(rw)
+
+	clientOrderID := req.PathParams["clientOrderId"]
+	if clientOrderID == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: "clientOrderId can't be empty"})
+		return
+	}
+
+	uuid, err := getUUIDByClientOrderID(a.Account, clientOrderID)
+	if err != nil {
+		rw.WriteHeader(http.StatusNotFound)
+		encoder.Encode(restResult{Err: "Order not found."})
+		return
+	}
+	order, err := getOrder(uuid)
+	if err != nil {
+		rw.WriteHeader(http.StatusNotFound)
+		encoder.Encode(restResult{Err: "Order not found."})
+		return
+	}
+	order.Status = getOrderStatus(uuid)
+	order.History, _ = getOrderHistory(uuid)
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: order})
+}
+
 // Release 发布币
 func (a *AppREST) Release(rw web.ResponseWriter, req *web.Request) {
 	myLogger.Info("REST processing currency release request...")
@@ -474,12 +508,14 @@ func (a *AppREST) Release(rw web.ResponseWriter, req *web.Request) {
 	}
 
 	// chaincode
+	currency.User = a.Account
 	txid, err := releaseCurrency(currency.ID, int64(round(currency.Count, 6)*Multiple), currency.User)
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
 		encoder.Encode(restResult{Err: "release Currency failed."})
 		return
 	}
+	watchTx(txid, currency.User)
 
 	rw.WriteHeader(http.StatusOK)
 	encoder.Encode(restResult{OK: txid})
@@ -503,7 +539,7 @@ func (a *AppREST) CheckRelease(rw web.ResponseWriter, req *web.Request) {
 		return
 	}
 
-	v, ok := chaincodeResult[txid]
+	v, ok := getChaincodeResult(txid)
 	if !ok {
 		rw.WriteHeader(http.StatusOK)
 		encoder.Encode(restResult{OK: "0"})
@@ -580,6 +616,7 @@ func (a *AppREST) Assign(rw web.ResponseWriter, req *web.Request) {
 		assign.Assigns[k].Count = int64(float64(v.Count) * Multiple)
 	}
 
+	assign.User = a.Account
 	assigns, _ := json.Marshal(&assign)
 	// chaincode
 	txid, err := assignCurrency(string(assigns), assign.User)
@@ -588,6 +625,11 @@ func (a *AppREST) Assign(rw web.ResponseWriter, req *web.Request) {
 		encoder.Encode(restResult{Err: "assign Currency failed."})
 		return
 	}
+	owners := []string{}
+	for _, v := range assign.Assigns {
+		owners = append(owners, v.Owner)
+	}
+	watchTx(txid, assign.User, owners...)
 
 	rw.WriteHeader(http.StatusOK)
 	encoder.Encode(restResult{OK: txid})
@@ -611,7 +653,7 @@ func (a *AppREST) CheckAssign(rw web.ResponseWriter, req *web.Request) {
 		return
 	}
 
-	v, ok := chaincodeResult[txid]
+	v, ok := getChaincodeResult(txid)
 	if !ok {
 		rw.WriteHeader(http.StatusOK)
 		encoder.Encode(restResult{OK: "0"})
@@ -629,6 +671,13 @@ func (a *AppREST) Exchange(rw web.ResponseWriter, req *web.Request) {
 
 	encoder := json.NewEncoder(rw)
 
+	// 紧急停止期间不接受挂单和改单
+	if isKillSwitchEngaged() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		encoder.Encode(restResult{Err: "Trading is stopped by kill switch."})
+		return
+	}
+
 	// Read in the incoming request payload
 	reqBody, err := ioutil.ReadAll(req.Body)
 	if err != nil {
@@ -663,12 +712,12 @@ func (a *AppREST) Exchange(rw web.ResponseWriter, req *web.Request) {
 	}
 
 	// 校验请求数据
-	if len(order.Account) <= 0 {
-		rw.WriteHeader(http.StatusBadRequest)
-		encoder.Encode(restResult{Err: "Account cann't be empty."})
-
-		myLogger.Error("Account cann't be empty.")
-		return
+	order.Account = a.Account
+	if order.ClientOrderID != "" {
+		if rawUUID, err := getUUIDByClientOrderID(order.Account, order.ClientOrderID); err == nil {
+			encodeClientOrder(rw, rawUUID)
+			return
+		}
 	}
 	if len(order.SrcCurrency) <= 0 {
 		rw.WriteHeader(http.StatusBadRequest)
@@ -684,6 +733,52 @@ func (a *AppREST) Exchange(rw web.ResponseWriter, req *web.Request) {
 		myLogger.Error("DesCurrency cann't be empty.")
 		return
 	}
+	if order.Type == "" {
+		order.Type = OrderTypeLimit
+	}
+	if order.Type == OrderTypeMarket {
+		// 熔断暂停期间不接受市价单
+		if isHalted(order.SrcCurrency, order.DesCurrency) {
+			rw.WriteHeader(http.StatusBadRequest)
+			encoder.Encode(restResult{Err: "Matching is halted, market order is not accepted."})
+
+			myLogger.Error("Matching is halted, market order is not accepted.")
+			return
+		}
+		// 市价单按对手盘价格和滑点上限推算挂单数量
+		err = prepareMarketOrder(&order)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			encoder.Encode(restResult{Err: err.Error()})
+
+			myLogger.Errorf("Prepare market order failed: %s", err)
+			return
+		}
+	} else if isStopOrder(&order) {
+		// 止损单挂单时锁定余额，进入触发队列等待触发
+		err = prepareStopOrder(&order)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			encoder.Encode(restResult{Err: err.Error()})
+
+			myLogger.Errorf("Prepare stop order failed: %s", err)
+			return
+		}
+	} else if order.Type != OrderTypeLimit {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: "Type must be limit, market, stop or stopLimit."})
+
+		myLogger.Error("Type must be limit, market, stop or stopLimit.")
+		return
+	}
+	err = prepareTimeInForce(&order)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+
+		myLogger.Errorf("Invalid time in force: %s", err)
+		return
+	}
 	if order.SrcCount <= 0 {
 		rw.WriteHeader(http.StatusBadRequest)
 		encoder.Encode(restResult{Err: "SrcCount must be greater than 0."})
@@ -705,17 +800,59 @@ func (a *AppREST) Exchange(rw web.ResponseWriter, req *web.Request) {
 	order.RawUUID = uuid
 	order.PendingTime = time.Now().Unix()
 	order.PendingDate = time.Now().Format("2006-01-02 15:04:05")
+	order.Price = order.DesCount / order.SrcCount
+	order.LockedCount = order.SrcCount
 
-	err = addOrder(uuid, &order)
+	// 限价挂单的价格需在价格带内，市价单由滑点上限约束
+	if order.Type != OrderTypeMarket {
+		err = checkPriceBand(order.SrcCurrency, order.DesCurrency, order.Price)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			encoder.Encode(restResult{Err: err.Error()})
+
+			myLogger.Errorf("Price band check failed: %s", err)
+			return
+		}
+	}
+	order.FilledCost = 0
+	order.TriggeredTime = 0
+	order.TriggeredDate = ""
+	order.RefilledTime = 0
+	order.RefilledDate = ""
+	order.AmendCount = 0
+	order.Amending = ""
+	order.AmendedTime = 0
+	order.AmendedDate = ""
+
+	// 冰山单按全部数量锁定余额，买卖队列中只显示部分数量
+	err = prepareIceberg(&order)
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
-		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		encoder.Encode(restResult{Err: err.Error()})
 
-		// myLogger.Errorf("Error redis operation: %s", err)
+		myLogger.Errorf("Prepare iceberg order failed: %s", err)
 		return
 	}
 
-	err = addSet(PendingOrdersKey, uuid)
+	// 挂单前检查可用余额和账户限额
+	if viper.GetBool("app.risk.enabled") {
+		err = checkOrderRisk(&order)
+		if risk, ok := err.(*RiskError); ok {
+			rw.WriteHeader(http.StatusBadRequest)
+			encoder.Encode(riskResult{Err: risk.Msg, Risk: risk})
+
+			myLogger.Errorf("Order of [%s] rejected by risk check: %s", order.Account, risk.Code)
+			return
+		}
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			encoder.Encode(restResult{Err: fmt.Sprintf("Error checking order risk: %s", err)})
+			return
+		}
+	}
+
+	// 客户端挂单ID重复提交时返回原挂单，不重复锁定余额
+	rawUUID, ok, err := placeOrder(uuid, &order)
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
 		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
@@ -723,6 +860,12 @@ func (a *AppREST) Exchange(rw web.ResponseWriter, req *web.Request) {
 		// myLogger.Errorf("Error redis operation: %s", err)
 		return
 	}
+	if !ok {
+		encodeClientOrder(rw, rawUUID)
+		return
+	}
+
+	addOrderHistory(uuid, EventPending, "")
 
 	// myLogger.Debugf("挂单信息: %+v", order)
 
@@ -730,6 +873,16 @@ func (a *AppREST) Exchange(rw web.ResponseWriter, req *web.Request) {
 	encoder.Encode(restResult{OK: uuid})
 }
 
+// encodeClientOrder 客户端挂单ID重复提交时返回原挂单UUID，状态放在X-Order-Status响应头中
+// 挂单详情可按客户端挂单ID查询
+func encodeClientOrder(rw web.ResponseWriter, rawUUID string) {
+	rw.Header().Set("X-Order-Status", strconv.Itoa(getOrderStatus(rawUUID)))
+	rw.Header().Set("Idempotent-Replayed", "true")
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(restResult{OK: rawUUID})
+}
+
 // CheckOrder  检测挂单结果，由前端轮询
 // response说明：StatusBadRequest  挂单失败  不需继续轮询，Error表示失败原因
 //				StatusOK OK="1"   挂单成功  不需继续轮询
@@ -747,6 +900,11 @@ func (a *AppREST) CheckOrder(rw web.ResponseWriter, req *web.Request) {
 		// myLogger.Errorf("Client must supply a id for checkorder requests.")
 		return
 	}
+	if !isOwnOrder(uuid, a.Account) {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: "Order not found."})
+		return
+	}
 
 	// 1.检测该挂单是否在挂单成功队列中
 	is, err := isInSet(PendSuccessOrdersKey, uuid)
@@ -850,14 +1008,42 @@ func (a *AppREST) Cancel(rw web.ResponseWriter, req *web.Request) {
 	// 	return
 	// }
 
+	// 也可以用JSON按挂单UUID或客户端挂单ID撤单：{"uuid":""}、{"clientOrderId":""}
+	if strings.HasPrefix(uuid, "{") {
+		var clientOrder struct {
+			UUID          string `json:"uuid"`
+			ClientOrderID string `json:"clientOrderId"`
+		}
+		err = json.Unmarshal(reqBody, &clientOrder)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			encoder.Encode(restResult{Err: fmt.Sprintf("Error unmarshalling cancel request payload: %s", err)})
+			return
+		}
+		uuid = clientOrder.UUID
+		if uuid == "" {
+			uuid, err = getUUIDByClientOrderID(a.Account, clientOrder.ClientOrderID)
+		}
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			encoder.Encode(restResult{Err: "Order not found."})
+			return
+		}
+	}
+
 	order, err := getOrder(uuid)
+	if err != nil || order.Account != a.Account {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: "Order not found."})
+		return
+	}
 
-	// 在买卖队列中的（已锁定的）才有撤单
-	key := getBSKey(order.SrcCurrency, order.DesCurrency)
+	// 在买卖队列或触发队列中的（已锁定的）才有撤单
+	key := getBookKey(order)
 	is := isInZSet(key, order.UUID)
 	if is {
 		// 1.将挂单从买入队列移到待撤单队列中
-		err = mvBS2Cancel(key, order.UUID)
+		err = cancelOrder(order, CancelReasonUser)
 		if err != nil {
 			rw.WriteHeader(http.StatusBadRequest)
 			encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
@@ -877,6 +1063,132 @@ func (a *AppREST) Cancel(rw web.ResponseWriter, req *web.Request) {
 	encoder.Encode(restResult{OK: order.UUID})
 }
 
+// Amend 改单，修改挂单剩余的源币和目标币数量
+func (a *AppREST) Amend(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing amend order request...")
+
+	encoder := json.NewEncoder(rw)
+
+	// 紧急停止期间不接受挂单和改单
+	if isKillSwitchEngaged() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		encoder.Encode(restResult{Err: "Trading is stopped by kill switch."})
+		return
+	}
+
+	// Read in the incoming request payload
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: "Internal JSON error when reading request body."})
+
+		myLogger.Error("Internal JSON error when reading request body.")
+		return
+	}
+
+	// Payload must conform to the following structure
+	var amend struct {
+		UUID     string  `json:"uuid"`
+		SrcCount float64 `json:"srcCount"`
+		DesCount float64 `json:"desCount"`
+	}
+
+	err = json.Unmarshal(reqBody, &amend)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error unmarshalling amend request payload: %s", err)})
+
+		// myLogger.Errorf("Error unmarshalling amend request payload: %s", err)
+		return
+	}
+
+	if len(amend.UUID) == 0 {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: "UUID cann't be empty."})
+
+		myLogger.Error("UUID cann't be empty.")
+		return
+	}
+	if amend.SrcCount <= 0 || amend.DesCount <= 0 {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: "SrcCount and DesCount must be greater than 0."})
+
+		myLogger.Error("SrcCount and DesCount must be greater than 0.")
+		return
+	}
+	if !isOwnOrder(amend.UUID, a.Account) {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: "Order not found."})
+		return
+	}
+
+	// 1.修改挂单，改单期间挂单被撮合时需重新提交
+	amendment, err := amendOrder(amend.UUID, round(amend.SrcCount, 6), round(amend.DesCount, 6))
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+
+		myLogger.Errorf("Amend order failed: %s", err)
+		return
+	}
+
+	// 2.chaincode锁定或解锁差额
+	err = submitAmendment(amendment)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error chaincode operation: %s", err)})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: amendment.ID})
+}
+
+// CheckAmend 检查改单是否成功
+// response说明：StatusBadRequest改单失败  不需继续轮询，Error表示失败原因
+//				StatusOK OK="1" 改单成功  不需继续轮询
+//				StatusOK OK="0" 未果 需要继续轮询
+func (a *AppREST) CheckAmend(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing check order amend request...")
+
+	encoder := json.NewEncoder(rw)
+
+	id := req.PathParams["id"]
+	if id == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: "Client must supply a id for checkamend requests."})
+
+		// myLogger.Errorf("Client must supply a id for checkamend requests.")
+		return
+	}
+
+	amendment, err := getAmendment(id)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+
+		// myLogger.Errorf("Error redis operation: %s", err)
+		return
+	}
+	if !isOwnOrder(amendment.UUID, a.Account) {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: "Order not found."})
+		return
+	}
+
+	switch amendment.Status {
+	case AmendSuccess:
+		rw.WriteHeader(http.StatusOK)
+		encoder.Encode(restResult{OK: "1"})
+	case AmendFailed:
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: amendment.Info})
+	default:
+		rw.WriteHeader(http.StatusOK)
+		encoder.Encode(restResult{OK: "0"})
+	}
+}
+
 // CheckCancel 检查撤单是否成功
 // response说明：StatusBadRequest撤单失败  不需继续轮询，Error表示失败原因
 //				StatusOK OK="1" 撤单成功  不需继续轮询
@@ -894,6 +1206,11 @@ func (a *AppREST) CheckCancel(rw web.ResponseWriter, req *web.Request) {
 		// myLogger.Errorf("Client must supply a id for checkorder requests.")
 		return
 	}
+	if !isOwnOrder(uuid, a.Account) {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: "Order not found."})
+		return
+	}
 
 	// 1.检测该挂单是否在撤单成功队列中
 	is, err := isInSet(CancelSuccessOrderKey, uuid)
@@ -954,45 +1271,83 @@ func (a *AppREST) Withdrawals(rw web.ResponseWriter, req *web.Request) {
 	return
 }
 
-// login confirms the account and secret password of the client with the
-// CA and stores the enrollment certificate and key in the Devops server.
+// Login 按membership service的enrollID和enrollSecret登录，签发会话令牌
+// 令牌同时写入cookie，也可以按“Authorization: Bearer [令牌]”传递
 func (s *AppREST) Login(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing login request...")
+
 	encoder := json.NewEncoder(rw)
 
-	result, _ := TestCurrency1("t1", "t1", "binhn")
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResp{Status: FAILED, Result: respErr{Code: PARAMERR, Msg: "Internal JSON error when reading request body"}})
+		myLogger.Error("Internal JSON error when reading request body.")
+		return
+	}
 
-	rw.WriteHeader(http.StatusOK)
-	encoder.Encode(restResp{Status: result})
-	// myLogger.Debug("Logout successful.")
+	var user User
+	err = json.Unmarshal(reqBody, &user)
+	if err != nil || user.EnrollID == "" || user.EnrollSecret == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResp{Status: FAILED, Result: respErr{Code: PARAMERR, Msg: "enrollId and enrollSecret can't be empty"}})
+		return
+	}
 
-	// myLogger.Debug("------------- logout Done")
+	err = verifyCredentials(user.EnrollID, user.EnrollSecret)
+	if err != nil {
+		rw.WriteHeader(http.StatusUnauthorized)
+		encoder.Encode(restResp{Status: FAILED, Result: respErr{Code: NOTLOGIN, Msg: err.Error()}})
+		myLogger.Errorf("Login failed for user '%s': %s", user.EnrollID, err)
+		return
+	}
 
-	return
+	token, claims, err := newSession(user.EnrollID)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResp{Status: FAILED, Result: respErr{Code: SYSERR, Msg: err.Error()}})
+		myLogger.Errorf("Create session failed for user '%s': %s", user.EnrollID, err)
+		return
+	}
+	setSessionCookie(rw, token, claims.Expires)
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResp{
+		Status: SUCCESS,
+		Result: struct {
+			Token    string `json:"token"`
+			Expires  int64  `json:"expires"`
+			UserInfo User   `json:"userInfo"`
+		}{
+			Token:    token,
+			Expires:  claims.Expires,
+			UserInfo: User{EnrollID: user.EnrollID},
+		}})
 }
 
+// Logout 退出登录，会话令牌立即失效；只接受POST，避免跨站请求触发
 func (s *AppREST) Logout(rw web.ResponseWriter, req *web.Request) {
-	// myLogger.Debug("------------- logout...")
+	myLogger.Info("REST processing logout request...")
 
 	encoder := json.NewEncoder(rw)
 
-	result, _ := TestgetCurrency1("t1")
-
-	rw.WriteHeader(http.StatusOK)
-	encoder.Encode(restResp{Status: result})
-	// myLogger.Debug("Logout successful.")
-
-	// myLogger.Debug("------------- logout Done")
-
-	return
-}
+	claims, err := getSession(req)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResp{Status: FAILED, Result: respErr{Code: NOTLOGIN, Msg: err.Error()}})
+		return
+	}
 
-func checkLogin(req *web.Request) (string, error) {
-	cookie, err := req.Cookie("loginfo")
-	if err != nil || cookie.Value == "" {
-		return "", errors.New("not login")
+	err = revokeSession(claims.ID)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResp{Status: FAILED, Result: respErr{Code: SYSERR, Msg: err.Error()}})
+		return
 	}
+	setSessionCookie(rw, "", 0)
 
-	return cookie.Value, nil
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResp{Status: SUCCESS})
 }
 
 // IsLogin IsLogin
@@ -1024,17 +1379,11 @@ func (s *AppREST) IsLogin(rw web.ResponseWriter, req *web.Request) {
 	return
 }
 
-func (s *AppREST) My(rw web.ResponseWriter, req *web.Request) {
+func (a *AppREST) My(rw web.ResponseWriter, req *web.Request) {
 	// myLogger.Debug("------------- my...")
 
 	encoder := json.NewEncoder(rw)
-	enrollID, err := checkLogin(req)
-	if err != nil {
-		rw.WriteHeader(http.StatusBadRequest)
-		encoder.Encode(restResp{Status: FAILED, Result: respErr{Code: NOTLOGIN, Msg: err.Error()}})
-		// myLogger.Errorf("My failed: [%s].", err)
-		return
-	}
+	enrollID := a.Account
 
 	// 获取个人币
 	result, _ := getCurrencysByUser(enrollID)
@@ -1060,7 +1409,7 @@ func (s *AppREST) My(rw web.ResponseWriter, req *web.Request) {
 	}
 
 	// 获取个人资产
-	result, _ = getAsset(enrollID)
+	result, err := getAsset(enrollID)
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
 		encoder.Encode(restResp{Status: FAILED, Result: respErr{Code: SYSERR, Msg: "Get owner asset failed"}})
@@ -1100,3 +1449,368 @@ func (s *AppREST) My(rw web.ResponseWriter, req *web.Request) {
 
 	return
 }
+
+// DeadLetters 查看所有死信
+func (a *AppREST) DeadLetters(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing dead letters request...")
+
+	encoder := json.NewEncoder(rw)
+
+	letters, err := getDeadLetters()
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+
+		// myLogger.Errorf("Error redis operation: %s", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: letters})
+}
+
+// DeadLetter 查看死信及对应挂单和挂单历史
+func (a *AppREST) DeadLetter(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing dead letter request...")
+
+	encoder := json.NewEncoder(rw)
+
+	id := req.PathParams["id"]
+	letter, err := getDeadLetter(id)
+	if err != nil {
+		rw.WriteHeader(http.StatusNotFound)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+
+	type orderDetail struct {
+		Order   *Order         `json:"order"`
+		History []OrderHistory `json:"history"`
+	}
+	orders := []orderDetail{}
+	for _, v := range strings.Split(id, ",") {
+		order, err := getOrder(v)
+		if err != nil {
+			continue
+		}
+		history, _ := getOrderHistory(v)
+		orders = append(orders, orderDetail{Order: order, History: history})
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: struct {
+		DeadLetter *DeadLetter   `json:"deadLetter"`
+		Orders     []orderDetail `json:"orders"`
+	}{
+		DeadLetter: letter,
+		Orders:     orders,
+	}})
+}
+
+// RetryDeadLetter 重试死信
+func (a *AppREST) RetryDeadLetter(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing retry dead letter request...")
+
+	encoder := json.NewEncoder(rw)
+
+	id := req.PathParams["id"]
+	err := retryDeadLetter(id)
+	if err == errDeadLetterNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+
+		// myLogger.Errorf("Error redis operation: %s", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: id})
+}
+
+// ResolveDeadLetter 按核实的chaincode结果强制处理死信
+func (a *AppREST) ResolveDeadLetter(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing resolve dead letter request...")
+
+	encoder := json.NewEncoder(rw)
+
+	// 紧急停止期间不处理，避免调用chaincode
+	if isKillSwitchEngaged() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		encoder.Encode(restResult{Err: "Trading is stopped by kill switch."})
+		return
+	}
+
+	// Read in the incoming request payload
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: "Internal JSON error when reading request body."})
+
+		myLogger.Error("Internal JSON error when reading request body.")
+		return
+	}
+
+	// Payload must conform to the following structure
+	var resolve struct {
+		Success bool   `json:"success"` //chaincode是否已处理成功
+		Reason  string `json:"reason"`
+	}
+
+	err = json.Unmarshal(reqBody, &resolve)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error unmarshalling resolve request payload: %s", err)})
+
+		// myLogger.Errorf("Error unmarshalling resolve request payload: %s", err)
+		return
+	}
+	if len(resolve.Reason) == 0 {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: "Reason cann't be empty."})
+
+		myLogger.Error("Reason cann't be empty.")
+		return
+	}
+
+	id := req.PathParams["id"]
+	err = resolveDeadLetter(id, resolve.Success, resolve.Reason)
+	if err == errDeadLetterNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+
+		// myLogger.Errorf("Error redis operation: %s", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: id})
+}
+
+// Reconciliations 查看所有对账报告
+func (a *AppREST) Reconciliations(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing reconciliations request...")
+
+	encoder := json.NewEncoder(rw)
+
+	list, err := getReconciliations()
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+
+		// myLogger.Errorf("Error redis operation: %s", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: list})
+}
+
+// Reconcile 对账，生成待审批的对账报告
+func (a *AppREST) Reconcile(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing reconcile request...")
+
+	encoder := json.NewEncoder(rw)
+
+	r, err := reconcile()
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error reconciling: %s", err)})
+
+		myLogger.Errorf("Error reconciling: %s", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: r})
+}
+
+// Reconciliation 查看对账报告
+func (a *AppREST) Reconciliation(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing reconciliation request...")
+
+	encoder := json.NewEncoder(rw)
+
+	r, err := getReconciliation(req.PathParams["id"])
+	if err == errReconciliationNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+
+		// myLogger.Errorf("Error redis operation: %s", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: r})
+}
+
+// ApproveReconciliation 审批对账报告，提交修正解锁
+func (a *AppREST) ApproveReconciliation(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing approve reconciliation request...")
+
+	encoder := json.NewEncoder(rw)
+
+	// 紧急停止期间不处理，避免调用chaincode
+	if isKillSwitchEngaged() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		encoder.Encode(restResult{Err: "Trading is stopped by kill switch."})
+		return
+	}
+
+	r, err := approveReconciliation(req.PathParams["id"])
+	if err == errReconciliationNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+
+		myLogger.Errorf("Approve reconciliation failed: %s", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: r})
+}
+
+// getQueryLimit 查询参数中的条数，未指定或无效时为def，不超过max
+func getQueryLimit(req *web.Request, name string, def, max int64) int64 {
+	limit, err := strconv.ParseInt(req.URL.Query().Get(name), 10, 64)
+	if err != nil || limit <= 0 {
+		limit = def
+	}
+	if limit > max {
+		limit = max
+	}
+	return limit
+}
+
+// MarketDepth 交易对按价格档位聚合的盘口深度
+func (a *AppREST) MarketDepth(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing market depth request...")
+
+	encoder := json.NewEncoder(rw)
+
+	base, quote, err := parsePairID(req.PathParams["pair"])
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+
+	depth := getQueryLimit(req, "depth", viper.GetInt64("app.market.depth"), viper.GetInt64("app.market.maxDepth"))
+	result, err := getDepth(base, quote, depth)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+
+		// myLogger.Errorf("Error redis operation: %s", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: result})
+}
+
+// MarketTicker 交易对的最新成交价、最优买卖价和24小时统计
+func (a *AppREST) MarketTicker(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing market ticker request...")
+
+	encoder := json.NewEncoder(rw)
+
+	base, quote, err := parsePairID(req.PathParams["pair"])
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+
+	result, err := getTicker(base, quote)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+
+		// myLogger.Errorf("Error redis operation: %s", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: result})
+}
+
+// MarketTrades 交易对最近的成交记录
+func (a *AppREST) MarketTrades(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing market trades request...")
+
+	encoder := json.NewEncoder(rw)
+
+	base, quote, err := parsePairID(req.PathParams["pair"])
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+
+	limit := getQueryLimit(req, "limit", viper.GetInt64("app.market.trades"), viper.GetInt64("app.market.trades"))
+	result, err := getTrades(base, quote, limit)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+
+		// myLogger.Errorf("Error redis operation: %s", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: result})
+}
+
+// MarketCandles 交易对的K线，参数interval为周期，from和to为开始和结束时间
+func (a *AppREST) MarketCandles(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing market candles request...")
+
+	encoder := json.NewEncoder(rw)
+
+	base, quote, err := parsePairID(req.PathParams["pair"])
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+
+	query := req.URL.Query()
+	from, _ := strconv.ParseInt(query.Get("from"), 10, 64)
+	to, _ := strconv.ParseInt(query.Get("to"), 10, 64)
+	result, err := getCandles(base, quote, query.Get("interval"), from, to)
+	if err == errInvalidInterval || err == errInvalidRange {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+
+		// myLogger.Errorf("Error redis operation: %s", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: result})
+}
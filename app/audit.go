@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/spf13/viper"
+)
+
+// 审计日志：管理接口除查询外的请求，记录操作人、请求内容和响应状态
+// 保存在audit列表中，只保留最近app.admin.audit条，同时写入日志
+
+// AuditEntry 管理操作的审计记录
+type AuditEntry struct {
+	Operator string `json:"operator"`
+	APIKey   string `json:"apiKey,omitempty"` //使用API Key操作时的Key ID
+	IP       string `json:"ip"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Body     string `json:"body"`
+	Status   int    `json:"status"`
+	Time     int64  `json:"time"`
+	Date     string `json:"date"`
+}
+
+// addAuditEntry 记录审计日志
+func addAuditEntry(entry *AuditEntry) {
+	myLogger.Infof("Audit: [%s] %s %s %s -> %d", entry.Operator, entry.Method, entry.Path, entry.Body, entry.Status)
+
+	js, _ := json.Marshal(entry)
+	pipe := client.Pipeline()
+	pipe.LPush(AuditKey, string(js))
+	pipe.LTrim(AuditKey, 0, viper.GetInt64("app.admin.audit")-1)
+	if _, err := pipe.Exec(); err != nil {
+		myLogger.Errorf("Failed saving audit entry: %s", err)
+	}
+}
+
+// getAuditEntries 最近count条审计日志，按时间倒序
+func getAuditEntries(count int64) ([]*AuditEntry, error) {
+	values, err := client.LRange(AuditKey, 0, count-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*AuditEntry{}
+	for _, v := range values {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(v), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
+
+// Audit 记录管理接口除GET外的请求，需在RequireSession之后，权限不足被拒绝的请求也记录
+func (a *AppREST) Audit(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if req.Method == "GET" || req.Method == "OPTIONS" {
+		next(rw, req)
+		return
+	}
+
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(rw).Encode(restResult{Err: "Internal JSON error when reading request body."})
+
+		myLogger.Error("Internal JSON error when reading request body.")
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+
+	recorder := &recordResponseWriter{ResponseWriter: rw, statusCode: http.StatusOK}
+	next(recorder, req)
+
+	now := time.Now()
+	entry := &AuditEntry{
+		Operator: a.Account,
+		IP:       getClientIP(req),
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		Body:     string(reqBody),
+		Status:   recorder.statusCode,
+		Time:     now.Unix(),
+		Date:     now.Format("2006-01-02 15:04:05"),
+	}
+	if a.APIKey != nil {
+		entry.APIKey = a.APIKey.ID
+	}
+	addAuditEntry(entry)
+}
+
+// AuditLog 最近的审计日志，?count=条数
+func (a *AppREST) AuditLog(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing audit log request...")
+
+	encoder := json.NewEncoder(rw)
+
+	count := viper.GetInt64("app.admin.audit")
+	result, err := getAuditEntries(getQueryLimit(req, "count", 100, count))
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: result})
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/hyperledger/fabric/core/util"
+	"github.com/spf13/viper"
+	"gopkg.in/redis.v5"
+)
+
+// 批量撤单：撤销账户的所有挂单，或按交易对、买卖方向筛选
+// 选中的挂单每app.cancel.chunk个由脚本一次性从买卖队列或触发队列移到待撤单队列
+// 未能移动的挂单（尚未锁定、改单中、已成交或已撤销）连同原因记入批次的skipped
+// 每次批量撤单有一个批次ID，进度可通过接口查询，用户的批次也会在私有频道cancels推送
+// 用户的批量撤单在请求中处理；管理员的批量撤单可能涉及整个交易对，批次排队后由execCancelJobs处理
+// 批次保存app.cancel.batchTTL秒
+
+// 批次状态
+const (
+	CancelBatchQueued  = "queued"  //等待execCancelJobs处理
+	CancelBatchRunning = "running" //正在移到待撤单队列
+	CancelBatchDone    = "done"    //选中的挂单已全部处理
+)
+
+// CancelBatch 批量撤单的批次
+type CancelBatch struct {
+	ID       string     `json:"id"`
+	Account  string     `json:"account,omitempty"`  //为空时不限，只有管理员的批次可以为空
+	Pair     string     `json:"pair,omitempty"`     //交易对ID，为空时不限
+	Side     string     `json:"side,omitempty"`     //buy：源币为计价币，sell：源币为基础币，为空时两个方向
+	Operator string     `json:"operator,omitempty"` //管理员的批次
+	Reason   string     `json:"reason"`             //挂单的撤单原因
+	Status   string     `json:"status"`
+	Orders   []string   `json:"orders"`  //已移到待撤单队列的挂单
+	Skipped  []FailInfo `json:"skipped"` //无法撤销的挂单
+	Time     int64      `json:"time"`
+	Date     string     `json:"date"`
+}
+
+// CancelBatchProgress 批量撤单的进度
+type CancelBatchProgress struct {
+	Batch     *CancelBatch `json:"batch"`
+	Total     int          `json:"total"`
+	Canceling int          `json:"canceling"` //等待chaincode解锁
+	Canceled  int          `json:"canceled"`
+	Failed    int          `json:"failed"` //撤单失败放回买卖队列或移入死信
+	Done      bool         `json:"done"`
+}
+
+var errCancelBatchNotFound = errors.New("Cancel batch not found.")
+
+// 挂单未能移到待撤单队列的原因，由cancelBatchScript返回
+const (
+	CancelSkipAmending  = "amending"  //改单差额未处理完
+	CancelSkipPending   = "pending"   //chaincode尚未锁定，锁定后才能撤单
+	CancelSkipNotInBook = "notInBook" //已不在队列中（已成交、已撤单或过期）
+	CancelSkipNotFound  = "notFound"  //挂单不存在
+)
+
+// cancelSkipInfo 跳过原因的说明
+var cancelSkipInfo = map[string]string{
+	CancelSkipAmending:  "Order is being amended.",
+	CancelSkipPending:   "Order is not locked yet, cancel it again after it is pended.",
+	CancelSkipNotInBook: "Order is no longer in the book.",
+	CancelSkipNotFound:  "Order not found.",
+}
+
+// cancelBatchScript 将挂单从所在队列移到待撤单队列，与mvBS2Cancel相同，只移动仍在队列中的挂单
+// 挂单在触发队列还是买卖队列在脚本中确定，以免读取后止损单被触发；改单差额未处理完的挂单不移动，否则会重复解锁
+// KEYS[1]待撤单队列 KEYS[2]过期调度 KEYS[3]待撤单工作队列 KEYS[4]挂单所属批次 KEYS[5]待挂单队列
+// KEYS[4i-2]、KEYS[4i-1]为ARGV[i]交易对的触发队列和买卖队列，KEYS[4i]为ARGV[i]所属账户的统计，KEYS[4i+1]为ARGV[i]挂单本身
+// ARGV[1]批次ID ARGV[2...]挂单UUID，返回[已移动的挂单, 跳过的挂单和原因交替排列]
+var cancelBatchScript = redis.NewScript(`
+local moved = {}
+local skipped = {}
+for i = 2, #ARGV do
+	local stop, book, totals, js = KEYS[4 * i - 2], KEYS[4 * i - 1], KEYS[4 * i], redis.call("GET", KEYS[4 * i + 1])
+	local reason
+	if not js then
+		reason = "notFound"
+	elseif redis.call("SISMEMBER", KEYS[5], ARGV[i]) == 1 then
+		reason = "pending"
+	else
+		local order = cjson.decode(js)
+		if type(order.amending) == "string" and order.amending ~= "" then
+			reason = "amending"
+		elseif redis.call("ZREM", stop, ARGV[i]) == 0 and redis.call("ZREM", book, ARGV[i]) == 0 then
+			reason = "notInBook"
+		end
+	end
+	if reason then
+		skipped[#skipped + 1] = ARGV[i]
+		skipped[#skipped + 1] = reason
+	else
+		redis.call("ZREM", KEYS[2], ARGV[i])
+		redis.call("SADD", KEYS[1], ARGV[i])
+		redis.call("XADD", KEYS[3], "*", "member", ARGV[i])
+		redis.call("HSET", KEYS[4], ARGV[i], ARGV[1])
+		redis.call("HINCRBY", totals, "count", -1)
+		moved[#moved + 1] = ARGV[i]
+	end
+end
+return {moved, skipped}
+`)
+
+func getCancelBatchKey(id string) string {
+	return CancelBatchKey + "_" + id
+}
+
+// matchCancelFilter 挂单是否属于交易对的买卖方向
+func matchCancelFilter(order *Order, base, quote, side string) bool {
+	if base == "" {
+		return true
+	}
+	sell := order.SrcCurrency == base && order.DesCurrency == quote
+	buy := order.SrcCurrency == quote && order.DesCurrency == base
+	switch side {
+	case TradeSideBuy:
+		return buy
+	case TradeSideSell:
+		return sell
+	}
+	return buy || sell
+}
+
+// parseCancelFilter 校验批量撤单的筛选条件，返回交易对的基础币和计价币
+func parseCancelFilter(pair, side string) (string, string, error) {
+	if side != "" && side != TradeSideBuy && side != TradeSideSell {
+		return "", "", fmt.Errorf("Invalid side [%s]", side)
+	}
+	if pair == "" {
+		if side != "" {
+			return "", "", errors.New("Side must be used with pair.")
+		}
+		return "", "", nil
+	}
+	return parsePairID(pair)
+}
+
+// newCancelBatch 新的批次
+func newCancelBatch(account, pair, side, operator, reason string) *CancelBatch {
+	now := time.Now()
+	return &CancelBatch{
+		ID:       util.GenerateUUID(),
+		Account:  account,
+		Pair:     pair,
+		Side:     side,
+		Operator: operator,
+		Reason:   reason,
+		Status:   CancelBatchQueued,
+		Orders:   []string{},
+		Skipped:  []FailInfo{},
+		Time:     now.Unix(),
+		Date:     now.Format("2006-01-02 15:04:05"),
+	}
+}
+
+// saveCancelBatch 在pipe中保存批次，保存app.cancel.batchTTL秒
+func saveCancelBatch(p *redis.Pipeline, batch *CancelBatch) {
+	js, _ := json.Marshal(batch)
+	ttl := time.Duration(viper.GetInt64("app.cancel.batchTTL")) * time.Second
+	p.Set(getCancelBatchKey(batch.ID), string(js), ttl)
+}
+
+// findCancelOrders 批次选中的挂单
+// 指定账户时从账户的未完成挂单中筛选，否则为交易对或所有交易对的买卖队列和触发队列中的挂单
+// 账户的未完成挂单中已不存在的挂单直接记入批次跳过的挂单
+func findCancelOrders(batch *CancelBatch) ([]*Order, error) {
+	base, quote, err := parseCancelFilter(batch.Pair, batch.Side)
+	if err != nil {
+		return nil, err
+	}
+
+	var uuids []string
+	switch {
+	case batch.Account != "":
+		uuids, err = getAllSetMember(getOpenOrdersKey(batch.Account))
+	case base != "":
+		uuids, err = getBookOrders(base, quote)
+	default:
+		uuids, err = getAllBookOrders()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := getOrders(uuids)
+	if err != nil {
+		return nil, err
+	}
+	orders := []*Order{}
+	for i, order := range all {
+		// 账户的未完成挂单已不存在时记入跳过的挂单，其他情况无法判断是否属于批次
+		if order == nil {
+			if batch.Account != "" {
+				batch.Skipped = append(batch.Skipped, FailInfo{Id: uuids[i], Info: cancelSkipInfo[CancelSkipNotFound]})
+			}
+			continue
+		}
+		if (batch.Account != "" && order.Account != batch.Account) || !matchCancelFilter(order, base, quote, batch.Side) {
+			continue
+		}
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+// moveCancelBatch 将选中的挂单分批移到待撤单队列，每批移动后保存批次，进度随之更新
+func moveCancelBatch(batch *CancelBatch, orders []*Order) error {
+	size := viper.GetInt("app.cancel.chunk")
+	for len(orders) > 0 {
+		chunk := orders
+		if size > 0 && len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		orders = orders[len(chunk):]
+
+		keys := []string{CancelingOrderKey, ExpiryKey, getQueueStream(CancelingOrderKey), CancelBatchOrdersKey, PendingOrdersKey}
+		args := []interface{}{batch.ID}
+		for _, order := range chunk {
+			keys = append(keys, getStopKey(order.SrcCurrency, order.DesCurrency), getBSKey(order.SrcCurrency, order.DesCurrency),
+				getRiskTotalsKey(order.Account), order.UUID)
+			args = append(args, order.UUID)
+		}
+
+		result, err := cancelBatchScript.Run(client, keys, args...).Result()
+		if err != nil {
+			return err
+		}
+		lists, _ := result.([]interface{})
+		if len(lists) == 2 {
+			moved, _ := lists[0].([]interface{})
+			for _, v := range moved {
+				uuid, _ := v.(string)
+				batch.Orders = append(batch.Orders, uuid)
+				saveOrderReason(uuid, batch.Reason)
+				addOrderHistory(uuid, EventCancel, batch.Reason)
+			}
+			skipped, _ := lists[1].([]interface{})
+			for i := 0; i+1 < len(skipped); i += 2 {
+				uuid, _ := skipped[i].(string)
+				reason, _ := skipped[i+1].(string)
+				batch.Skipped = append(batch.Skipped, FailInfo{Id: uuid, Info: cancelSkipInfo[reason]})
+			}
+		}
+
+		pipe := client.Pipeline()
+		saveCancelBatch(pipe, batch)
+		if _, err := pipe.Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCancelBatch 按批次的筛选条件撤单，完成后批次状态为done
+func runCancelBatch(batch *CancelBatch) error {
+	batch.Status = CancelBatchRunning
+	orders, err := findCancelOrders(batch)
+	if err != nil {
+		return err
+	}
+	err = moveCancelBatch(batch, orders)
+	if err != nil {
+		return err
+	}
+
+	batch.Status = CancelBatchDone
+	pipe := client.Pipeline()
+	saveCancelBatch(pipe, batch)
+	_, err = pipe.Exec()
+	if err != nil {
+		return err
+	}
+	myLogger.Infof("Cancel batch [%s] of [%s]: %d orders", batch.ID, batch.Account, len(batch.Orders))
+	return nil
+}
+
+// cancelBatch 批量撤销账户的挂单，pair为空时撤销所有挂单
+// 账户的挂单数有上限，在请求中直接处理
+func cancelBatch(account, pair, side string) (*CancelBatch, error) {
+	if _, _, err := parseCancelFilter(pair, side); err != nil {
+		return nil, err
+	}
+
+	batch := newCancelBatch(account, pair, side, "", CancelReasonUser)
+	if err := runCancelBatch(batch); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// queueCancelBatch 管理员批量撤单，批次排队后由execCancelJobs处理
+// account和pair都为空时撤销所有挂单
+func queueCancelBatch(account, pair, operator string) (*CancelBatch, error) {
+	batch := newCancelBatch(account, pair, "", operator, CancelReasonAdmin)
+
+	pipe := client.TxPipeline()
+	saveCancelBatch(pipe, batch)
+	pipe.SAdd(CancelJobsKey, batch.ID)
+	enqueue(pipe, CancelJobsKey, batch.ID)
+	_, err := pipe.Exec()
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Infof("Cancel batch [%s] queued by [%s].", batch.ID, operator)
+
+	return batch, nil
+}
+
+// execCancelJobs 处理排队的管理员批量撤单
+// 只将挂单移到待撤单队列，紧急停止期间也继续处理，chaincode解锁由execCancel在解除后进行
+// 处理中断时批次在消息超时后重新处理，已移到待撤单队列的挂单不再移动
+func execCancelJobs() {
+	for {
+		ids, err := readQueue(CancelJobsKey, 1)
+		if err != nil {
+			waitQueueError(err)
+			continue
+		}
+
+		for _, id := range ids {
+			batch, err := getCancelBatch(id)
+			if err == nil {
+				err = runCancelBatch(batch)
+			}
+			if err != nil && err != errCancelBatchNotFound {
+				myLogger.Errorf("Failed running cancel batch [%s]: %s", id, err)
+				continue
+			}
+			rmSetMember(CancelJobsKey, id)
+			ackQueue(CancelJobsKey, id)
+		}
+	}
+}
+
+// getCancelBatch 查询批量撤单的批次
+func getCancelBatch(id string) (*CancelBatch, error) {
+	js, err := client.Get(getCancelBatchKey(id)).Result()
+	if err == redis.Nil {
+		return nil, errCancelBatchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var batch CancelBatch
+	if err := json.Unmarshal([]byte(js), &batch); err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// getCancelBatchProgress 按挂单当前所处的队列统计批次进度
+func getCancelBatchProgress(batch *CancelBatch) *CancelBatchProgress {
+	progress := &CancelBatchProgress{Batch: batch, Total: len(batch.Orders)}
+	for _, v := range batch.Orders {
+		if ok, _ := isInSet(CancelingOrderKey, v); ok {
+			progress.Canceling++
+		} else if getOrderStatus(v) == 3 {
+			progress.Canceled++
+		} else {
+			progress.Failed++
+		}
+	}
+	progress.Done = batch.Status != CancelBatchQueued && batch.Status != CancelBatchRunning && progress.Canceling == 0
+	return progress
+}
+
+// pushCancelBatches 批量撤单的挂单有撤单结果后推送所属批次的进度
+func pushCancelBatches(uuids ...string) {
+	batches := make(map[string]bool)
+	for _, v := range uuids {
+		id, err := client.HGet(CancelBatchOrdersKey, v).Result()
+		if err != nil {
+			continue
+		}
+		client.HDel(CancelBatchOrdersKey, v)
+		batches[id] = true
+	}
+
+	for id := range batches {
+		batch, err := getCancelBatch(id)
+		if err != nil || batch.Operator != "" {
+			continue
+		}
+		pipe := client.Pipeline()
+		publishPush(pipe, ChannelCancels, batch.Account, getCancelBatchProgress(batch))
+		if _, err := pipe.Exec(); err != nil {
+			myLogger.Errorf("Failed pushing progress of cancel batch [%s]: %s", id, err)
+		}
+	}
+}
+
+// CancelBatch 批量撤单，请求内容 {"pair":"","side":""}，都为空时撤销所有挂单
+func (a *AppREST) CancelBatch(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing cancel batch request...")
+
+	encoder := json.NewEncoder(rw)
+
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: "Internal JSON error when reading request body."})
+
+		myLogger.Error("Internal JSON error when reading request body.")
+		return
+	}
+
+	var filter struct {
+		Pair string `json:"pair"`
+		Side string `json:"side"`
+	}
+	if len(reqBody) > 0 {
+		err = json.Unmarshal(reqBody, &filter)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			encoder.Encode(restResult{Err: fmt.Sprintf("Error unmarshalling cancel request payload: %s", err)})
+			return
+		}
+	}
+
+	if _, _, err := parseCancelFilter(filter.Pair, filter.Side); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+
+	batch, err := cancelBatch(a.Account, filter.Pair, filter.Side)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: getCancelBatchProgress(batch)})
+}
+
+// CancelBatchStatus 查询批量撤单的进度
+func (a *AppREST) CancelBatchStatus(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing cancel batch status request...")
+
+	encoder := json.NewEncoder(rw)
+
+	batch, err := getCancelBatch(req.PathParams["id"])
+	if err == errCancelBatchNotFound || (err == nil && (batch.Account != a.Account || batch.Operator != "")) {
+		rw.WriteHeader(http.StatusNotFound)
+		encoder.Encode(restResult{Err: errCancelBatchNotFound.Error()})
+		return
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: getCancelBatchProgress(batch)})
+}
+
+// AdminCancelBatchStatus 查询管理员批量撤单的进度
+func (a *AppREST) AdminCancelBatchStatus(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing admin cancel batch status request...")
+
+	encoder := json.NewEncoder(rw)
+
+	batch, err := getCancelBatch(req.PathParams["id"])
+	if err == errCancelBatchNotFound || (err == nil && batch.Operator == "") {
+		rw.WriteHeader(http.StatusNotFound)
+		encoder.Encode(restResult{Err: errCancelBatchNotFound.Error()})
+		return
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: getCancelBatchProgress(batch)})
+}
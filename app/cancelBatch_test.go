@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestParseCancelFilter(t *testing.T) {
+	tests := []struct {
+		pair, side  string
+		base, quote string
+		err         bool
+	}{
+		{"", "", "", "", false},
+		{"BTC_USD", "", "BTC", "USD", false},
+		{"BTC_USD", TradeSideBuy, "BTC", "USD", false},
+		{"BTC_USD", TradeSideSell, "BTC", "USD", false},
+		{"BTC_USD", "both", "", "", true},
+		{"", TradeSideBuy, "", "", true},
+		{"BTC", "", "", "", true},
+	}
+	for _, tt := range tests {
+		base, quote, err := parseCancelFilter(tt.pair, tt.side)
+		if (err != nil) != tt.err || base != tt.base || quote != tt.quote {
+			t.Errorf("parseCancelFilter(%q, %q) = %q, %q, %v", tt.pair, tt.side, base, quote, err)
+		}
+	}
+}
+
+func TestMatchCancelFilter(t *testing.T) {
+	sell := &Order{SrcCurrency: "BTC", DesCurrency: "USD"}
+	buy := &Order{SrcCurrency: "USD", DesCurrency: "BTC"}
+	other := &Order{SrcCurrency: "ETH", DesCurrency: "USD"}
+	tests := []struct {
+		order             *Order
+		base, quote, side string
+		want              bool
+	}{
+		{other, "", "", "", true},
+		{sell, "BTC", "USD", "", true},
+		{buy, "BTC", "USD", "", true},
+		{other, "BTC", "USD", "", false},
+		{sell, "BTC", "USD", TradeSideSell, true},
+		{buy, "BTC", "USD", TradeSideSell, false},
+		{sell, "BTC", "USD", TradeSideBuy, false},
+		{buy, "BTC", "USD", TradeSideBuy, true},
+	}
+	for _, tt := range tests {
+		if got := matchCancelFilter(tt.order, tt.base, tt.quote, tt.side); got != tt.want {
+			t.Errorf("matchCancelFilter(%s_%s, %q, %q, %q) = %v, want %v",
+				tt.order.SrcCurrency, tt.order.DesCurrency, tt.base, tt.quote, tt.side, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/redis.v5"
+)
+
+// K线：按交易对ID“基础币_计价币”和周期汇总成交，价格为每个基础币换得的计价币数量
+// 每笔成交在账本上有两个方向的交易记录，交易对只统计源币为基础币的一条：消耗的源币为成交量，得到的目标币为成交额
+// 启动时按账本TxLog2的交易记录重新计算，之后按chaincode_exchange事件中的交易记录更新
+// 事件监听将交易记录写入Stream，由一个K线任务汇总；最近app.market.candleDedupe秒内计算过的成交不再重复计算
+
+// candleIntervals K线周期及秒数
+var candleIntervals = map[string]int64{
+	"1m":  60,
+	"5m":  5 * 60,
+	"15m": 15 * 60,
+	"1h":  60 * 60,
+	"1d":  24 * 60 * 60,
+	"1w":  7 * 24 * 60 * 60,
+}
+
+var (
+	errInvalidInterval = errors.New("Interval must be one of 1m, 5m, 15m, 1h, 1d and 1w.")
+	errInvalidRange    = errors.New("From must be earlier than to.")
+)
+
+// Candle K线
+type Candle struct {
+	Time        int64   `json:"time"` //周期开始时间
+	Open        float64 `json:"open"`
+	High        float64 `json:"high"`
+	Low         float64 `json:"low"`
+	Close       float64 `json:"close"`
+	Volume      float64 `json:"volume"`      //基础币成交量
+	QuoteVolume float64 `json:"quoteVolume"` //计价币成交额
+	Trades      int     `json:"trades"`      //成交笔数
+	LastTime    int64   `json:"lastTime"`    //最后一笔成交的撮合时间
+}
+
+// candleTrade 一个方向的成交记录
+type candleTrade struct {
+	UUID        string  `json:"uuid"`
+	SrcCurrency string  `json:"srcCurrency"`
+	DesCurrency string  `json:"desCurrency"`
+	Spent       float64 `json:"spent"`    //消耗的源币数量
+	Received    float64 `json:"received"` //得到的目标币数量
+	Time        int64   `json:"time"`     //撮合时间
+}
+
+func getCandlesKey(pair, interval string) string {
+	return CandlesKey + "_" + pair + "_" + interval
+}
+
+// getCandleTime 成交时间所在周期的开始时间，周K线从周一开始
+func getCandleTime(t int64, interval string) int64 {
+	seconds := candleIntervals[interval]
+	offset := int64(0)
+	if interval == "1w" {
+		// 1970-01-01为周四，1970-01-05为周一
+		offset = 4 * 24 * 60 * 60
+	}
+	return t - (t-offset)%seconds
+}
+
+// newCandleTrade 账本上的交易记录或挂单转为成交记录
+func newCandleTrade(order *Order) *candleTrade {
+	return &candleTrade{
+		UUID:        order.UUID,
+		SrcCurrency: order.SrcCurrency,
+		DesCurrency: order.DesCurrency,
+		Spent:       order.FinalCost,
+		Received:    order.DesCount,
+		Time:        order.MatchedTime,
+	}
+}
+
+// addCandleTrades 将chaincode_exchange事件中的交易记录写入K线的成交Stream
+func addCandleTrades(trades []*OrderInt) {
+	if len(trades) == 0 {
+		return
+	}
+
+	pipe := client.Pipeline()
+	defer pipe.Close()
+	for _, v := range trades {
+		js, _ := json.Marshal(newCandleTrade(fromOrderInt(v)))
+		pipe.Process(redis.NewStringCmd("XADD", CandleTradesKey, "MAXLEN", "~", viper.GetInt64("app.market.candleStream"),
+			"*", "trade", string(js)))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		myLogger.Errorf("Failed adding candle trades: %s", err)
+	}
+}
+
+// candleDedupe 最近window秒内计算过的成交，超过时间窗口的记录删除
+// 用于跳过回填时已计算的成交和重复写入Stream的成交
+type candleDedupe struct {
+	window int64
+	seen   map[string]int64 //成交 -> 计算时间
+	pruned int64
+}
+
+func newCandleDedupe(window int64) *candleDedupe {
+	return &candleDedupe{window: window, seen: make(map[string]int64), pruned: time.Now().Unix()}
+}
+
+// add 记录成交，已计算过时返回true
+func (d *candleDedupe) add(uuid string) bool {
+	now := time.Now().Unix()
+	if now-d.pruned >= d.window {
+		for k, t := range d.seen {
+			if now-t >= d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.pruned = now
+	}
+
+	if _, ok := d.seen[uuid]; ok {
+		return true
+	}
+	d.seen[uuid] = now
+	return false
+}
+
+// applyCandleTrade 按成交更新K线
+func applyCandleTrade(candles map[string]*Candle, trade *candleTrade, interval string) {
+	if trade.Spent <= 0 || trade.Received <= 0 {
+		return
+	}
+	price := getTradePrice(trade.Spent, trade.Received)
+	field := strconv.FormatInt(getCandleTime(trade.Time, interval), 10)
+
+	c, ok := candles[field]
+	if !ok {
+		c = &Candle{Time: getCandleTime(trade.Time, interval), Open: price, High: price, Low: price, Close: price, LastTime: trade.Time}
+		candles[field] = c
+	}
+	if price > c.High {
+		c.High = price
+	}
+	if price < c.Low {
+		c.Low = price
+	}
+	if trade.Time >= c.LastTime {
+		c.Close = price
+		c.LastTime = trade.Time
+	}
+	c.Volume = round(c.Volume+trade.Spent, 6)
+	c.QuoteVolume = round(c.QuoteVolume+trade.Received, 6)
+	c.Trades++
+}
+
+// saveCandles 保存交易对一个周期的K线
+func saveCandles(pipe *redis.Pipeline, pair, interval string, candles map[string]*Candle) {
+	for field, v := range candles {
+		js, _ := json.Marshal(v)
+		pipe.HSet(getCandlesKey(pair, interval), field, string(js))
+	}
+}
+
+// getLastCandleTradeID 成交Stream中最后一条消息的ID
+func getLastCandleTradeID() (string, error) {
+	cmd := redis.NewSliceCmd("XREVRANGE", CandleTradesKey, "+", "-", "COUNT", 1)
+	client.Process(cmd)
+	if cmd.Err() != nil {
+		return "", cmd.Err()
+	}
+	if len(cmd.Val()) == 0 {
+		return "0-0", nil
+	}
+	entry, _ := cmd.Val()[0].([]interface{})
+	if len(entry) != 2 {
+		return "0-0", nil
+	}
+	id, _ := entry[0].(string)
+	return id, nil
+}
+
+// backfillCandles 按账本上所有的交易记录重新计算K线，已计算的交易记录加入dedupe
+// 返回计算前成交Stream的位置，之后从该位置继续更新
+func backfillCandles(dedupe *candleDedupe) (string, error) {
+	lastID, err := getLastCandleTradeID()
+	if err != nil {
+		return "", err
+	}
+
+	js, err := getTxLogs()
+	if err != nil {
+		return "", err
+	}
+	var txs []*OrderInt
+	err = json.Unmarshal([]byte(js), &txs)
+	if err != nil {
+		return "", err
+	}
+
+	// 交易对 -> 周期 -> K线
+	all := make(map[string]map[string]map[string]*Candle)
+	for _, v := range txs {
+		trade := newCandleTrade(fromOrderInt(v))
+		dedupe.add(trade.UUID)
+
+		pair := getPairID(trade.SrcCurrency, trade.DesCurrency)
+		if _, ok := all[pair]; !ok {
+			all[pair] = make(map[string]map[string]*Candle)
+			for interval := range candleIntervals {
+				all[pair][interval] = make(map[string]*Candle)
+			}
+		}
+		for interval := range candleIntervals {
+			applyCandleTrade(all[pair][interval], trade, interval)
+		}
+	}
+
+	for pair, intervals := range all {
+		pipe := client.TxPipeline()
+		for interval, candles := range intervals {
+			pipe.Del(getCandlesKey(pair, interval))
+			saveCandles(pipe, pair, interval, candles)
+		}
+		_, err = pipe.Exec()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return lastID, nil
+}
+
+// updateCandles 按一笔成交更新各周期已保存的K线
+func updateCandles(trade *candleTrade) error {
+	pair := getPairID(trade.SrcCurrency, trade.DesCurrency)
+
+	pipe := client.Pipeline()
+	for interval := range candleIntervals {
+		field := strconv.FormatInt(getCandleTime(trade.Time, interval), 10)
+		candles := make(map[string]*Candle)
+		if js, err := client.HGet(getCandlesKey(pair, interval), field).Result(); err == nil {
+			var c Candle
+			if json.Unmarshal([]byte(js), &c) == nil {
+				candles[field] = &c
+			}
+		}
+		applyCandleTrade(candles, trade, interval)
+		saveCandles(pipe, pair, interval, candles)
+	}
+	_, err := pipe.Exec()
+
+	return err
+}
+
+// readCandleTrades 阻塞读取成交Stream中lastID之后的消息，返回最后一条消息的ID
+func readCandleTrades(lastID string) ([]*candleTrade, string, error) {
+	cmd := redis.NewSliceCmd("XREAD", "COUNT", 100, "BLOCK", viper.GetInt64("redis.stream.block"),
+		"STREAMS", CandleTradesKey, lastID)
+	client.Process(cmd)
+	if cmd.Err() == redis.Nil {
+		return nil, lastID, nil
+	}
+	if cmd.Err() != nil {
+		return nil, lastID, cmd.Err()
+	}
+
+	// [[stream, [[id, [field, value]], ...]]]
+	trades := []*candleTrade{}
+	for _, stream := range cmd.Val() {
+		s, ok := stream.([]interface{})
+		if !ok || len(s) != 2 {
+			continue
+		}
+		list, _ := s[1].([]interface{})
+		for _, v := range list {
+			entry, ok := v.([]interface{})
+			if !ok || len(entry) != 2 {
+				continue
+			}
+			lastID, _ = entry[0].(string)
+			fields, _ := entry[1].([]interface{})
+			if len(fields) < 2 {
+				continue
+			}
+			js, _ := fields[1].(string)
+			var trade candleTrade
+			if err := json.Unmarshal([]byte(js), &trade); err != nil {
+				continue
+			}
+			trades = append(trades, &trade)
+		}
+	}
+	return trades, lastID, nil
+}
+
+// candleTask K线汇总任务，启动时按账本回填，之后按成交Stream更新，只需运行一个实例
+func candleTask() {
+	var lastID string
+	var dedupe *candleDedupe
+	for {
+		var err error
+		dedupe = newCandleDedupe(viper.GetInt64("app.market.candleDedupe"))
+		lastID, err = backfillCandles(dedupe)
+		if err == nil {
+			break
+		}
+		myLogger.Errorf("Failed backfilling candles: %s", err)
+		time.Sleep(10 * time.Second)
+	}
+
+	for {
+		waitKillSwitch("candleTask")
+
+		trades, id, err := readCandleTrades(lastID)
+		if err != nil {
+			myLogger.Errorf("Failed reading candle trades: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		lastID = id
+
+		for _, v := range trades {
+			// 回填时已计算或重复写入的交易记录
+			if dedupe.add(v.UUID) {
+				continue
+			}
+			if err := updateCandles(v); err != nil {
+				myLogger.Errorf("Failed updating candles of [%s]: %s", v.UUID, err)
+			}
+		}
+	}
+}
+
+// getCandles 交易对一个周期在from到to之间的K线，没有成交的周期不返回
+func getCandles(base, quote, interval string, from, to int64) ([]*Candle, error) {
+	seconds, ok := candleIntervals[interval]
+	if !ok {
+		return nil, errInvalidInterval
+	}
+
+	max := viper.GetInt64("app.market.maxCandles")
+	if to <= 0 {
+		to = time.Now().Unix()
+	}
+	if from <= 0 || (to-from)/seconds >= max {
+		from = to - (max-1)*seconds
+	}
+	if from > to {
+		return nil, errInvalidRange
+	}
+
+	fields := []string{}
+	for t := getCandleTime(from, interval); t <= to; t += seconds {
+		fields = append(fields, strconv.FormatInt(t, 10))
+	}
+	values, err := client.HMGet(getCandlesKey(getPairID(base, quote), interval), fields...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	candles := []*Candle{}
+	for _, v := range values {
+		js, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var c Candle
+		if err := json.Unmarshal([]byte(js), &c); err != nil {
+			continue
+		}
+		candles = append(candles, &c)
+	}
+	return candles, nil
+}
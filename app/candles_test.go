@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetCandleTime(t *testing.T) {
+	// 1700000000为2023-11-14（周二）22:13:20 UTC
+	tests := []struct {
+		t        int64
+		interval string
+		want     int64
+	}{
+		{1700000000, "1m", 1699999980},
+		{1700000000, "5m", 1699999800},
+		{1700000000, "15m", 1699999200},
+		{1700000000, "1h", 1699999200},
+		{1700000000, "1d", 1699920000},
+		{1700000000, "1w", 1699833600},
+		{1699999980, "1m", 1699999980},
+		{1699833600, "1w", 1699833600},
+		{1699833599, "1w", 1699228800},
+	}
+	for _, tt := range tests {
+		if got := getCandleTime(tt.t, tt.interval); got != tt.want {
+			t.Errorf("getCandleTime(%d, %q) = %d, want %d", tt.t, tt.interval, got, tt.want)
+		}
+	}
+}
+
+func TestCandleDedupe(t *testing.T) {
+	tests := []struct {
+		name string
+		age  int64 //已记录的成交距今的秒数，小于0表示未记录
+		want bool
+	}{
+		{"new", -1, false},
+		{"seen", 0, true},
+		{"seen within window", 590, true},
+		{"expired", 600, false},
+	}
+	for _, tt := range tests {
+		d := newCandleDedupe(600)
+		if tt.age >= 0 {
+			now := time.Now().Unix()
+			d.seen["uuid"] = now - tt.age
+			d.pruned = now - tt.age
+		}
+		if got := d.add("uuid"); got != tt.want {
+			t.Errorf("%s: add() = %v, want %v", tt.name, got, tt.want)
+		}
+		if !d.add("uuid") {
+			t.Errorf("%s: second add() = false, want true", tt.name)
+		}
+	}
+}
@@ -117,13 +117,12 @@ func assignCurrency(assigns string, user string) (txid string, err error) {
 	return invokeChaincode(invoker, chaincodeInput)
 }
 
-func exchange(exchanges string) (err error) {
+func exchange(exchanges string) (txid string, err error) {
 	// myLogger.Debugf("Chaincode [exchange] args:[%s]-[%s]", "exchanges", exchanges)
 
 	chaincodeInput := &pb.ChaincodeInput{Args: util.ToChaincodeArgs("exchange", exchanges)}
 
-	_, err = invokeChaincode(adminInvoker, chaincodeInput)
-	return
+	return invokeChaincodeSigma(adminInvoker, adminCert, chaincodeInput)
 }
 
 func lock(orders string, islock bool, srcMethod string) (txid string, err error) {
@@ -131,7 +130,14 @@ func lock(orders string, islock bool, srcMethod string) (txid string, err error)
 
 	chaincodeInput := &pb.ChaincodeInput{Args: util.ToChaincodeArgs("lock", orders, strconv.FormatBool(islock), srcMethod)}
 
-	return invokeChaincode(adminInvoker, chaincodeInput)
+	return invokeChaincodeSigma(adminInvoker, adminCert, chaincodeInput)
+}
+
+// saveOrderTerms 不需锁定或解锁差额的改单只更新账本上的挂单快照
+func saveOrderTerms(terms string) (txid string, err error) {
+	chaincodeInput := &pb.ChaincodeInput{Args: util.ToChaincodeArgs("saveOrderTerms", terms)}
+
+	return invokeChaincodeSigma(adminInvoker, adminCert, chaincodeInput)
 }
 
 func getCurrencys() (currencys string, err error) {
@@ -265,6 +271,18 @@ func getAsset(owner string) (asset string, err error) {
 	return queryChaincode(chaincodeInput)
 }
 
+func getLocks(owner string) (locks string, err error) {
+	// myLogger.Debugf("Chaincode [queryLocksByOwner] args:[%s]-[%s]", "owner", owner)
+	chaincodeInput := &pb.ChaincodeInput{Args: util.ToChaincodeArgs("queryLocksByOwner", owner)}
+
+	return queryChaincode(chaincodeInput)
+}
+
+func getOrderTerms() (terms string, err error) {
+	chaincodeInput := &pb.ChaincodeInput{Args: util.ToChaincodeArgs("queryOrderTerms")}
+	return queryChaincode(chaincodeInput)
+}
+
 func getTxLogs() (txLogs string, err error) {
 	chaincodeInput := &pb.ChaincodeInput{Args: util.ToChaincodeArgs("queryTxLogs")}
 	return queryChaincode(chaincodeInput)
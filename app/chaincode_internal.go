@@ -20,6 +20,7 @@ import (
 var (
 	confidentialityOn    bool
 	adminInvoker         crypto.Client
+	adminCert            crypto.CertificateHandler //管理员的ECert，部署时登记到chaincode，lock和exchange用它签名
 	confidentialityLevel pb.ConfidentialityLevel
 )
 
@@ -35,6 +36,11 @@ func initNVP() (err error) {
 		return
 	}
 
+	adminCert, err = adminInvoker.GetEnrollmentCertificateHandler()
+	if err != nil {
+		return
+	}
+
 	return
 }
 
@@ -91,10 +97,10 @@ func deployInternal() (resp *pb.Response, err error) {
 	chaincodePath = viper.GetString("chaincode.id.path")
 	// Prepare the spec
 	spec := &pb.ChaincodeSpec{
-		Type:        pb.ChaincodeSpec_GOLANG,
-		ChaincodeID: &pb.ChaincodeID{Path: chaincodePath},
-		CtorMsg:     &pb.ChaincodeInput{Args: util.ToChaincodeArgs("init")},
-		// Metadata:             "",
+		Type:                 pb.ChaincodeSpec_GOLANG,
+		ChaincodeID:          &pb.ChaincodeID{Path: chaincodePath},
+		CtorMsg:              &pb.ChaincodeInput{Args: util.ToChaincodeArgs("init")},
+		Metadata:             adminCert.GetCertificate(),
 		ConfidentialityLevel: confidentialityLevel,
 	}
 
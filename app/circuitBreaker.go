@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/spf13/viper"
+	"gopkg.in/redis.v5"
+)
+
+// 熔断：成交价相对window秒内的最高或最低成交价变动超过percent时，交易对两个方向暂停撮合cooldown秒
+// 撮合时按将要成交的价格检查，超过限制的撮合不执行，不等待chaincode执行交易后的成交记录
+// 暂停期间仍可挂单、改单和撤单，市价单被拒绝；冷却结束后由撮合任务恢复撮合
+// 管理员也可以暂停单个交易对或全部交易对（HaltAllPairs），手动暂停没有冷却时间，需由管理员恢复
+// 配置可按交易对覆盖，见getPairSetting；暂停和恢复事件可通过行情接口查询，行情中的halted同时推送
+
+// 熔断事件
+const (
+	HaltEventHalt   = "halt"   //暂停撮合
+	HaltEventResume = "resume" //恢复撮合
+
+	HaltAllPairs = "*" //暂停全部交易对
+)
+
+var errMarketHalted = errors.New("Matching of the pair is halted.")
+
+// MarketHalt 交易对的暂停或恢复事件
+type MarketHalt struct {
+	Pair       string  `json:"pair"`
+	Event      string  `json:"event"`
+	Reason     string  `json:"reason"`
+	Operator   string  `json:"operator,omitempty"` //手动暂停或恢复的管理员
+	Price      float64 `json:"price"`              //触发熔断的成交价
+	Reference  float64 `json:"reference"`          //窗口内与成交价相差最大的成交价
+	Move       float64 `json:"move"`               //变动百分比
+	ResumeTime int64   `json:"resumeTime"`         //预计恢复时间，0表示等待管理员恢复
+	Time       int64   `json:"time"`
+	Date       string  `json:"date"`
+}
+
+// MarketStatus 交易对的撮合状态和最近的熔断事件
+type MarketStatus struct {
+	Pair   string        `json:"pair"`
+	Halted bool          `json:"halted"`
+	Halt   *MarketHalt   `json:"halt"` //当前的暂停，未暂停时为null
+	Events []*MarketHalt `json:"events"`
+}
+
+// getHaltPairID 两个方向共用的交易对ID，取较小的一个
+func getHaltPairID(base, quote string) string {
+	pair, reverse := getPairID(base, quote), getPairID(quote, base)
+	if reverse < pair {
+		return reverse
+	}
+	return pair
+}
+
+func getHaltEventsKey(pair string) string {
+	return HaltEventsKey + "_" + pair
+}
+
+// isActive 暂停是否仍有效
+func (h *MarketHalt) isActive(now int64) bool {
+	return h.ResumeTime == 0 || h.ResumeTime > now
+}
+
+// getHalt 交易对当前的暂停，交易对本身的暂停已到期时返回全部交易对的暂停，都没有时为nil
+func getHalt(base, quote string) (*MarketHalt, error) {
+	values, err := client.HMGet(HaltsKey, getHaltPairID(base, quote), HaltAllPairs).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	halts := []*MarketHalt{}
+	for _, v := range values {
+		js, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var halt MarketHalt
+		if err := json.Unmarshal([]byte(js), &halt); err != nil {
+			return nil, err
+		}
+		halts = append(halts, &halt)
+	}
+	if len(halts) == 0 {
+		return nil, nil
+	}
+	if !halts[0].isActive(time.Now().Unix()) && len(halts) > 1 {
+		return halts[1], nil
+	}
+	return halts[0], nil
+}
+
+// isHalted 交易对是否暂停撮合
+func isHalted(base, quote string) bool {
+	halt, _ := getHalt(base, quote)
+	return halt != nil && halt.isActive(time.Now().Unix())
+}
+
+// addHaltEvent 记录熔断事件，只保留最近app.circuitBreaker.events条
+func addHaltEvent(pipe *redis.Pipeline, halt *MarketHalt) {
+	js, _ := json.Marshal(halt)
+	key := getHaltEventsKey(halt.Pair)
+	pipe.LPush(key, string(js))
+	pipe.LTrim(key, 0, viper.GetInt64("app.circuitBreaker.events")-1)
+}
+
+// checkCircuitBreaker 撮合前检查成交价相对窗口内成交的变动，超过限制时暂停撮合，返回是否已暂停
+// price为每个base换得的quote数量
+func checkCircuitBreaker(base, quote string, price float64) bool {
+	if !viper.GetBool("app.circuitBreaker.enabled") {
+		return false
+	}
+	percent := getPairSetting("app.circuitBreaker", "percent", base, quote)
+	window := int64(getPairSetting("app.circuitBreaker", "window", base, quote))
+	if percent <= 0 || window <= 0 || price <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	values, err := client.ZRangeByScore(getTradeStatsKey(getPairID(base, quote)), redis.ZRangeBy{
+		Min: fmt.Sprintf("%d", now.Unix()-window),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		myLogger.Errorf("Failed checking circuit breaker of [%s]: %s", getPairID(base, quote), err)
+		return false
+	}
+
+	move, reference := float64(0), float64(0)
+	for _, v := range values {
+		var trade Trade
+		if err := json.Unmarshal([]byte(v), &trade); err != nil || trade.Price <= 0 {
+			continue
+		}
+		m := (price - trade.Price) / trade.Price * 100
+		if m < 0 {
+			m = -m
+		}
+		if m > move {
+			move, reference = m, trade.Price
+		}
+	}
+	if move <= percent {
+		return false
+	}
+
+	cooldown := int64(getPairSetting("app.circuitBreaker", "cooldown", base, quote))
+	halt := &MarketHalt{
+		Pair:       getHaltPairID(base, quote),
+		Event:      HaltEventHalt,
+		Reason:     fmt.Sprintf("Price moved %.2f%% within %d seconds.", move, window),
+		Price:      price,
+		Reference:  reference,
+		Move:       round(move, 2),
+		ResumeTime: now.Unix() + cooldown,
+		Time:       now.Unix(),
+		Date:       now.Format("2006-01-02 15:04:05"),
+	}
+	js, _ := json.Marshal(halt)
+	ok, err := client.HSetNX(HaltsKey, halt.Pair, string(js)).Result()
+	if err != nil {
+		myLogger.Errorf("Failed halting [%s]: %s", halt.Pair, err)
+		return false
+	}
+	// 已有暂停（如其他实例同时触发）时不重复记录
+	if !ok {
+		return true
+	}
+
+	pipe := client.Pipeline()
+	addHaltEvent(pipe, halt)
+	pipe.Exec()
+	myLogger.Warningf("Matching of [%s] halted: %s", halt.Pair, halt.Reason)
+
+	pushTicker(base, quote)
+	return true
+}
+
+// marketHalted 撮合前检查交易对是否暂停，冷却结束的恢复撮合，返回是否仍暂停
+func marketHalted(base, quote string) bool {
+	halt, err := getHalt(base, quote)
+	if err != nil {
+		myLogger.Errorf("Failed getting halt of [%s]: %s", getPairID(base, quote), err)
+		return false
+	}
+	if halt == nil {
+		return false
+	}
+	now := time.Now()
+	if halt.isActive(now.Unix()) {
+		return true
+	}
+
+	// 多个实例同时恢复时只记录一次
+	n, err := client.HDel(HaltsKey, halt.Pair).Result()
+	if err != nil || n == 0 {
+		return false
+	}
+	pipe := client.Pipeline()
+	addHaltEvent(pipe, &MarketHalt{
+		Pair:   halt.Pair,
+		Event:  HaltEventResume,
+		Reason: "Cooldown finished.",
+		Time:   now.Unix(),
+		Date:   now.Format("2006-01-02 15:04:05"),
+	})
+	pipe.Exec()
+	myLogger.Infof("Matching of [%s] resumed.", halt.Pair)
+
+	pushTicker(base, quote)
+	return false
+}
+
+// getMarketStatus 交易对的撮合状态和最近的熔断事件
+func getMarketStatus(base, quote string) (*MarketStatus, error) {
+	halt, err := getHalt(base, quote)
+	if err != nil {
+		return nil, err
+	}
+	pair := getHaltPairID(base, quote)
+	events, err := getHaltEvents(pair)
+	if err != nil {
+		return nil, err
+	}
+	all, err := getHaltEvents(HaltAllPairs)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &MarketStatus{
+		Pair:   getPairID(base, quote),
+		Halted: halt != nil && halt.isActive(time.Now().Unix()),
+		Halt:   halt,
+		Events: []*MarketHalt{},
+	}
+	if !status.Halted {
+		status.Halt = nil
+	}
+	// 交易对和全部交易对的事件都按时间倒序，合并后仍按时间倒序
+	for len(events) > 0 || len(all) > 0 {
+		if len(all) == 0 || (len(events) > 0 && events[0].Time >= all[0].Time) {
+			status.Events = append(status.Events, events[0])
+			events = events[1:]
+		} else {
+			status.Events = append(status.Events, all[0])
+			all = all[1:]
+		}
+	}
+	return status, nil
+}
+
+// getHaltEvents 交易对的熔断事件，按时间倒序
+func getHaltEvents(pair string) ([]*MarketHalt, error) {
+	values, err := client.LRange(getHaltEventsKey(pair), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*MarketHalt{}
+	for _, v := range values {
+		var event MarketHalt
+		if err := json.Unmarshal([]byte(v), &event); err != nil {
+			continue
+		}
+		events = append(events, &event)
+	}
+	return events, nil
+}
+
+// MarketStatus 交易对的撮合状态和熔断事件
+func (a *AppREST) MarketStatus(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing market status request...")
+
+	encoder := json.NewEncoder(rw)
+
+	base, quote, err := parsePairID(req.PathParams["pair"])
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+
+	result, err := getMarketStatus(base, quote)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: result})
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/redis.v5"
+)
+
+// 失败批次的重试和死信
+// 整批失败（提交chaincode出错或交易被拒绝）以及成员的临时错误按退避时间重试
+// 失败次数达到上限或不可重试的成员移入死信，由管理员查看、重试或强制处理
+
+// methodQueues chaincode方法对应的队列集合
+var methodQueues = map[string]string{
+	"lock":     PendingOrdersKey,
+	"exchange": MatchedOrdersKey,
+	"expire":   ExpiredOrdersKey,
+	"cancel":   CancelingOrderKey,
+}
+
+// Batch 已提交chaincode的批次，交易被拒绝时按此找回批次成员
+type Batch struct {
+	TxID      string   `json:"txid"`
+	SrcMethod string   `json:"srcMethod"`
+	Members   []string `json:"members"`
+	Time      int64    `json:"time"`
+}
+
+// DeadLetter 死信，ID为队列成员
+type DeadLetter struct {
+	ID       string `json:"id"`
+	Key      string `json:"key"`      //所在的队列集合
+	Attempts int64  `json:"attempts"` //失败次数
+	Info     string `json:"info"`     //最后一次失败信息
+	Time     int64  `json:"time"`
+	Date     string `json:"date"`
+}
+
+var errDeadLetterNotFound = errors.New("Dead letter not found.")
+
+// deadLetters 按移入时间排序
+type deadLetters []*DeadLetter
+
+func (d deadLetters) Len() int           { return len(d) }
+func (d deadLetters) Less(i, j int) bool { return d[i].Time < d[j].Time }
+func (d deadLetters) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func getRetryKey(key string) string {
+	return RetryKey + "_" + key
+}
+
+func getRetryAttemptsKey(key string) string {
+	return RetryAttemptsKey + "_" + key
+}
+
+// addMemberHistory 记录队列成员对应挂单的历史，撮合好的交易对记录到两个挂单
+func addMemberHistory(member, event, reason string) {
+	for _, v := range strings.Split(member, ",") {
+		addOrderHistory(v, event, reason)
+	}
+}
+
+// submitBatch 记录提交的批次；提交出错时整批重试
+func submitBatch(srcMethod string, members []string, txid string, err error) {
+	if err != nil {
+		if key, ok := methodQueues[srcMethod]; ok {
+			retryMembers(key, members, err.Error())
+		}
+		return
+	}
+
+	js, _ := json.Marshal(&Batch{
+		TxID:      txid,
+		SrcMethod: srcMethod,
+		Members:   members,
+		Time:      time.Now().Unix(),
+	})
+	client.HSet(BatchesKey, txid, string(js))
+}
+
+// finishBatch chaincode结果已处理，删除批次记录
+func finishBatch(txid string) {
+	client.HDel(BatchesKey, txid)
+}
+
+// batchRejected chaincode交易被拒绝，整批失败
+// 队列成员整批重试，改单差额直接改单失败
+func batchRejected(txid, errMsg string) {
+	js, err := client.HGet(BatchesKey, txid).Result()
+	if err != nil {
+		return
+	}
+	finishBatch(txid)
+
+	var batch Batch
+	err = json.Unmarshal([]byte(js), &batch)
+	if err != nil {
+		return
+	}
+
+	if key, ok := methodQueues[batch.SrcMethod]; ok {
+		retryMembers(key, batch.Members, errMsg)
+		return
+	}
+	fails := []FailInfo{}
+	for _, v := range batch.Members {
+		fails = append(fails, FailInfo{Id: v, Info: errMsg})
+	}
+	if batch.SrcMethod == "amendLock" || batch.SrcMethod == "amendUnlock" {
+		amendFail(fails)
+	} else if batch.SrcMethod == "reconcile" {
+		finishReconciliation(nil, fails)
+	}
+}
+
+// expireBatches 超过app.listener.batchTimeout仍没有结果的批次按整批失败重试
+// 交易之后仍上链时，重试会因已执行过而按成功处理；改单差额不能重复执行，不按超时处理
+func expireBatches() {
+	values, err := client.HGetAll(BatchesKey).Result()
+	if err != nil {
+		return
+	}
+
+	deadline := time.Now().Unix() - viper.GetInt64("app.listener.batchTimeout")
+	for txid, v := range values {
+		var batch Batch
+		if err := json.Unmarshal([]byte(v), &batch); err != nil {
+			continue
+		}
+		if _, ok := methodQueues[batch.SrcMethod]; !ok || batch.Time > deadline {
+			continue
+		}
+		batchRejected(txid, "Timeout waiting for chaincode result.")
+	}
+}
+
+// isTransientFail 是否为可重试的临时错误
+// chaincode读取账本、计算余额等失败信息以“Failed”开头，余额不足、交易无效等校验失败不可重试
+func isTransientFail(info string) bool {
+	return strings.HasPrefix(info, "Failed")
+}
+
+// retryFails 临时错误的成员等待重试，其他直接移入死信
+func retryFails(key string, fails []FailInfo) {
+	for _, v := range fails {
+		if isTransientFail(v.Info) {
+			retryMembers(key, []string{v.Id}, v.Info)
+		} else {
+			deadLetter(key, v.Id, v.Info)
+		}
+	}
+}
+
+// retryBackoff 第attempts次失败后的等待时间，每次翻倍，不超过maxBackoff
+func retryBackoff(attempts int64) time.Duration {
+	backoff := viper.GetInt64("exchange.retry.backoff")
+	maxBackoff := viper.GetInt64("exchange.retry.maxBackoff")
+
+	delay := backoff
+	for i := int64(1); i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return time.Duration(delay) * time.Second
+}
+
+// retryMembers 记录失败次数，未达到上限时ack本次消息并按退避时间等待重试
+func retryMembers(key string, members []string, info string) {
+	maxAttempts := viper.GetInt64("exchange.retry.maxAttempts")
+
+	for _, v := range members {
+		attempts, err := client.HIncrBy(getRetryAttemptsKey(key), v, 1).Result()
+		if err != nil {
+			continue
+		}
+		if attempts >= maxAttempts {
+			deadLetter(key, v, info)
+			continue
+		}
+
+		delay := retryBackoff(attempts)
+		pipe := client.Pipeline()
+		pipe.ZAdd(getRetryKey(key), redis.Z{Member: v, Score: float64(time.Now().Add(delay).Unix())})
+		if id, err := client.HGet(getQueueEntries(key), v).Result(); err == nil {
+			ackEntry(pipe, key, id, v)
+		}
+		_, err = pipe.Exec()
+		if err != nil {
+			myLogger.Errorf("Failed scheduling retry of [%s]: %s", v, err)
+			continue
+		}
+
+		addMemberHistory(v, EventRetry, fmt.Sprintf("attempt %d, retry in %s: %s", attempts, delay, info))
+	}
+}
+
+// retryQueues 定时将到期的重试成员重新放入工作队列
+func retryQueues() {
+	for {
+		waitKillSwitch("retryQueues")
+
+		now := fmt.Sprintf("%d", time.Now().Unix())
+		for _, key := range queueKeys {
+			members, err := client.ZRangeByScore(getRetryKey(key), redis.ZRangeBy{
+				Min: "-inf",
+				Max: now,
+			}).Result()
+			if err != nil {
+				continue
+			}
+
+			for _, v := range members {
+				// 多个实例同时处理时只有移出成功的实例重新入队
+				if n, _ := client.ZRem(getRetryKey(key), v).Result(); n == 0 {
+					continue
+				}
+				if ok, _ := isInSet(key, v); ok {
+					enqueue(client, key, v)
+				}
+			}
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// deadLetter 将成员从队列集合移入死信，不再自动处理
+func deadLetter(key, member, info string) error {
+	attempts, _ := client.HGet(getRetryAttemptsKey(key), member).Int64()
+	now := time.Now()
+	js, _ := json.Marshal(&DeadLetter{
+		ID:       member,
+		Key:      key,
+		Attempts: attempts,
+		Info:     info,
+		Time:     now.Unix(),
+		Date:     now.Format("2006-01-02 15:04:05"),
+	})
+
+	pipe := client.TxPipeline()
+	pipe.HSet(DeadLetterKey, member, string(js))
+	pipe.SRem(key, member)
+	pipe.ZRem(getRetryKey(key), member)
+	pipe.HDel(getRetryAttemptsKey(key), member)
+	if id, err := client.HGet(getQueueEntries(key), member).Result(); err == nil {
+		ackEntry(pipe, key, id, member)
+	}
+	_, err := pipe.Exec()
+	if err != nil {
+		myLogger.Errorf("Failed moving [%s] to dead letter: %s", member, err)
+		return err
+	}
+
+	addMemberHistory(member, EventDeadLetter, info)
+	if key == CancelingOrderKey {
+		pushCancelBatches(member)
+	}
+
+	return nil
+}
+
+func getDeadLetter(id string) (*DeadLetter, error) {
+	js, err := client.HGet(DeadLetterKey, id).Result()
+	if err == redis.Nil {
+		return nil, errDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var letter DeadLetter
+	err = json.Unmarshal([]byte(js), &letter)
+	if err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+// getDeadLetters 按移入时间排序的所有死信
+func getDeadLetters() ([]*DeadLetter, error) {
+	values, err := client.HGetAll(DeadLetterKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	letters := []*DeadLetter{}
+	for _, v := range values {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(v), &letter); err != nil {
+			continue
+		}
+		letters = append(letters, &letter)
+	}
+	sort.Sort(deadLetters(letters))
+	return letters, nil
+}
+
+// retryDeadLetter 管理员重试死信，放回队列集合并重新计算失败次数
+func retryDeadLetter(id string) error {
+	letter, err := getDeadLetter(id)
+	if err != nil {
+		return err
+	}
+
+	pipe := client.TxPipeline()
+	pipe.HDel(DeadLetterKey, id)
+	pipe.SAdd(letter.Key, id)
+	enqueue(pipe, letter.Key, id)
+	_, err = pipe.Exec()
+	if err != nil {
+		return err
+	}
+
+	addMemberHistory(id, EventRetry, "manual retry of dead letter")
+
+	return nil
+}
+
+// resolveDeadLetter 管理员按核实的chaincode结果强制处理死信
+// success为true时按处理成功完成，否则按处理失败完成；执行交易和过期处理失败只记录原因
+func resolveDeadLetter(id string, success bool, reason string) error {
+	letter, err := getDeadLetter(id)
+	if err != nil {
+		return err
+	}
+
+	members := []string{id}
+	fails := []FailInfo{FailInfo{Id: id, Info: reason}}
+	if success || letter.Key == PendingOrdersKey || letter.Key == CancelingOrderKey {
+		// 按正常流程从队列集合中移出
+		err = client.SAdd(letter.Key, id).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case success && letter.Key == PendingOrdersKey:
+		lockSuccess(members)
+	case success && letter.Key == MatchedOrdersKey:
+		execTxSuccess(members)
+	case success && letter.Key == ExpiredOrdersKey:
+		expiredSuccess(members)
+	case success && letter.Key == CancelingOrderKey:
+		cancelSuccess(members)
+	case letter.Key == PendingOrdersKey:
+		lockFail(fails)
+	case letter.Key == CancelingOrderKey:
+		cancelFailed(fails)
+	default:
+		for _, v := range strings.Split(id, ",") {
+			saveOrderMetadata(v, reason)
+		}
+	}
+
+	err = client.HDel(DeadLetterKey, id).Err()
+	if err != nil {
+		return err
+	}
+
+	result := "failed"
+	if success {
+		result = "success"
+	}
+	if len(reason) > 0 {
+		result += ": " + reason
+	}
+	addMemberHistory(id, EventResolved, result)
+
+	return nil
+}
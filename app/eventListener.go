@@ -2,19 +2,21 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
-	"os"
+	"sync"
+	"time"
 
+	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/hyperledger/fabric/events/consumer"
 	pb "github.com/hyperledger/fabric/protos"
 	"github.com/spf13/viper"
+	"golang.org/x/net/context"
+	"gopkg.in/redis.v5"
 )
 
 type adapter struct {
 	blockEvent     chan *pb.Event_Block
-	chaincodeEvent chan *pb.Event_ChaincodeEvent
 	rejectionEvent chan *pb.Event_Rejection
-	chaincodeID    string
+	disconnected   chan error
 }
 type FailInfo struct {
 	Id   string `json:"id"`
@@ -22,34 +24,28 @@ type FailInfo struct {
 }
 
 type BatchResult struct {
-	EventName string     `json:"eventName"`
-	SrcMethod string     `json:"srcMethod"`
-	Success   []string   `json:""success`
-	Fail      []FailInfo `json:"fail"`
+	EventName string      `json:"eventName"`
+	SrcMethod string      `json:"srcMethod"`
+	Success   []string    `json:"success"`
+	Fail      []FailInfo  `json:"fail"`
+	Trades    []*OrderInt `json:"trades,omitempty"` //chaincode_exchange执行成功的交易，与账本上的交易记录相同
 }
 
-var (
-	chaincodeResult      = make(map[string]string)      //存储chaincode执行结果，key为txid，value为结果，最终成功以blockEvent为准
-	chaincodeBatchResult = make(map[string]BatchResult) //存储chaincode批量操作结果，key为txid，value为结果。该内容与chaincodeResult结合确定最终执行结果
-)
+// TxResult chaincode交易的最终结果，按txid保存在redis中，重启后不丢失
+type TxResult struct {
+	Result string       `json:"result"` //Chaincode_Success或交易被拒绝的错误信息
+	Block  uint64       `json:"block"`  //交易所在区块高度，被拒绝的交易为0
+	Batch  *BatchResult `json:"batch,omitempty"`
+}
 
 const Chaincode_Success = "SUCCESS"
 
+// blockMutex 区块按高度顺序处理，事件触发和定时补处理不能同时进行
+var blockMutex sync.Mutex
+
+// 区块事件只作为触发，交易结果以按高度读取的区块为准：
+// 区块中的交易为成功，批量操作的结果取区块中对应的chaincode事件；被拒绝的交易只能从rejection事件得到
 func (a *adapter) GetInterestedEvents() ([]*pb.Interest, error) {
-	if a.chaincodeID != "" {
-		return []*pb.Interest{
-			&pb.Interest{EventType: pb.EventType_BLOCK},
-			&pb.Interest{EventType: pb.EventType_REJECTION},
-			&pb.Interest{EventType: pb.EventType_CHAINCODE,
-				RegInfo: &pb.Interest_ChaincodeRegInfo{
-					ChaincodeRegInfo: &pb.ChaincodeReg{
-						ChaincodeID: a.chaincodeID,
-						EventName:   "",
-					},
-				},
-			},
-		}, nil
-	}
 	return []*pb.Interest{
 		&pb.Interest{EventType: pb.EventType_BLOCK},
 		&pb.Interest{EventType: pb.EventType_REJECTION},
@@ -60,99 +56,239 @@ func (a *adapter) Recv(msg *pb.Event) (bool, error) {
 	if e, o := msg.Event.(*pb.Event_Block); o {
 		a.blockEvent <- e
 		return true, nil
-	} else if e, o := msg.Event.(*pb.Event_ChaincodeEvent); o {
-		a.chaincodeEvent <- e
-		return true, nil
 	} else if e, o := msg.Event.(*pb.Event_Rejection); o {
 		a.rejectionEvent <- e
 		return true, nil
 	}
 
-	return false, fmt.Errorf("Receive unkown type event: %v", msg)
+	// 忽略其他事件，返回false会停止接收且不会通知断开
+	myLogger.Warningf("Receive unkown type event: %v", msg)
+	return true, nil
 }
 
 func (a *adapter) Disconnected(err error) {
-	// myLogger.Debug("Disconnected...exiting\n")
-	os.Exit(1)
+	select {
+	case a.disconnected <- err:
+	default:
+	}
 }
 
+// eventListener 监听区块和交易拒绝事件，断开后按退避时间重连，并按高度补处理断开期间的区块
 func eventListener(chaincodeID string) {
 	eventAddress := viper.GetString("peer.validator.events.address")
+	maxBackoff := time.Duration(viper.GetInt64("app.listener.maxBackoff")) * time.Second
+	backoff := time.Second
+
+	for {
+		a := &adapter{
+			blockEvent:     make(chan *pb.Event_Block),
+			rejectionEvent: make(chan *pb.Event_Rejection),
+			disconnected:   make(chan error, 1),
+		}
 
-	a := &adapter{
-		blockEvent:     make(chan *pb.Event_Block),
-		chaincodeEvent: make(chan *pb.Event_ChaincodeEvent),
-		rejectionEvent: make(chan *pb.Event_Rejection),
-		chaincodeID:    chaincodeID}
+		obcEHClient, _ := consumer.NewEventsClient(eventAddress, 5*time.Second, a)
+		if err := obcEHClient.Start(); err != nil {
+			myLogger.Errorf("Could not connect to event hub, retry in %s: %s", backoff, err)
+			obcEHClient.Stop()
 
-	obcEHClient, _ := consumer.NewEventsClient(eventAddress, 5, a)
-	if err := obcEHClient.Start(); err != nil {
-		// myLogger.Errorf("could not start chat %s\n", err)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+
+		dealBlocks(chaincodeID)
+		listen(a, chaincodeID)
 		obcEHClient.Stop()
-		return
 	}
+}
+
+// listen 处理事件直到连接断开，并定时补处理遗漏的区块
+func listen(a *adapter, chaincodeID string) {
+	ticker := time.NewTicker(time.Duration(viper.GetInt64("app.listener.interval")) * time.Second)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case b := <-a.blockEvent:
-			// myLogger.Debug("Received block\n")
-			// myLogger.Debug("--------------\n")
-			for _, r := range b.Block.Transactions {
-				// myLogger.Debugf("Transaction:\n\t[%v]\n", r)
-				chaincodeResult[r.Txid] = Chaincode_Success
-				dealResult(r.Txid)
-			}
+		case <-a.blockEvent:
+			dealBlocks(chaincodeID)
 		case r := <-a.rejectionEvent:
-			// myLogger.Debug("Received rejected transaction\n")
-			// myLogger.Debug("--------------\n")
-			// myLogger.Debugf("Transaction error:\n%s\n", r.Rejection.ErrorMsg)
-
 			if r.Rejection.Tx != nil {
-				chaincodeResult[r.Rejection.Tx.Txid] = r.Rejection.ErrorMsg
+				dealRejection(r.Rejection.Tx.Txid, r.Rejection.ErrorMsg)
 			}
-		case ce := <-a.chaincodeEvent:
-			// myLogger.Debug("Received chaincode event\n")
-			// myLogger.Debug("------------------------\n")
-			// myLogger.Debugf("Chaincode Event:%v\n", ce)
+		case <-ticker.C:
+			dealBlocks(chaincodeID)
+		case err := <-a.disconnected:
+			myLogger.Errorf("Disconnected from event hub: %v", err)
+			return
+		}
+	}
+}
+
+// dealBlocks 从上次处理的区块开始，按高度处理到最新区块，每处理完一个区块保存一次高度
+func dealBlocks(chaincodeID string) {
+	blockMutex.Lock()
+	defer blockMutex.Unlock()
+
+	openchain := pb.NewOpenchainClient(peerClientConn)
+	info, err := openchain.GetBlockchainInfo(context.Background(), &empty.Empty{})
+	if err != nil {
+		myLogger.Errorf("Failed getting blockchain info: %s", err)
+		return
+	}
+	if info.Height == 0 {
+		return
+	}
+
+	last, err := client.Get(ListenerCheckpointKey).Uint64()
+	if err == redis.Nil {
+		// 首次启动时从最新区块之后开始
+		client.Set(ListenerCheckpointKey, info.Height-1, 0)
+		return
+	}
+	if err != nil {
+		myLogger.Errorf("Failed getting listener checkpoint: %s", err)
+		return
+	}
+
+	for number := last + 1; number < info.Height; number++ {
+		block, err := openchain.GetBlockByNumber(context.Background(), &pb.BlockNumber{Number: number})
+		if err != nil {
+			myLogger.Errorf("Failed getting block %d: %s", number, err)
+			return
+		}
+
+		dealBlock(number, block, chaincodeID)
 
+		err = client.Set(ListenerCheckpointKey, number, 0).Err()
+		if err != nil {
+			myLogger.Errorf("Failed saving listener checkpoint %d: %s", number, err)
+			return
+		}
+	}
+
+	expireBatches()
+}
+
+// dealBlock 处理区块中的交易，重新处理同一区块时跳过已处理的交易
+func dealBlock(number uint64, block *pb.Block, chaincodeID string) {
+	batches := make(map[string]*BatchResult)
+	if block.NonHashData != nil {
+		for _, ce := range block.NonHashData.ChaincodeEvents {
+			if ce == nil || len(ce.Payload) == 0 || ce.ChaincodeID != chaincodeID {
+				continue
+			}
 			var batch BatchResult
-			err := json.Unmarshal(ce.ChaincodeEvent.Payload, &batch)
-			if err != nil {
+			if err := json.Unmarshal(ce.Payload, &batch); err != nil {
 				continue
 			}
-			chaincodeBatchResult[ce.ChaincodeEvent.TxID] = batch
-			dealResult(ce.ChaincodeEvent.TxID)
+			batches[ce.TxID] = &batch
 		}
 	}
+
+	for _, tx := range block.Transactions {
+		if isTxDealt(tx.Txid) {
+			continue
+		}
+		dealResult(tx.Txid, batches[tx.Txid])
+		saveTxResult(tx.Txid, &TxResult{Result: Chaincode_Success, Block: number, Batch: batches[tx.Txid]})
+		pushTxResult(tx.Txid, Chaincode_Success)
+	}
+}
+
+// dealRejection 处理被拒绝的交易
+func dealRejection(txid, errMsg string) {
+	if isTxDealt(txid) {
+		return
+	}
+	batchRejected(txid, errMsg)
+	saveTxResult(txid, &TxResult{Result: errMsg})
+	pushTxResult(txid, errMsg)
+}
+
+func getTxResultKey(txid string) string {
+	return TxResultKey + "_" + txid
+}
+
+// saveTxResult 保存交易结果，保留时间为app.listener.resultTTL
+func saveTxResult(txid string, result *TxResult) error {
+	ttl := time.Duration(viper.GetInt64("app.listener.resultTTL")) * time.Second
+	js, _ := json.Marshal(result)
+	return client.Set(getTxResultKey(txid), string(js), ttl).Err()
+}
+
+func isTxDealt(txid string) bool {
+	ok, _ := isKeyExists(getTxResultKey(txid))
+	return ok
+}
+
+// getChaincodeResult 交易结果，未出结果时返回false
+func getChaincodeResult(txid string) (string, bool) {
+	js, err := getString(getTxResultKey(txid))
+	if err != nil {
+		return "", false
+	}
+
+	var result TxResult
+	if err := json.Unmarshal([]byte(js), &result); err != nil {
+		return "", false
+	}
+	return result.Result, true
 }
 
-// 非批量操作的结果用chaincodeResult[txid]即可处理
+// 非批量操作的结果用getChaincodeResult(txid)即可处理
 // 批量操作的结果由两种
-// 1.成功：通过chaincodeResult[txid]=success 和 chaincodeBatchResult[txid].Success[] 来确定
-// 2.失败：a. chaincode里直接return err的失败，这种失败保存在chaincodeResult[txid]=ErrMsg中，表示整批操作全部失败.这种失败不处理失败成员
-// 		  b. chaincodeBatchResult[txid].Fail[]里的失败，表示批量处理部分失败（校验失败），这种失败是处理失败成员
-func dealResult(txid string) {
-	r1, ok1 := chaincodeBatchResult[txid]
-	r2, ok2 := chaincodeResult[txid]
-
-	if ok1 && ok2 {
-		if r2 == Chaincode_Success {
-			switch r1.EventName {
-			case "chaincode_lock":
-				if r1.SrcMethod == "lock" {
-					lockSuccess(r1.Success)
-					lockFail(r1.Fail)
-				} else if r1.SrcMethod == "expire" {
-					expiredSuccess(r1.Success)
-					expiredFail(r1.Fail)
-				} else if r1.SrcMethod == "cancel" {
-					cancelSuccess(r1.Success)
-					cancelFailed(r1.Fail)
-				}
-			case "chaincode_exchange":
-				execTxSuccess(r1.Success)
-				execTxFail(r1.Fail)
-			}
+// 1.成功：交易在区块中，且区块中对应的chaincode事件BatchResult.Success[] 来确定
+// 2.失败：a. chaincode里直接return err的失败，交易被拒绝或区块中没有对应的chaincode事件，表示整批操作全部失败.这种失败按提交时记录的批次整批重试
+//
+//	b. BatchResult.Fail[]里的失败，表示批量处理部分失败（校验失败），这种失败是处理失败成员
+func dealResult(txid string, r1 *BatchResult) {
+	if r1 == nil {
+		// 提交过批次却没有chaincode事件，整批失败
+		batchRejected(txid, "No chaincode event in block.")
+		return
+	}
+
+	// 重新认领的消息可能已处理过，按成功处理
+	r1.Success, r1.Fail = splitExeced(r1.Success, r1.Fail)
+
+	switch r1.EventName {
+	case "chaincode_lock":
+		if r1.SrcMethod == "lock" {
+			lockSuccess(r1.Success)
+			lockFail(r1.Fail)
+		} else if r1.SrcMethod == "expire" {
+			expiredSuccess(r1.Success)
+			expiredFail(r1.Fail)
+		} else if r1.SrcMethod == "cancel" {
+			cancelSuccess(r1.Success)
+			cancelFailed(r1.Fail)
+		} else if r1.SrcMethod == "amendLock" || r1.SrcMethod == "amendUnlock" {
+			amendSuccess(r1.Success)
+			amendFail(r1.Fail)
+		} else if r1.SrcMethod == "reconcile" {
+			finishReconciliation(r1.Success, r1.Fail)
+		}
+	case "chaincode_exchange":
+		addCandleTrades(r1.Trades)
+		execTxSuccess(r1.Success)
+		execTxFail(r1.Fail)
+	}
+	finishBatch(txid)
+}
+
+// splitExeced 将已执行过的失败结果归入成功结果
+func splitExeced(success []string, fails []FailInfo) ([]string, []FailInfo) {
+	others := []FailInfo{}
+	for _, v := range fails {
+		if v.Info == "execed" {
+			success = append(success, v.Id)
+			continue
 		}
+		others = append(others, v)
 	}
+	return success, others
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/redis.v5"
+)
+
+// 过期调度：买卖队列中有过期时间的挂单同时加入按过期时间排序的集合
+// 定时按过期时间顺序取出到期的挂单移到过期队列，由execExpired批量调用chaincode解锁
+// 挂单成交完、撤单或过期时从集合中移除，撤单失败放回买卖队列时重新加入
+
+// scheduleExpiry 有过期时间的挂单加入过期调度
+func scheduleExpiry(pipe *redis.Pipeline, order *Order) {
+	if order.ExpiredTime > 0 {
+		pipe.ZAdd(ExpiryKey, redis.Z{Member: order.UUID, Score: float64(order.ExpiredTime)})
+	}
+}
+
+// initExpiry 过期调度集合不存在时，将买卖队列中已有的挂单加入
+func initExpiry() {
+	if ok, _ := isKeyExists(ExpiryKey); ok {
+		return
+	}
+
+	pairs, err := getPairs()
+	if err != nil {
+		myLogger.Errorf("Failed initializing expiry: %s", err)
+		return
+	}
+	uuids := []string{}
+	for _, v := range pairs {
+		uuids = append(uuids, client.ZRange(getBSKey(v.SrcCurrency, v.DesCurrency), 0, -1).Val()...)
+		uuids = append(uuids, client.ZRange(getStopKey(v.SrcCurrency, v.DesCurrency), 0, -1).Val()...)
+	}
+
+	pipe := client.Pipeline()
+	for _, v := range uuids {
+		if order, err := getOrder(v); err == nil {
+			scheduleExpiry(pipe, order)
+		}
+	}
+	pipe.Exec()
+}
+
+// popExpired 按过期时间顺序取出最多count个到期的挂单
+func popExpired(count int64) ([]string, error) {
+	members, err := client.ZRangeByScore(ExpiryKey, redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   fmt.Sprintf("%d", time.Now().Unix()),
+		Count: count,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	uuids := []string{}
+	for _, v := range members {
+		// 多个实例同时处理时只有移出成功的实例处理
+		if n, _ := client.ZRem(ExpiryKey, v).Result(); n > 0 {
+			uuids = append(uuids, v)
+		}
+	}
+	return uuids, nil
+}
+
+// findExpired 定时任务按过期时间取出到期的挂单，移到过期队列
+func findExpired() {
+	batch := viper.GetInt64("redis.batch.expired")
+
+	initExpiry()
+
+	for {
+		waitKillSwitch("findExpired")
+
+		uuids, err := popExpired(batch)
+		if err != nil || len(uuids) == 0 {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, v := range uuids {
+			order, err := getOrder(v)
+			if err != nil {
+				continue
+			}
+			// 改单差额未处理完时稍后再处理，否则会重复解锁
+			if order.Amending != "" {
+				client.ZAdd(ExpiryKey, redis.Z{Member: v, Score: float64(time.Now().Unix() + 1)})
+				continue
+			}
+			dealExpired(v)
+		}
+	}
+}
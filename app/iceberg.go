@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// 冰山单：买卖队列中只显示DisplayCount的数量，其余数量隐藏在HiddenCount中
+// 卖完为止（IsBuyAll=false）时数量指源币数量，买完为止（IsBuyAll=true）时数量指目标币数量
+// 挂单时按母单全部数量锁定余额，可见部分成交完后从隐藏数量补充，并重新排队
+// 补充前的各笔成交均生成子单，RawUUID为母单UUID，最后一笔成交使用母单UUID
+
+// isIceberg 是否为冰山单
+func isIceberg(order *Order) bool {
+	return order.DisplayCount > 0
+}
+
+// prepareIceberg 校验冰山单，并将挂单数量拆分为可见部分和隐藏部分
+// 需在LockedCount和Price确定后调用
+func prepareIceberg(order *Order) error {
+	if order.DisplayCount < 0 {
+		return errors.New("DisplayCount must be greater than 0.")
+	}
+	if !isIceberg(order) {
+		order.HiddenCount = 0
+		return nil
+	}
+	if order.Type != OrderTypeLimit {
+		return errors.New("Iceberg order must be limit order.")
+	}
+	if isImmediate(order) {
+		return errors.New("Iceberg order must be GTC or GTD.")
+	}
+
+	total := order.SrcCount
+	if order.IsBuyAll {
+		total = order.DesCount
+	}
+	if order.DisplayCount >= total {
+		return errors.New("DisplayCount must be less than the order count.")
+	}
+
+	order.HiddenCount = round(total-order.DisplayCount, 6)
+	setSliceCount(order, order.DisplayCount)
+
+	return nil
+}
+
+// setSliceCount 按母单限价设置可见部分的挂单数量
+func setSliceCount(order *Order, count float64) {
+	if order.IsBuyAll {
+		order.DesCount = count
+		order.SrcCount = round(count/order.Price, 6)
+	} else {
+		order.SrcCount = count
+		order.DesCount = round(count*order.Price, 6)
+	}
+}
+
+// isSliceFilled 冰山单可见部分是否已成交完
+func isSliceFilled(order *Order) bool {
+	count := order.SrcCount
+	if order.IsBuyAll {
+		count = order.DesCount
+	}
+	return count*Multiple < 1
+}
+
+// refillIceberg 冰山单可见部分成交完时从隐藏数量补充，并按补充时间重新排队
+func refillIceberg(pipe *redis.Pipeline, order *Order, timeStamp int64) bool {
+	if order.HiddenCount <= 0 || !isSliceFilled(order) {
+		return false
+	}
+
+	slice := math.Min(order.DisplayCount, order.HiddenCount)
+	order.HiddenCount = round(order.HiddenCount-slice, 6)
+	setSliceCount(order, slice)
+	order.RefilledTime = timeStamp
+	order.RefilledDate = time.Unix(timeStamp, 0).Format("2006-01-02 15:04:05")
+
+	pipe.ZAdd(getBSKey(order.SrcCurrency, order.DesCurrency), redis.Z{Member: order.UUID, Score: getBookScore(order)})
+
+	return true
+}
+
+// getTotalCount 挂单剩余的全部数量，冰山单包括隐藏数量
+func getTotalCount(order *Order) float64 {
+	count := order.SrcCount
+	if order.IsBuyAll {
+		count = order.DesCount
+	}
+	return round(count+order.HiddenCount, 6)
+}
+
+// decrementIceberg 冰山单按母单限价减少count数量并解锁差额，优先减少隐藏数量，保留时间优先级
+// 改单流程与同价减量相同，count需小于剩余的全部数量
+func decrementIceberg(uuid string, count float64) (*Amendment, error) {
+	var amend *Amendment
+
+	err := updateOrder(uuid, func(order *Order, pipe *redis.Pipeline) error {
+		if order.Amending != "" {
+			return errors.New("Order is being amended.")
+		}
+		if !isIceberg(order) {
+			return errors.New("Order is not iceberg order.")
+		}
+		total := getTotalCount(order)
+		if count <= 0 || count >= total {
+			return errors.New("Invalid decrement count.")
+		}
+		score, err := client.ZScore(getBookKey(order), uuid).Result()
+		if err != nil {
+			return errors.New("Order is not in the book.")
+		}
+
+		hidden := round(math.Max(order.HiddenCount-count, 0), 6)
+		visible := round(total-count-hidden, 6)
+		slice := *order
+		setSliceCount(&slice, visible)
+
+		// 剩余锁定数量与减量后全部数量需要的源币数量之差
+		need := round(total-count, 6)
+		if order.IsBuyAll {
+			need = round(need/order.Price, 6)
+		}
+		locked := order.LockedCount - order.FilledCost
+
+		order.AmendCount++
+		amend = &Amendment{
+			ID:          fmt.Sprintf("%s@%d", uuid, order.AmendCount),
+			UUID:        uuid,
+			SrcCount:    slice.SrcCount,
+			DesCount:    slice.DesCount,
+			Diff:        math.Min(round(need-locked, 6), 0),
+			OldScore:    score,
+			OldSrcCount: order.SrcCount,
+			OldDesCount: order.DesCount,
+			HiddenCount: hidden,
+			OldHidden:   order.HiddenCount,
+			Status:      AmendPending,
+		}
+		applyAmendment(order, amend, pipe)
+		if amend.Diff != 0 {
+			order.Amending = amend.ID
+		} else {
+			amend.Status = AmendSuccess
+		}
+
+		js, _ := json.Marshal(amend)
+		pipe.HSet(AmendmentsKey, amend.ID, string(js))
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	addOrderHistory(uuid, EventAmend, amend.ID)
+
+	return amend, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestGetTotalCount(t *testing.T) {
+	tests := []struct {
+		name  string
+		order Order
+		want  float64
+	}{
+		{"sell all", Order{SrcCount: 10, DesCount: 20}, 10},
+		{"buy all", Order{SrcCount: 10, DesCount: 20, IsBuyAll: true}, 20},
+		{"iceberg", Order{SrcCount: 3, DesCount: 6, DisplayCount: 3, HiddenCount: 7}, 10},
+		{"iceberg buy all", Order{SrcCount: 1.5, DesCount: 3, DisplayCount: 3, HiddenCount: 0.1, IsBuyAll: true}, 3.1},
+	}
+	for _, tt := range tests {
+		if got := getTotalCount(&tt.order); got != tt.want {
+			t.Errorf("%s: getTotalCount() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetSliceCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		order    Order
+		count    float64
+		src, des float64
+		filled   bool
+	}{
+		{"sell all", Order{Price: 2}, 3, 3, 6, false},
+		{"buy all", Order{Price: 3, IsBuyAll: true}, 1, 0.333333, 1, false},
+		{"empty", Order{Price: 2}, 0, 0, 0, true},
+		{"dust", Order{Price: 2}, 0.0000001, 0.0000001, 0, true},
+	}
+	for _, tt := range tests {
+		order := tt.order
+		setSliceCount(&order, tt.count)
+		if order.SrcCount != tt.src || order.DesCount != tt.des {
+			t.Errorf("%s: setSliceCount() = %v, %v, want %v, %v", tt.name, order.SrcCount, order.DesCount, tt.src, tt.des)
+		}
+		if got := isSliceFilled(&order); got != tt.filled {
+			t.Errorf("%s: isSliceFilled() = %v, want %v", tt.name, got, tt.filled)
+		}
+	}
+}
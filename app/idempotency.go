@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/spf13/viper"
+)
+
+const idempotencyPending = "pending"
+
+// idempotencyRecord 已处理请求的响应，相同Idempotency-Key的重复请求直接返回该响应
+type idempotencyRecord struct {
+	BodyHash   string `json:"bodyHash"` //请求内容摘要，同一个key不能用于不同的请求内容
+	StatusCode int    `json:"statusCode"`
+	Response   string `json:"response"`
+}
+
+// recordResponseWriter 记录响应状态和内容
+type recordResponseWriter struct {
+	web.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *recordResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordResponseWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// Idempotency 带Idempotency-Key请求头的POST请求只处理一次，重复请求返回第一次的响应
+// 第一次请求处理完之前的重复请求返回409，同一个key用于不同请求内容时返回422
+func (a *AppREST) Idempotency(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	idemKey := req.Header.Get("Idempotency-Key")
+	if req.Method != "POST" || idemKey == "" {
+		next(rw, req)
+		return
+	}
+
+	encoder := json.NewEncoder(rw)
+
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: "Internal JSON error when reading request body."})
+
+		myLogger.Error("Internal JSON error when reading request body.")
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+
+	sum := sha256.Sum256(reqBody)
+	bodyHash := hex.EncodeToString(sum[:])
+	key := IdempotencyKey + "_" + a.Account + "_" + req.URL.Path + "_" + idemKey
+	ttl := time.Duration(viper.GetInt64("app.idempotency.ttl")) * time.Second
+
+	ok, err := client.SetNX(key, idempotencyPending, ttl).Result()
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: "Error redis operation."})
+
+		// myLogger.Errorf("Error redis operation: %s", err)
+		return
+	}
+	if !ok {
+		replayIdempotency(rw, key, bodyHash)
+		return
+	}
+
+	recorder := &recordResponseWriter{ResponseWriter: rw, statusCode: http.StatusOK}
+	next(recorder, req)
+
+	// 服务端错误不保存，允许客户端用同一个key重试
+	if recorder.statusCode >= http.StatusInternalServerError {
+		client.Del(key)
+		return
+	}
+
+	js, _ := json.Marshal(&idempotencyRecord{
+		BodyHash:   bodyHash,
+		StatusCode: recorder.statusCode,
+		Response:   recorder.body.String(),
+	})
+	client.Set(key, string(js), ttl)
+}
+
+// replayIdempotency 返回相同Idempotency-Key的请求第一次处理的响应
+func replayIdempotency(rw web.ResponseWriter, key, bodyHash string) {
+	encoder := json.NewEncoder(rw)
+
+	value, err := getString(key)
+	if err != nil || value == idempotencyPending {
+		rw.WriteHeader(http.StatusConflict)
+		encoder.Encode(restResult{Err: "A request with the same Idempotency-Key is in progress."})
+		return
+	}
+
+	var record idempotencyRecord
+	err = json.Unmarshal([]byte(value), &record)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: "Error unmarshalling idempotency record."})
+		return
+	}
+	if record.BodyHash != bodyHash {
+		rw.WriteHeader(422)
+		encoder.Encode(restResult{Err: "Idempotency-Key was used with a different request."})
+		return
+	}
+
+	rw.Header().Set("Idempotent-Replayed", "true")
+	rw.WriteHeader(record.StatusCode)
+	rw.Write([]byte(record.Response))
+}
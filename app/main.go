@@ -16,6 +16,8 @@ import (
 )
 
 type AppREST struct {
+	Account string  //会话或API Key对应的账户，由Authenticate设置
+	APIKey  *APIKey //使用API Key时的Key，会话登录时为nil
 }
 
 var myLogger = logging.MustGetLogger("app")
@@ -25,35 +27,124 @@ func buildRouter() *web.Router {
 
 	// Add middleware
 	router.Middleware((*AppREST).SetResponseType)
+	router.Middleware((*AppREST).RateLimitGlobal)
+	router.Middleware((*AppREST).Authenticate)
+	router.Middleware((*AppREST).Idempotency)
 
 	api := router.Subrouter(AppREST{}, "/api")
-	api.Post("/login", (*AppREST).Login)
-	api.Get("/logout", (*AppREST).Logout)
+	api.Post("/logout", (*AppREST).Logout)
 	api.Get("/islogin", (*AppREST).IsLogin)
-	api.Get("/my", (*AppREST).My)
+	api.Get("/push", (*AppREST).Push)
+
+	loginRouter := api.Subrouter(AppREST{}, "/login")
+	loginRouter.Middleware((*AppREST).RateLimitLogin)
+	loginRouter.Post("", (*AppREST).Login)
+
+	myRouter := api.Subrouter(AppREST{}, "/my")
+	myRouter.Middleware((*AppREST).RequireRead)
+	myRouter.Middleware((*AppREST).RateLimitRead)
+	myRouter.Get("", (*AppREST).My)
+
+	keysRouter := api.Subrouter(AppREST{}, "/keys")
+	keysRouter.Middleware((*AppREST).RequireSession)
+	keysRouter.Middleware((*AppREST).RateLimitRead)
+	keysRouter.Post("", (*AppREST).CreateAPIKey)
+	keysRouter.Get("", (*AppREST).APIKeys)
+	keysRouter.Delete("/:id", (*AppREST).RevokeAPIKey)
 
 	// Add routes
+	currencyTxRouter := api.Subrouter(AppREST{}, "/currency")
+	currencyTxRouter.Middleware((*AppREST).RequireWithdraw)
+	currencyTxRouter.Middleware((*AppREST).RequireIssuerRole)
+	currencyTxRouter.Middleware((*AppREST).RateLimitWithdraw)
+	currencyTxRouter.Post("/create", (*AppREST).Create)
+	currencyTxRouter.Post("/release", (*AppREST).Release)
+	currencyTxRouter.Post("/assign", (*AppREST).Assign)
+
+	currencyCheckRouter := api.Subrouter(AppREST{}, "/currency")
+	currencyCheckRouter.Middleware((*AppREST).RequireRead)
+	currencyCheckRouter.Middleware((*AppREST).RateLimitRead)
+	currencyCheckRouter.Get("/create/check/:txid", (*AppREST).CheckCreate)
+	currencyCheckRouter.Get("/release/check/:txid", (*AppREST).CheckRelease)
+	currencyCheckRouter.Get("/assign/check/:txid", (*AppREST).CheckAssign)
+
 	currencyRouter := api.Subrouter(AppREST{}, "/currency")
-	currencyRouter.Post("/create", (*AppREST).Create)
-	currencyRouter.Post("/release", (*AppREST).Release)
-	currencyRouter.Post("/assign", (*AppREST).Assign)
-	currencyRouter.Get("/create/check/:txid", (*AppREST).CheckCreate)
-	currencyRouter.Get("/release/check/:txid", (*AppREST).CheckRelease)
-	currencyRouter.Get("/assign/check/:txid", (*AppREST).CheckAssign)
+	currencyRouter.Middleware((*AppREST).RateLimitPublic)
 	currencyRouter.Get("/:id", (*AppREST).Currency)
 	currencyRouter.Get("/", (*AppREST).Currencys)
 
+	// 交易对ID为“基础币_计价币”，币种代码中的“%”和“_”转义
+	marketRouter := api.Subrouter(AppREST{}, "/market")
+	marketRouter.Middleware((*AppREST).RateLimitPublic)
+	marketRouter.Get("/:pair/depth", (*AppREST).MarketDepth)
+	marketRouter.Get("/:pair/ticker", (*AppREST).MarketTicker)
+	marketRouter.Get("/:pair/trades", (*AppREST).MarketTrades)
+	marketRouter.Get("/:pair/candles", (*AppREST).MarketCandles)
+	marketRouter.Get("/:pair/status", (*AppREST).MarketStatus)
+
 	txRouter := router.Subrouter(AppREST{}, "/tx")
+	txRouter.Middleware((*AppREST).RequireTrade)
+	txRouter.Middleware((*AppREST).RequireTraderRole)
+	txRouter.Middleware((*AppREST).RateLimitOrder)
 	txRouter.Post("/exchange", (*AppREST).Exchange)
-	txRouter.Post("/cancel", (*AppREST).Cancel)
-	txRouter.Get("/exchange/check/:uuid", (*AppREST).CheckOrder)
-	txRouter.Get("/cancel/check/:uuid", (*AppREST).CheckCancel)
+	txRouter.Post("/amend", (*AppREST).Amend)
+
+	// 撤单只需登录，trader角色被撤销的账户仍可撤销自己的挂单
+	cancelRouter := router.Subrouter(AppREST{}, "/tx/cancel")
+	cancelRouter.Middleware((*AppREST).RequireTrade)
+	cancelRouter.Middleware((*AppREST).RateLimitCancel)
+	cancelRouter.Post("", (*AppREST).Cancel)
+	cancelRouter.Post("/batch", (*AppREST).CancelBatch)
+
+	txCheckRouter := router.Subrouter(AppREST{}, "/tx")
+	txCheckRouter.Middleware((*AppREST).RequireRead)
+	txCheckRouter.Middleware((*AppREST).RateLimitRead)
+	txCheckRouter.Get("/exchange/check/:uuid", (*AppREST).CheckOrder)
+	txCheckRouter.Get("/cancel/check/:uuid", (*AppREST).CheckCancel)
+	txCheckRouter.Get("/cancel/batch/:id", (*AppREST).CancelBatchStatus)
+	txCheckRouter.Get("/amend/check/:id", (*AppREST).CheckAmend)
+	txCheckRouter.Get("/client/:clientOrderId", (*AppREST).ClientOrder)
+
+	adminRouter := router.Subrouter(AppREST{}, "/admin")
+	adminRouter.Middleware((*AppREST).RequireSession)
+	adminRouter.Middleware((*AppREST).Audit)
+	adminRouter.Middleware((*AppREST).RequireOperatorRole)
+	adminRouter.Get("/deadletter", (*AppREST).DeadLetters)
+	adminRouter.Get("/deadletter/:id", (*AppREST).DeadLetter)
+	adminRouter.Post("/deadletter/:id/retry", (*AppREST).RetryDeadLetter)
+	adminRouter.Post("/deadletter/:id/resolve", (*AppREST).ResolveDeadLetter)
+	adminRouter.Get("/reconcile", (*AppREST).Reconciliations)
+	adminRouter.Post("/reconcile", (*AppREST).Reconcile)
+	adminRouter.Get("/reconcile/:id", (*AppREST).Reconciliation)
+	adminRouter.Post("/reconcile/:id/approve", (*AppREST).ApproveReconciliation)
+	adminRouter.Post("/market/halt", (*AppREST).HaltAllMarkets)
+	adminRouter.Post("/market/resume", (*AppREST).ResumeAllMarkets)
+	adminRouter.Post("/market/:pair/halt", (*AppREST).HaltMarket)
+	adminRouter.Post("/market/:pair/resume", (*AppREST).ResumeMarket)
+	adminRouter.Post("/cancel/all", (*AppREST).CancelAllOrders)
+	adminRouter.Post("/cancel/pair/:pair", (*AppREST).CancelPairOrders)
+	adminRouter.Post("/cancel/account/:account", (*AppREST).CancelAccountOrders)
+	adminRouter.Get("/cancel/batch/:id", (*AppREST).AdminCancelBatchStatus)
+	adminRouter.Get("/killswitch", (*AppREST).KillSwitch)
+	adminRouter.Post("/killswitch", (*AppREST).EngageKillSwitch)
+	adminRouter.Post("/killswitch/release", (*AppREST).ReleaseKillSwitch)
+	adminRouter.Get("/audit", (*AppREST).AuditLog)
+
+	rolesRouter := router.Subrouter(AppREST{}, "/admin/roles")
+	rolesRouter.Middleware((*AppREST).RequireSession)
+	rolesRouter.Middleware((*AppREST).Audit)
+	rolesRouter.Middleware((*AppREST).RequireAdminRole)
+	rolesRouter.Get("/:enrollID", (*AppREST).Roles)
+	rolesRouter.Post("/:enrollID/grant", (*AppREST).GrantRole)
+	rolesRouter.Post("/:enrollID/revoke", (*AppREST).RevokeRole)
 
 	userRouter := router.Subrouter(AppREST{}, "/user")
+	userRouter.Middleware((*AppREST).RequireRead)
+	userRouter.Middleware((*AppREST).RateLimitRead)
 	// userRouter.Post("/login", (*AppREST).Login)
-	// userRouter.Get("/asset/:owner", (*AppREST).Asset)
-	// userRouter.Get("/currency/:user", (*AppREST).MyCurrency)
-	userRouter.Get("/tx/:user", (*AppREST).MyTxs)
+	// userRouter.Get("/asset", (*AppREST).Asset)
+	// userRouter.Get("/currency", (*AppREST).MyCurrency)
+	userRouter.Get("/tx", (*AppREST).MyTxs)
 	// Add not found page
 	router.NotFound((*AppREST).NotFound)
 
@@ -89,6 +180,24 @@ func main() {
 	// Enable fabric 'confidentiality'
 	confidentiality(false)
 
+	// 对账命令：reconcile 生成待审批的对账报告；reconcile approve [id] 审批并提交修正解锁
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		runReconcile(os.Args[2:])
+		return
+	}
+
+	// 重建命令：rebuild 从账本重建挂单；rebuild force 清空redis中的买卖队列和工作队列后重建
+	if len(os.Args) > 1 && os.Args[1] == "rebuild" {
+		runRebuild(os.Args[2:])
+		return
+	}
+
+	// 凭证命令：credentials [enrollID] 为已在本节点注册的客户端设置登录凭证，enrollSecret从标准输入读取
+	if len(os.Args) > 1 && os.Args[1] == "credentials" {
+		runCredentials(os.Args[2:])
+		return
+	}
+
 	// Deploy
 	if err := deploy(); err != nil {
 		// myLogger.Errorf("Failed deploying [%s]", err)
@@ -172,6 +281,18 @@ func main() {
 	// go execExpired()
 
 	// go execCancel()
+
+	// go execCancelJobs()
+
+	// go retryQueues()
+
+	// go reconcileTask()
+
+	// go candleTask()
+
+	// go pushTask()
+
+	// go pushListener()
 	fmt.Println("+++++++++++++++++")
 	time.Sleep(time.Minute)
 	restAddress := viper.GetString("app.rest.address")
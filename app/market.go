@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/redis.v5"
+)
+
+// 行情数据：交易对ID“基础币_计价币”，价格为每个基础币换得的计价币数量
+// 卖盘为源币是基础币的买卖队列，买盘为源币是计价币的买卖队列，只统计挂单可见的数量
+// 成交记录在chaincode执行交易成功后按两个方向分别保存，24小时统计按成交时间计算
+
+const (
+	TradeSideBuy  = "buy"  //主动买入基础币
+	TradeSideSell = "sell" //主动卖出基础币
+
+	tradeWindow = 24 * 60 * 60 //行情统计的时间范围
+)
+
+// PriceLevel 价格档位
+type PriceLevel struct {
+	Price  float64 `json:"price"`
+	Amount float64 `json:"amount"` //基础币数量
+	Total  float64 `json:"total"`  //计价币数量
+	Orders int     `json:"orders"` //挂单个数
+}
+
+// Depth 盘口深度
+type Depth struct {
+	Pair string        `json:"pair"`
+	Bids []*PriceLevel `json:"bids"` //买盘，价格从高到低
+	Asks []*PriceLevel `json:"asks"` //卖盘，价格从低到高
+	Time int64         `json:"time"`
+}
+
+// Ticker 行情
+type Ticker struct {
+	Pair          string  `json:"pair"`
+	Last          float64 `json:"last"` //最新成交价
+	Bid           float64 `json:"bid"`  //最高买价
+	Ask           float64 `json:"ask"`  //最低卖价
+	Open          float64 `json:"open"` //24小时内第一笔成交价
+	High          float64 `json:"high"`
+	Low           float64 `json:"low"`
+	Volume        float64 `json:"volume"`        //24小时基础币成交量
+	QuoteVolume   float64 `json:"quoteVolume"`   //24小时计价币成交量
+	Change        float64 `json:"change"`        //24小时涨跌
+	ChangePercent float64 `json:"changePercent"` //24小时涨跌幅，百分比
+	Halted        bool    `json:"halted"`        //是否熔断暂停撮合
+	Time          int64   `json:"time"`
+}
+
+// Trade 成交记录
+type Trade struct {
+	ID     string  `json:"id"` //成交的一对挂单“买入挂单UUID,卖出挂单UUID”
+	Price  float64 `json:"price"`
+	Amount float64 `json:"amount"` //基础币数量
+	Total  float64 `json:"total"`  //计价币数量
+	Side   string  `json:"side"`   //主动成交方向
+	Time   int64   `json:"time"`
+	Date   string  `json:"date"`
+}
+
+func getTradesKey(pair string) string {
+	return TradesKey + "_" + pair
+}
+
+func getTradeStatsKey(pair string) string {
+	return TradeStatsKey + "_" + pair
+}
+
+// recordTrade 保存chaincode执行成功的一对挂单“买入挂单UUID,卖出挂单UUID”的成交记录
+func recordTrade(member string) error {
+	uuids := strings.Split(member, ",")
+	buyOrder, err := getOrder(uuids[0])
+	if err != nil {
+		return err
+	}
+	sellOrder, err := getOrder(uuids[1])
+	if err != nil {
+		return err
+	}
+	if buyOrder.FinalCost <= 0 || sellOrder.FinalCost <= 0 {
+		return fmt.Errorf("FinalCost of [%s] must be greater than 0.", member)
+	}
+
+	// 较晚进入买卖队列的挂单为主动成交方，与撮合时成交价的取法一致
+	buyTaker := getBookTime(buyOrder) > getBookTime(sellOrder)
+	now := time.Now()
+
+	// 买单以源币为基础币时卖出基础币，卖单同理
+	buySide, sellSide := TradeSideBuy, TradeSideSell
+	if buyTaker {
+		buySide, sellSide = TradeSideSell, TradeSideBuy
+	}
+
+	// 成交价、成交量和成交额都按各方向挂单自己的消耗和所得计算，与K线一致
+	price := getTradePrice(buyOrder.FinalCost, buyOrder.DesCount)
+	pipe := client.TxPipeline()
+	addTrade(pipe, buyOrder.SrcCurrency, buyOrder.DesCurrency, &Trade{
+		ID:     member,
+		Price:  price,
+		Amount: buyOrder.FinalCost,
+		Total:  buyOrder.DesCount,
+		Side:   buySide,
+		Time:   now.Unix(),
+		Date:   now.Format("2006-01-02 15:04:05"),
+	})
+	addTrade(pipe, sellOrder.SrcCurrency, sellOrder.DesCurrency, &Trade{
+		ID:     member,
+		Price:  getTradePrice(sellOrder.FinalCost, sellOrder.DesCount),
+		Amount: sellOrder.FinalCost,
+		Total:  sellOrder.DesCount,
+		Side:   sellSide,
+		Time:   now.Unix(),
+		Date:   now.Format("2006-01-02 15:04:05"),
+	})
+	_, err = pipe.Exec()
+	if err != nil {
+		return err
+	}
+
+	pushTicker(buyOrder.SrcCurrency, buyOrder.DesCurrency)
+	return nil
+}
+
+// getTradePrice 一个方向的成交价，即每个消耗的源币得到的目标币数量，成交记录、行情和K线都按此计算
+func getTradePrice(spent, received float64) float64 {
+	if spent <= 0 {
+		return 0
+	}
+	return round(received/spent, 6)
+}
+
+// addTrade 保存并推送交易对的成交记录，最近的成交只保留配置的条数，统计只保留24小时内的成交
+// 与推送在同一事务中执行，订阅时的成交记录快照与序号一致
+func addTrade(pipe *redis.Pipeline, base, quote string, trade *Trade) {
+	pair := getPairID(base, quote)
+	js, _ := json.Marshal(trade)
+
+	pipe.LPush(getTradesKey(pair), string(js))
+	pipe.LTrim(getTradesKey(pair), 0, viper.GetInt64("app.market.trades")-1)
+	pipe.ZAdd(getTradeStatsKey(pair), redis.Z{Member: string(js), Score: float64(trade.Time)})
+	pipe.ZRemRangeByScore(getTradeStatsKey(pair), "-inf", fmt.Sprintf("(%d", trade.Time-tradeWindow))
+	publishPush(pipe, getPairChannel(ChannelTrades, base, quote), "", trade)
+}
+
+// getPriceLevels 按价格档位聚合买卖队列，最多depth档
+// isBid为true时队列中的挂单以计价币买入基础币
+func getPriceLevels(key string, isBid bool, depth int64) ([]*PriceLevel, error) {
+	const page = 100
+	now := time.Now().Unix()
+
+	levels := []*PriceLevel{}
+	for start := int64(0); ; start += page {
+		uuids, err := client.ZRange(key, start, start+page-1).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(uuids) == 0 {
+			break
+		}
+
+		orders, err := getOrders(uuids)
+		if err != nil {
+			return nil, err
+		}
+		for _, order := range orders {
+			if order == nil || (order.ExpiredTime > 0 && order.ExpiredTime <= now) {
+				continue
+			}
+
+			price, amount, total := round(order.DesCount/order.SrcCount, 6), order.SrcCount, order.DesCount
+			if isBid {
+				price, amount, total = round(order.SrcCount/order.DesCount, 6), order.DesCount, order.SrcCount
+			}
+
+			n := len(levels)
+			if n > 0 && levels[n-1].Price == price {
+				levels[n-1].Amount = round(levels[n-1].Amount+amount, 6)
+				levels[n-1].Total = round(levels[n-1].Total+total, 6)
+				levels[n-1].Orders++
+				continue
+			}
+			if int64(n) >= depth {
+				return levels, nil
+			}
+			levels = append(levels, &PriceLevel{Price: price, Amount: amount, Total: total, Orders: 1})
+		}
+	}
+	return levels, nil
+}
+
+// getDepth 交易对的盘口深度
+func getDepth(base, quote string, depth int64) (*Depth, error) {
+	asks, err := getPriceLevels(getBSKey(base, quote), false, depth)
+	if err != nil {
+		return nil, err
+	}
+	bids, err := getPriceLevels(getBSKey(quote, base), true, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Depth{
+		Pair: getPairID(base, quote),
+		Bids: bids,
+		Asks: asks,
+		Time: time.Now().Unix(),
+	}, nil
+}
+
+// getTicker 交易对的最新成交价、最优买卖价和24小时统计
+func getTicker(base, quote string) (*Ticker, error) {
+	pair := getPairID(base, quote)
+	now := time.Now().Unix()
+	ticker := &Ticker{
+		Pair:   pair,
+		Last:   getLastPrice(base, quote),
+		Halted: isHalted(base, quote),
+		Time:   now,
+	}
+
+	asks, err := getPriceLevels(getBSKey(base, quote), false, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(asks) > 0 {
+		ticker.Ask = asks[0].Price
+	}
+	bids, err := getPriceLevels(getBSKey(quote, base), true, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(bids) > 0 {
+		ticker.Bid = bids[0].Price
+	}
+
+	values, err := client.ZRangeByScore(getTradeStatsKey(pair), redis.ZRangeBy{
+		Min: fmt.Sprintf("%d", now-tradeWindow),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		var trade Trade
+		if err := json.Unmarshal([]byte(v), &trade); err != nil {
+			continue
+		}
+		if ticker.Open == 0 {
+			ticker.Open = trade.Price
+			ticker.Low = trade.Price
+		}
+		if trade.Price > ticker.High {
+			ticker.High = trade.Price
+		}
+		if trade.Price < ticker.Low {
+			ticker.Low = trade.Price
+		}
+		ticker.Volume = round(ticker.Volume+trade.Amount, 6)
+		ticker.QuoteVolume = round(ticker.QuoteVolume+trade.Total, 6)
+	}
+	if ticker.Open > 0 {
+		ticker.Change = round(ticker.Last-ticker.Open, 6)
+		ticker.ChangePercent = round(ticker.Change/ticker.Open*100, 2)
+	}
+
+	return ticker, nil
+}
+
+// getTrades 交易对最近的成交记录，按成交时间倒序
+func getTrades(base, quote string, limit int64) ([]*Trade, error) {
+	values, err := client.LRange(getTradesKey(getPairID(base, quote)), 0, limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	trades := []*Trade{}
+	for _, v := range values {
+		var trade Trade
+		if err := json.Unmarshal([]byte(v), &trade); err != nil {
+			continue
+		}
+		trades = append(trades, &trade)
+	}
+	return trades, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	OrderTypeLimit  = "limit"  //限价单
+	OrderTypeMarket = "market" //市价单
+)
+
+// marketSlippage 市价单实际使用的滑点，不指定或超过配置上限时取配置上限
+func marketSlippage(slippage float64) float64 {
+	max := viper.GetFloat64("exchange.market.slippage")
+	if slippage <= 0 || slippage > max {
+		return max
+	}
+	return slippage
+}
+
+// prepareMarketOrder 按对手盘推算市价单的挂单数量和最差价格
+// 卖完为止（IsBuyAll=false）：花费SrcCount个源币，DesCount按最差价格推算
+// 买完为止（IsBuyAll=true）：买入DesCount个目标币，SrcCount按最差价格推算，即需要锁定的源币数量
+// 最差价格=对手盘最优价格*(1+滑点)，数量不超过对手盘在最差价格以内能成交的数量，只锁定需要的余额
+func prepareMarketOrder(order *Order) error {
+	if order.IsBuyAll && order.DesCount <= 0 {
+		return errors.New("DesCount must be greater than 0.")
+	}
+	if !order.IsBuyAll && order.SrcCount <= 0 {
+		return errors.New("SrcCount must be greater than 0.")
+	}
+
+	order.Slippage = marketSlippage(order.Slippage)
+
+	levels, err := getOppositeOrders(order.SrcCurrency, order.DesCurrency)
+	if err != nil {
+		return err
+	}
+	if len(levels) == 0 {
+		return errors.New("No opposite orders for market order.")
+	}
+
+	fitMarketOrder(order, levels)
+	return nil
+}
+
+// fitMarketOrder 按对手盘levels（价格从优到劣）推算市价单的挂单数量
+func fitMarketOrder(order *Order, levels []*Order) {
+	// 对手单价格：对手单每个源币（即本单的目标币）需要的本单源币数量，对手盘按此价格从小到大排列
+	worst := levels[0].DesCount / levels[0].SrcCount * (1 + order.Slippage)
+
+	// 扫描对手盘，统计最差价格以内可成交的数量
+	srcCost, desGain := float64(0), float64(0)
+	for _, v := range levels {
+		if v.DesCount/v.SrcCount > worst {
+			break
+		}
+		srcCost += v.DesCount
+		desGain += v.SrcCount
+	}
+
+	if order.IsBuyAll {
+		if order.DesCount > desGain {
+			order.DesCount = round(desGain, 6)
+		}
+		order.SrcCount = round(order.DesCount*worst, 6)
+	} else {
+		if order.SrcCount > srcCost {
+			order.SrcCount = round(srcCost, 6)
+		}
+		order.DesCount = round(order.SrcCount/worst, 6)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestMarketSlippage(t *testing.T) {
+	viper.Set("exchange.market.slippage", 0.05)
+	defer viper.Set("exchange.market.slippage", nil)
+
+	tests := []struct {
+		slippage float64
+		want     float64
+	}{
+		{0, 0.05},
+		{-0.01, 0.05},
+		{0.02, 0.02},
+		{0.05, 0.05},
+		{0.1, 0.05},
+	}
+	for _, tt := range tests {
+		if got := marketSlippage(tt.slippage); got != tt.want {
+			t.Errorf("marketSlippage(%v) = %v, want %v", tt.slippage, got, tt.want)
+		}
+	}
+}
+
+func TestPrepareMarketOrderInvalid(t *testing.T) {
+	for _, order := range []Order{
+		{IsBuyAll: true, SrcCount: 10},
+		{IsBuyAll: false, DesCount: 10},
+		{IsBuyAll: false, SrcCount: -1},
+	} {
+		if err := prepareMarketOrder(&order); err == nil {
+			t.Errorf("prepareMarketOrder(%+v) succeeded, want error", order)
+		}
+	}
+}
+
+func TestFitMarketOrder(t *testing.T) {
+	// 对手盘价格依次为2、2.1、3，滑点10%时最差价格为2.2，前两档可成交，共花费41个源币，得到20个目标币
+	levels := []*Order{
+		{SrcCount: 10, DesCount: 20},
+		{SrcCount: 10, DesCount: 21},
+		{SrcCount: 10, DesCount: 30},
+	}
+	tests := []struct {
+		name     string
+		order    Order
+		src, des float64
+	}{
+		{"sell within depth", Order{SrcCount: 30}, 30, 13.636364},
+		{"sell beyond depth", Order{SrcCount: 100}, 41, 18.636364},
+		{"buy within depth", Order{IsBuyAll: true, DesCount: 15}, 33, 15},
+		{"buy beyond depth", Order{IsBuyAll: true, DesCount: 50}, 44, 20},
+	}
+	for _, tt := range tests {
+		order := tt.order
+		order.Slippage = 0.1
+		fitMarketOrder(&order, levels)
+		if order.SrcCount != tt.src || order.DesCount != tt.des {
+			t.Errorf("%s: fitMarketOrder() = %v, %v, want %v, %v", tt.name, order.SrcCount, order.DesCount, tt.src, tt.des)
+		}
+	}
+}
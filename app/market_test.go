@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestGetTradePrice(t *testing.T) {
+	tests := []struct {
+		spent, received float64
+		want            float64
+	}{
+		{2, 10, 5},
+		{3, 1, 0.333333},
+		{3, 2, 0.666667},
+		{0, 10, 0},
+		{-1, 10, 0},
+	}
+	for _, tt := range tests {
+		if got := getTradePrice(tt.spent, tt.received); got != tt.want {
+			t.Errorf("getTradePrice(%v, %v) = %v, want %v", tt.spent, tt.received, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+
+	"gopkg.in/redis.v5"
+)
+
+// 交易对登记：挂单首次进入某个交易方向的买卖队列或触发队列时登记交易对ID
+// 撮合、过期等按登记的交易对遍历买卖队列，不再用KEYS扫描整个redis
+
+// Pair 交易方向
+type Pair struct {
+	SrcCurrency string `json:"srcCurrency"`
+	DesCurrency string `json:"desCurrency"`
+}
+
+// registerPair 登记交易方向，需与挂单加入买卖队列同时执行
+func registerPair(pipe *redis.Pipeline, srcCurrency, desCurrency string) {
+	pipe.SAdd(PairsKey, getPairID(srcCurrency, desCurrency))
+}
+
+// getPairs 所有已登记的交易方向
+func getPairs() ([]*Pair, error) {
+	ids, err := getAllSetMember(PairsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := []*Pair{}
+	for _, v := range ids {
+		src, des, err := parsePairID(v)
+		if err != nil {
+			continue
+		}
+		pairs = append(pairs, &Pair{SrcCurrency: src, DesCurrency: des})
+	}
+	return pairs, nil
+}
+
+// initPairs 登记集合不存在时，按已有的买卖队列和触发队列登记
+// 只在升级后执行一次，使用SCAN避免阻塞redis
+func initPairs() {
+	if ok, _ := isKeyExists(PairsKey); ok {
+		return
+	}
+
+	for _, prefix := range []string{ExchangeKey + "_", StopOrdersKey + "_"} {
+		var cursor uint64
+		for {
+			keys, next, err := client.Scan(cursor, prefix+"*", 100).Result()
+			if err != nil {
+				myLogger.Errorf("Failed initializing pairs: %s", err)
+				return
+			}
+			for _, key := range keys {
+				id := strings.TrimPrefix(key, prefix)
+				if _, _, err := parsePairID(id); err != nil {
+					myLogger.Errorf("Failed registering book [%s]: %s", key, err)
+					continue
+				}
+				client.SAdd(PairsKey, id)
+			}
+
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+}
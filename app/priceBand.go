@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"gopkg.in/redis.v5"
+)
+
+// 价格带：挂单价格偏离参考价超过配置的百分比时拒绝
+// 参考价为最新成交价（last）或最近一段时间的成交量加权平均价（vwap），没有成交时不检查
+// 百分比可按交易对配置在app.priceBand.pairs.[交易对ID].percent，两个方向的交易对ID都可以
+
+// 参考价类型
+const (
+	ReferenceLast = "last"
+	ReferenceVWAP = "vwap"
+)
+
+// getPairSetting 交易对的配置，未单独配置时使用prefix下的默认值
+// 交易对ID由币种代码组成，可以包含“.”，不能拼接为viper的键，按配置中的键逐个比较（viper的键不区分大小写）
+func getPairSetting(prefix, name, base, quote string) float64 {
+	pairs := viper.GetStringMap(prefix + ".pairs")
+	for _, pair := range []string{getPairID(base, quote), getPairID(quote, base)} {
+		for k, v := range pairs {
+			if !strings.EqualFold(k, pair) {
+				continue
+			}
+			for field, value := range cast.ToStringMap(v) {
+				if strings.EqualFold(field, name) {
+					return cast.ToFloat64(value)
+				}
+			}
+		}
+	}
+	return viper.GetFloat64(prefix + "." + name)
+}
+
+// getVWAP 交易对最近window秒的成交量加权平均价，没有成交时为0
+func getVWAP(base, quote string, window int64) (float64, error) {
+	values, err := client.ZRangeByScore(getTradeStatsKey(getPairID(base, quote)), redis.ZRangeBy{
+		Min: fmt.Sprintf("%d", time.Now().Unix()-window),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	amount, total := float64(0), float64(0)
+	for _, v := range values {
+		var trade Trade
+		if err := json.Unmarshal([]byte(v), &trade); err != nil {
+			continue
+		}
+		amount += trade.Amount
+		total += trade.Total
+	}
+	if amount <= 0 {
+		return 0, nil
+	}
+	return total / amount, nil
+}
+
+// getReferencePrice 交易对的参考价，价格为每个base换得的quote数量
+// vwap窗口内没有成交时使用最新成交价
+func getReferencePrice(base, quote string) (float64, error) {
+	if viper.GetString("app.priceBand.reference") == ReferenceVWAP {
+		price, err := getVWAP(base, quote, viper.GetInt64("app.priceBand.window"))
+		if err != nil || price > 0 {
+			return price, err
+		}
+	}
+	return getLastPrice(base, quote), nil
+}
+
+// checkPriceBand 检查以srcCurrency换desCurrency的挂单价格是否在价格带内
+func checkPriceBand(srcCurrency, desCurrency string, price float64) error {
+	if !viper.GetBool("app.priceBand.enabled") {
+		return nil
+	}
+	percent := getPairSetting("app.priceBand", "percent", srcCurrency, desCurrency)
+	if percent <= 0 {
+		return nil
+	}
+
+	reference, err := getReferencePrice(srcCurrency, desCurrency)
+	if err != nil {
+		return err
+	}
+	if reference <= 0 {
+		return nil
+	}
+
+	if math.Abs(price-reference)/reference*100 > percent {
+		return fmt.Errorf("Price %.6f is more than %.2f%% away from the reference price %.6f.", price, percent, reference)
+	}
+	return nil
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/redis.v5"
+)
+
+// 推送：客户端通过WebSocket订阅频道，代替轮询check接口
+// 公共频道 depth.[交易对ID]、trades.[交易对ID]、ticker.[交易对ID]；私有频道 orders、txs、balances、cancels，需要登录，只推送本账户的消息
+// 每个频道（私有频道按账户）的消息有连续递增的序号，订阅时返回快照和快照对应的序号
+// 客户端丢弃序号不大于快照序号的消息，发现序号不连续时重新订阅
+// 消息由redis脚本编号后发布到PushChannel，各app实例收到后转发给本实例订阅的连接
+
+// 推送频道
+const (
+	ChannelDepth    = "depth"    //盘口深度变化的价格档位，数量为0表示档位已移除
+	ChannelTrades   = "trades"   //成交记录
+	ChannelTicker   = "ticker"   //行情
+	ChannelOrders   = "orders"   //挂单状态变化
+	ChannelTxs      = "txs"      //币的创建、发布、分发交易结果
+	ChannelBalances = "balances" //余额变化
+	ChannelCancels  = "cancels"  //批量撤单的进度
+
+	PushTypeSnapshot = "snapshot" //订阅时的快照
+	PushTypeUpdate   = "update"   //快照之后的变化
+)
+
+// privateChannels 需要登录的私有频道
+var privateChannels = map[string]bool{
+	ChannelOrders:   true,
+	ChannelTxs:      true,
+	ChannelBalances: true,
+	ChannelCancels:  true,
+}
+
+// balanceEvents 会改变余额的挂单事件
+var balanceEvents = map[string]bool{
+	EventPended:   true,
+	EventFinished: true,
+	EventCanceled: true,
+	EventExpired:  true,
+	EventAmended:  true,
+}
+
+// PushMessage 推送的消息
+type PushMessage struct {
+	Channel string          `json:"channel"`
+	Account string          `json:"account,omitempty"`
+	Seq     int64           `json:"seq"`
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// OrderEvent 挂单状态变化
+type OrderEvent struct {
+	Event  string `json:"event"`
+	Reason string `json:"reason"`
+	Status int    `json:"status"` //0：待交易，1：完成，2：过期，3：撤单
+	Order  *Order `json:"order"`
+	Time   int64  `json:"time"`
+}
+
+// TxEvent 币交易结果
+type TxEvent struct {
+	Txid   string `json:"txid"`
+	Result string `json:"result"` //Chaincode_Success或失败原因
+	Time   int64  `json:"time"`
+}
+
+// TxWatch 币交易提交者和余额受影响的账户
+type TxWatch struct {
+	Owner    string   `json:"owner"`
+	Accounts []string `json:"accounts"`
+}
+
+// pushScript 递增频道序号并发布消息，编号和发布在一个脚本中完成，消息顺序与序号一致
+var pushScript = redis.NewScript(`
+local seq = redis.call("HINCRBY", KEYS[1], ARGV[1], 1)
+local msg = '{"channel":' .. cjson.encode(ARGV[2])
+if ARGV[3] ~= "" then
+	msg = msg .. ',"account":' .. cjson.encode(ARGV[3])
+end
+msg = msg .. ',"seq":' .. seq .. ',"type":"update","data":' .. ARGV[4] .. '}'
+redis.call("PUBLISH", KEYS[2], msg)
+return seq
+`)
+
+// getPairChannel 公共频道名  [频道].[交易对ID] 格式
+func getPairChannel(channel, base, quote string) string {
+	return channel + "." + getPairID(base, quote)
+}
+
+// getPushSeqField 频道序号的field，私有频道按账户编号
+func getPushSeqField(channel, account string) string {
+	if account == "" {
+		return channel
+	}
+	return channel + "_" + account
+}
+
+func getTxWatchKey(txid string) string {
+	return TxWatchKey + "_" + txid
+}
+
+// publishPush 在pipe中发布频道消息，私有频道需指定账户
+func publishPush(pipe *redis.Pipeline, channel, account string, data interface{}) {
+	js, _ := json.Marshal(data)
+	pushScript.Eval(pipe, []string{PushSeqKey, PushChannel}, getPushSeqField(channel, account), channel, account, string(js))
+}
+
+// orderEvent 等待推送的挂单事件
+type orderEvent struct {
+	uuid   string
+	event  string
+	reason string
+	time   int64
+}
+
+// orderEvents 挂单事件由一个goroutine按顺序推送，推送慢时不影响挂单流程
+var (
+	orderEvents     chan *orderEvent
+	orderEventsOnce sync.Once
+)
+
+// pushOrderEvent 将挂单状态变化交给推送goroutine，缓冲区满时不推送
+func pushOrderEvent(uuid, event, reason string) {
+	orderEventsOnce.Do(func() {
+		orderEvents = make(chan *orderEvent, viper.GetInt("app.websocket.orderEvents"))
+		go sendOrderEvents()
+	})
+
+	select {
+	case orderEvents <- &orderEvent{uuid: uuid, event: event, reason: reason, time: time.Now().Unix()}:
+	default:
+		myLogger.Warningf("Order event buffer is full, event [%s] of order [%s] is not pushed.", event, uuid)
+	}
+}
+
+func sendOrderEvents() {
+	for e := range orderEvents {
+		sendOrderEvent(e)
+	}
+}
+
+// sendOrderEvent 推送挂单状态变化，改变余额的事件同时标记账户待推送余额
+func sendOrderEvent(e *orderEvent) {
+	order, err := getOrder(e.uuid)
+	if err != nil {
+		return
+	}
+
+	pipe := client.Pipeline()
+	publishPush(pipe, ChannelOrders, order.Account, &OrderEvent{
+		Event:  e.event,
+		Reason: e.reason,
+		Status: getOrderStatus(e.uuid),
+		Order:  order,
+		Time:   e.time,
+	})
+	if balanceEvents[e.event] {
+		pipe.SAdd(BalanceChangedKey, order.Account)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		myLogger.Errorf("Failed pushing event [%s] of order [%s]: %s", e.event, e.uuid, err)
+	}
+}
+
+// watchTx 记录币交易的提交者和余额受影响的账户，交易结果出来后推送，保留时间与交易结果相同
+func watchTx(txid, owner string, accounts ...string) {
+	ttl := time.Duration(viper.GetInt64("app.listener.resultTTL")) * time.Second
+	js, _ := json.Marshal(&TxWatch{Owner: owner, Accounts: append(accounts, owner)})
+	client.Set(getTxWatchKey(txid), string(js), ttl)
+}
+
+// pushTxResult 推送币交易结果，交易成功时标记受影响的账户待推送余额
+func pushTxResult(txid, result string) {
+	js, err := getString(getTxWatchKey(txid))
+	if err != nil {
+		return
+	}
+	var watch TxWatch
+	if err := json.Unmarshal([]byte(js), &watch); err != nil {
+		return
+	}
+
+	pipe := client.TxPipeline()
+	publishPush(pipe, ChannelTxs, watch.Owner, &TxEvent{Txid: txid, Result: result, Time: time.Now().Unix()})
+	if result == Chaincode_Success {
+		for _, v := range watch.Accounts {
+			pipe.SAdd(BalanceChangedKey, v)
+		}
+	}
+	pipe.Del(getTxWatchKey(txid))
+	if _, err := pipe.Exec(); err != nil {
+		myLogger.Errorf("Failed pushing result of tx [%s]: %s", txid, err)
+	}
+}
+
+// pushTicker 推送交易对两个方向的行情
+func pushTicker(base, quote string) {
+	pipe := client.Pipeline()
+	for _, v := range [][2]string{{base, quote}, {quote, base}} {
+		ticker, err := getTicker(v[0], v[1])
+		if err != nil {
+			myLogger.Errorf("Failed getting ticker of [%s]: %s", getPairID(v[0], v[1]), err)
+			return
+		}
+		publishPush(pipe, getPairChannel(ChannelTicker, v[0], v[1]), "", ticker)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		myLogger.Errorf("Failed pushing ticker of [%s]: %s", getPairID(base, quote), err)
+	}
+}
+
+// getAssetData 账户余额，chaincode返回的结果不是JSON时为null
+func getAssetData(account string) json.RawMessage {
+	asset, err := getAsset(account)
+	if err != nil {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(asset), &v); err != nil {
+		return nil
+	}
+	return json.RawMessage(asset)
+}
+
+// pushBalances 推送余额有变化的账户的最新余额
+func pushBalances() {
+	for {
+		accounts, err := client.SPopN(BalanceChangedKey, 100).Result()
+		if err != nil || len(accounts) == 0 {
+			return
+		}
+
+		pipe := client.Pipeline()
+		for _, v := range accounts {
+			publishPush(pipe, ChannelBalances, v, getAssetData(v))
+		}
+		if _, err := pipe.Exec(); err != nil {
+			myLogger.Errorf("Failed pushing balances: %s", err)
+		}
+	}
+}
+
+// diffLevels 与上次推送相比变化的价格档位，移除的档位数量为0
+func diffLevels(old, cur []*PriceLevel) []*PriceLevel {
+	prev := make(map[float64]*PriceLevel)
+	for _, v := range old {
+		prev[v.Price] = v
+	}
+
+	diff := []*PriceLevel{}
+	for _, v := range cur {
+		if p, ok := prev[v.Price]; !ok || *p != *v {
+			diff = append(diff, v)
+		}
+		delete(prev, v.Price)
+	}
+	for _, v := range old {
+		if _, ok := prev[v.Price]; ok {
+			diff = append(diff, &PriceLevel{Price: v.Price})
+		}
+	}
+	return diff
+}
+
+// pushDepth 推送交易对盘口的变化，快照与序号在同一事务中保存
+func pushDepth(base, quote string) error {
+	pair := getPairID(base, quote)
+	depth, err := getDepth(base, quote, viper.GetInt64("app.websocket.depth"))
+	if err != nil {
+		return err
+	}
+
+	old := &Depth{}
+	if js, err := client.HGet(DepthSnapshotKey, pair).Result(); err == nil {
+		json.Unmarshal([]byte(js), old)
+	}
+	diff := &Depth{
+		Pair: pair,
+		Bids: diffLevels(old.Bids, depth.Bids),
+		Asks: diffLevels(old.Asks, depth.Asks),
+		Time: depth.Time,
+	}
+	if len(diff.Bids) == 0 && len(diff.Asks) == 0 {
+		return nil
+	}
+
+	js, _ := json.Marshal(depth)
+	pipe := client.TxPipeline()
+	pipe.HSet(DepthSnapshotKey, pair, string(js))
+	publishPush(pipe, getPairChannel(ChannelDepth, base, quote), "", diff)
+	_, err = pipe.Exec()
+	return err
+}
+
+// pushTask 定时推送盘口变化和余额，只需运行一个实例
+func pushTask() {
+	interval := time.Duration(viper.GetInt64("app.websocket.interval")) * time.Millisecond
+	for {
+		time.Sleep(interval)
+		waitKillSwitch("pushTask")
+
+		pairs, err := getPairs()
+		if err != nil {
+			myLogger.Errorf("Failed getting pairs: %s", err)
+			continue
+		}
+		// 只有一个方向有挂单时另一方向的盘口也有变化
+		pushed := make(map[string]bool)
+		for _, v := range pairs {
+			for _, p := range [][2]string{{v.SrcCurrency, v.DesCurrency}, {v.DesCurrency, v.SrcCurrency}} {
+				pair := getPairID(p[0], p[1])
+				if pushed[pair] {
+					continue
+				}
+				pushed[pair] = true
+				if err := pushDepth(p[0], p[1]); err != nil {
+					myLogger.Errorf("Failed pushing depth of [%s]: %s", pair, err)
+				}
+			}
+		}
+
+		pushBalances()
+	}
+}
+
+// getPushSnapshot 订阅时的快照和快照对应的序号，orders和txs频道没有快照
+func getPushSnapshot(channel, account string) (*PushMessage, error) {
+	name, pair := channel, ""
+	if i := strings.Index(channel, "."); i >= 0 {
+		name, pair = channel[:i], channel[i+1:]
+	}
+	field := getPushSeqField(channel, account)
+	msg := &PushMessage{Channel: channel, Account: account, Type: PushTypeSnapshot, Data: json.RawMessage("null")}
+
+	var depth *redis.StringCmd
+	var trades *redis.StringSliceCmd
+	pipe := client.TxPipeline()
+	seq := pipe.HGet(PushSeqKey, field)
+	switch name {
+	case ChannelDepth:
+		depth = pipe.HGet(DepthSnapshotKey, pair)
+	case ChannelTrades:
+		trades = pipe.LRange(getTradesKey(pair), 0, viper.GetInt64("app.market.trades")-1)
+	}
+	_, err := pipe.Exec()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	msg.Seq, _ = seq.Int64()
+	if depth != nil && depth.Val() != "" {
+		msg.Data = json.RawMessage(depth.Val())
+	}
+	if trades != nil {
+		msg.Data = json.RawMessage("[" + strings.Join(trades.Val(), ",") + "]")
+	}
+
+	switch name {
+	case ChannelTicker:
+		// 行情每条消息都是完整的，快照不需要与序号一致
+		base, quote, _ := parsePairID(pair)
+		ticker, err := getTicker(base, quote)
+		if err != nil {
+			return nil, err
+		}
+		msg.Data, _ = json.Marshal(ticker)
+	case ChannelBalances:
+		// 先取序号再查余额，之后的余额消息不会比快照旧
+		if asset := getAssetData(account); asset != nil {
+			msg.Data = asset
+		}
+	}
+	return msg, nil
+}
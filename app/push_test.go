@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffLevels(t *testing.T) {
+	level := func(price, amount float64) *PriceLevel {
+		return &PriceLevel{Price: price, Amount: amount, Total: price * amount, Orders: 1}
+	}
+	tests := []struct {
+		name     string
+		old, cur []*PriceLevel
+		want     []*PriceLevel
+	}{
+		{"empty", nil, nil, []*PriceLevel{}},
+		{"unchanged", []*PriceLevel{level(1, 2)}, []*PriceLevel{level(1, 2)}, []*PriceLevel{}},
+		{"added", nil, []*PriceLevel{level(1, 2)}, []*PriceLevel{level(1, 2)}},
+		{"changed", []*PriceLevel{level(1, 2)}, []*PriceLevel{level(1, 3)}, []*PriceLevel{level(1, 3)}},
+		{"removed", []*PriceLevel{level(1, 2), level(2, 1)}, []*PriceLevel{level(2, 1)}, []*PriceLevel{&PriceLevel{Price: 1}}},
+		{
+			"mixed",
+			[]*PriceLevel{level(1, 2), level(2, 1), level(3, 1)},
+			[]*PriceLevel{level(2, 5), level(3, 1), level(4, 1)},
+			[]*PriceLevel{level(2, 5), level(4, 1), &PriceLevel{Price: 1}},
+		},
+	}
+	for _, tt := range tests {
+		if got := diffLevels(tt.old, tt.cur); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: diffLevels() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
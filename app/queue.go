@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/redis.v5"
+)
+
+// 待挂单、撮合好、过期、待撤单队列和管理员批量撤单的工作队列
+// 队列集合仍表示挂单所处的状态，同时按加入顺序写入对应的Stream：queue_[队列集合key]
+// 各任务通过消费组阻塞读取，chaincode结果确认后ack；未ack的消息超时后重新认领处理
+const (
+	QueueStreamKey  = "queue"        //工作队列Stream  queue_[队列集合key] 格式
+	QueueEntriesKey = "queueEntries" //队列成员对应的消息ID  queueEntries_[队列集合key] 格式，field为成员
+	QueueGroup      = "app"          //消费组
+)
+
+var queueKeys = []string{PendingOrdersKey, MatchedOrdersKey, ExpiredOrdersKey, CancelingOrderKey, CancelJobsKey}
+
+var queueConsumer = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}()
+
+// processor Client和Pipeline均可执行自定义命令
+type processor interface {
+	Process(cmd redis.Cmder) error
+}
+
+func getQueueStream(key string) string {
+	return QueueStreamKey + "_" + key
+}
+
+func getQueueEntries(key string) string {
+	return QueueEntriesKey + "_" + key
+}
+
+// initQueues 创建消费组，首次创建时将队列集合中已有的成员入队
+func initQueues() {
+	for _, key := range queueKeys {
+		cmd := redis.NewStatusCmd("XGROUP", "CREATE", getQueueStream(key), QueueGroup, "0", "MKSTREAM")
+		client.Process(cmd)
+		if err := cmd.Err(); err != nil {
+			if !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+				myLogger.Errorf("Failed creating consumer group of [%s]: %s", key, err)
+			}
+			continue
+		}
+
+		members, _ := getAllSetMember(key)
+		for _, v := range members {
+			enqueue(client, key, v)
+		}
+	}
+}
+
+// enqueue 将队列集合的成员写入工作队列，需与加入集合同时执行
+func enqueue(p processor, key, member string) {
+	p.Process(redis.NewStringCmd("XADD", getQueueStream(key), "*", "member", member))
+}
+
+// readQueue 读取工作队列，优先认领超时未ack的消息，没有消息时阻塞等待
+// 已不在队列集合中的成员（已处理完成）直接ack
+func readQueue(key string, count int64) ([]string, error) {
+	entries, err := claimQueue(key, count)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		block := viper.GetInt64("redis.stream.block")
+		cmd := redis.NewSliceCmd("XREADGROUP", "GROUP", QueueGroup, queueConsumer,
+			"COUNT", count, "BLOCK", block, "STREAMS", getQueueStream(key), ">")
+		client.Process(cmd)
+		if cmd.Err() == redis.Nil {
+			return nil, nil
+		}
+		if cmd.Err() != nil {
+			return nil, cmd.Err()
+		}
+
+		// [[stream, [[id, [field, value]], ...]]]
+		for _, stream := range cmd.Val() {
+			if s, ok := stream.([]interface{}); ok && len(s) == 2 {
+				entries = append(entries, parseEntries(key, s[1])...)
+			}
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	members := []string{}
+	pipe := client.Pipeline()
+	for _, v := range entries {
+		if ok, _ := isInSet(key, v[1]); !ok {
+			ackEntry(pipe, key, v[0], v[1])
+			continue
+		}
+		pipe.HSet(getQueueEntries(key), v[1], v[0])
+		members = append(members, v[1])
+	}
+	_, err = pipe.Exec()
+
+	return members, err
+}
+
+// claimQueue 认领超时未ack的消息
+func claimQueue(key string, count int64) ([][2]string, error) {
+	idle := viper.GetInt64("redis.stream.claimIdle") * 1000
+	cmd := redis.NewSliceCmd("XAUTOCLAIM", getQueueStream(key), QueueGroup, queueConsumer,
+		idle, "0-0", "COUNT", count)
+	client.Process(cmd)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+
+	// [next-id, [[id, [field, value]], ...], ...]
+	if len(cmd.Val()) < 2 {
+		return nil, nil
+	}
+	return parseEntries(key, cmd.Val()[1]), nil
+}
+
+// parseEntries 解析消息列表，返回[消息ID, 成员]
+func parseEntries(key string, val interface{}) [][2]string {
+	entries := [][2]string{}
+
+	list, _ := val.([]interface{})
+	for _, v := range list {
+		entry, ok := v.([]interface{})
+		if !ok || len(entry) != 2 {
+			continue
+		}
+		id, _ := entry[0].(string)
+		fields, _ := entry[1].([]interface{})
+		if len(fields) < 2 {
+			// 已删除的消息，直接ack
+			client.Process(redis.NewIntCmd("XACK", getQueueStream(key), QueueGroup, id))
+			continue
+		}
+		member, _ := fields[1].(string)
+		entries = append(entries, [2]string{id, member})
+	}
+	return entries
+}
+
+// ackQueue chaincode结果确认后ack并删除队列成员对应的消息，同时清除失败次数
+func ackQueue(key string, members ...string) {
+	pipe := client.Pipeline()
+	for _, v := range members {
+		pipe.HDel(getRetryAttemptsKey(key), v)
+		id, err := client.HGet(getQueueEntries(key), v).Result()
+		if err != nil {
+			continue
+		}
+		ackEntry(pipe, key, id, v)
+	}
+	pipe.Exec()
+}
+
+func ackEntry(pipe *redis.Pipeline, key, id, member string) {
+	pipe.Process(redis.NewIntCmd("XACK", getQueueStream(key), QueueGroup, id))
+	pipe.Process(redis.NewIntCmd("XDEL", getQueueStream(key), id))
+	pipe.HDel(getQueueEntries(key), member)
+}
+
+// waitQueueError 读取队列出错时等待一段时间，避免空转
+func waitQueueError(err error) {
+	myLogger.Errorf("Failed reading queue: %s", err)
+	time.Sleep(time.Second)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/spf13/viper"
+	"gopkg.in/redis.v5"
+)
+
+// 限流：令牌桶保存在redis中，多个app实例共享
+// 每类接口按账户、API Key和IP分别限流，配置在app.rateLimit.[类别].account、app.rateLimit.[类别].key和app.rateLimit.[类别].ip
+// 已登录的请求都计入账户的令牌桶，API Key的请求同时计入该Key的令牌桶，未配置key时使用account的配置
+// rate为每秒补充的令牌数，burst为桶的容量，rate为0表示不限
+// 所有请求还按IP计入global类别，在校验会话和API Key之前检查，防止猜测签名
+// 超出限制返回429和Retry-After，redis出错时不限流
+
+// 接口类别
+const (
+	RateGlobal   = "global"   //所有请求，只按IP
+	RateLogin    = "login"    //登录
+	RatePublic   = "public"   //行情、币信息等公共查询
+	RateRead     = "read"     //账户查询
+	RateOrder    = "order"    //挂单和改单
+	RateCancel   = "cancel"   //撤单
+	RateWithdraw = "withdraw" //币的创建、发布和分发
+)
+
+// rateLimitScript 检查所有令牌桶，都有令牌时各扣一个并返回0，否则不扣并返回需要等待的毫秒数
+// KEYS为令牌桶，ARGV[1]为当前毫秒时间，之后每个桶两个参数：rate和burst
+var rateLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local wait = 0
+local tokens = {}
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[i * 2])
+	local burst = tonumber(ARGV[i * 2 + 1])
+	local state = redis.call("HMGET", key, "tokens", "ts")
+	local left = tonumber(state[1]) or burst
+	local ts = tonumber(state[2]) or now
+	left = math.min(burst, left + math.max(0, now - ts) * rate / 1000)
+	if left < 1 then
+		wait = math.max(wait, math.ceil((1 - left) * 1000 / rate))
+	end
+	tokens[i] = left
+end
+if wait > 0 then
+	return wait
+end
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[i * 2])
+	local burst = tonumber(ARGV[i * 2 + 1])
+	redis.call("HMSET", key, "tokens", tokens[i] - 1, "ts", now)
+	redis.call("PEXPIRE", key, math.ceil(burst * 1000 / rate) + 1000)
+end
+return 0
+`)
+
+func getRateLimitKey(class, kind, id string) string {
+	return RateLimitKey + "_" + class + "_" + kind + "_" + id
+}
+
+// getClientIP 请求的IP，app.rateLimit.trustProxy开启时取X-Forwarded-For的第一个地址
+func getClientIP(req *web.Request) string {
+	if viper.GetBool("app.rateLimit.trustProxy") {
+		if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// takeToken 从请求对应的令牌桶中各取一个令牌，返回需要等待的时间，0表示未限流
+func (a *AppREST) takeToken(class string, req *web.Request) (time.Duration, error) {
+	prefix := "app.rateLimit." + class
+	keys := []string{}
+	args := []interface{}{time.Now().UnixNano() / int64(time.Millisecond)}
+	add := func(kind, id, config string) {
+		rate := viper.GetFloat64(prefix + "." + config + ".rate")
+		burst := viper.GetFloat64(prefix + "." + config + ".burst")
+		if rate <= 0 || burst <= 0 {
+			return
+		}
+		keys = append(keys, getRateLimitKey(class, kind, id))
+		args = append(args, rate, burst)
+	}
+
+	add("ip", getClientIP(req), "ip")
+	// 账户的令牌桶由会话和该账户所有API Key共用，API Key另有各自的令牌桶
+	if a.Account != "" {
+		add("account", a.Account, "account")
+	}
+	if a.APIKey != nil {
+		config := "key"
+		if !viper.IsSet(prefix + ".key") {
+			config = "account"
+		}
+		add("key", a.APIKey.ID, config)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	result, err := rateLimitScript.Run(client, keys, args...).Result()
+	if err != nil {
+		return 0, err
+	}
+	wait, _ := result.(int64)
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+// rateLimit 按类别限流
+func (a *AppREST) rateLimit(class string, rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if !viper.GetBool("app.rateLimit.enabled") {
+		next(rw, req)
+		return
+	}
+
+	wait, err := a.takeToken(class, req)
+	if err != nil {
+		myLogger.Errorf("Failed checking rate limit [%s]: %s", class, err)
+		next(rw, req)
+		return
+	}
+	if wait > 0 {
+		seconds := int64((wait + time.Second - 1) / time.Second)
+		rw.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+		rw.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(rw).Encode(restResult{Err: fmt.Sprintf("Too many %s requests, retry after %d seconds.", class, seconds)})
+		return
+	}
+	next(rw, req)
+}
+
+// RateLimitGlobal 所有请求按IP限流
+func (a *AppREST) RateLimitGlobal(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	a.rateLimit(RateGlobal, rw, req, next)
+}
+
+// RateLimitLogin 登录限流
+func (a *AppREST) RateLimitLogin(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	a.rateLimit(RateLogin, rw, req, next)
+}
+
+// RateLimitPublic 公共查询限流
+func (a *AppREST) RateLimitPublic(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	a.rateLimit(RatePublic, rw, req, next)
+}
+
+// RateLimitRead 账户查询限流
+func (a *AppREST) RateLimitRead(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	a.rateLimit(RateRead, rw, req, next)
+}
+
+// RateLimitOrder 挂单和改单限流
+func (a *AppREST) RateLimitOrder(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	a.rateLimit(RateOrder, rw, req, next)
+}
+
+// RateLimitCancel 撤单限流，与挂单分开计算，挂单被限流时仍可撤单
+func (a *AppREST) RateLimitCancel(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	a.rateLimit(RateCancel, rw, req, next)
+}
+
+// RateLimitWithdraw 币的创建、发布和分发限流
+func (a *AppREST) RateLimitWithdraw(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	a.rateLimit(RateWithdraw, rw, req, next)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// TestRateLimitScript 令牌桶的补充和等待时间，需要REDIS_TEST_ADDR指定的redis
+func TestRateLimitScript(t *testing.T) {
+	addr := os.Getenv("REDIS_TEST_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_TEST_ADDR is not set.")
+	}
+	client = redis.NewClient(&redis.Options{Addr: addr})
+	defer client.Close()
+
+	type bucket struct{ rate, burst float64 }
+	type step struct {
+		at   int64 //毫秒
+		wait int64 //毫秒
+	}
+	tests := []struct {
+		name    string
+		buckets []bucket
+		steps   []step
+	}{
+		{"burst then refill", []bucket{{1, 2}}, []step{{0, 0}, {0, 0}, {0, 1000}, {500, 500}, {1000, 0}, {1000, 1000}}},
+		{"refill capped at burst", []bucket{{10, 1}}, []step{{0, 0}, {10000, 0}, {10000, 100}}},
+		{"fractional rate", []bucket{{0.5, 1}}, []step{{0, 0}, {1000, 1000}, {2000, 0}}},
+		{"all buckets or none", []bucket{{1, 1}, {10, 5}}, []step{{0, 0}, {0, 1000}, {1000, 0}, {1000, 1000}}},
+	}
+	for i, tt := range tests {
+		keys := []string{}
+		for j := range tt.buckets {
+			keys = append(keys, fmt.Sprintf("test_%d_%d_%d", time.Now().UnixNano(), i, j))
+		}
+		for k, s := range tt.steps {
+			args := []interface{}{s.at}
+			for _, b := range tt.buckets {
+				args = append(args, b.rate, b.burst)
+			}
+			result, err := rateLimitScript.Run(client, keys, args...).Result()
+			if err != nil {
+				t.Fatalf("%s: step %d: %s", tt.name, k, err)
+			}
+			if wait, _ := result.(int64); wait != s.wait {
+				t.Errorf("%s: step %d at %dms: wait = %d, want %d", tt.name, k, s.at, wait, s.wait)
+			}
+		}
+		client.Del(keys...)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// 从账本重建redis中的挂单
+// 挂单锁定、改单、撤单和过期时chaincode保存挂单快照和状态，最后一笔成交执行后状态为已全部成交
+// 挂单剩余数量 = 快照中的数量 - 快照之后执行的子单数量，已执行的子单按账本上的交易记录恢复
+// 挂单历史按快照中的历史恢复，快照之后的成交、撤单和过期按账本补充
+// 已撮合尚未执行的子单只在redis中，重建后其数量退回母单；改单记录无法恢复
+
+// 账本上挂单条款的状态
+const (
+	TermsPended   = "pended"   //挂单已锁定
+	TermsCanceled = "canceled" //挂单已撤销
+	TermsExpired  = "expired"  //挂单已过期
+	TermsFinished = "finished" //挂单已全部成交
+)
+
+// OrderTerms 账本上的挂单条款
+type OrderTerms struct {
+	UUID       string `json:"uuid"`
+	Owner      string `json:"owner"`
+	Terms      *Order `json:"terms"` //挂单锁定、改单、撤单或过期时的快照，包括挂单历史
+	Status     string `json:"status"`
+	LockTime   int64  `json:"lockTime"`
+	UpdateTime int64  `json:"updateTime"`
+}
+
+// RebuildResult 重建结果
+type RebuildResult struct {
+	Open     int      `json:"open"`
+	Finished int      `json:"finished"`
+	Canceled int      `json:"canceled"`
+	Expired  int      `json:"expired"`
+	Children int      `json:"children"`
+	Skipped  []string `json:"skipped"` //无法重建的挂单及原因
+}
+
+// childOrders 按撮合时间排序
+type childOrders []*Order
+
+func (c childOrders) Len() int           { return len(c) }
+func (c childOrders) Less(i, j int) bool { return c[i].MatchedTime < c[j].MatchedTime }
+func (c childOrders) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// fromOrderInt 账本上的交易记录转为挂单
+func fromOrderInt(o *OrderInt) *Order {
+	return &Order{
+		UUID:         o.UUID,
+		Account:      o.Account,
+		SrcCurrency:  o.SrcCurrency,
+		SrcCount:     float64(o.SrcCount) / Multiple,
+		DesCurrency:  o.DesCurrency,
+		DesCount:     float64(o.DesCount) / Multiple,
+		IsBuyAll:     o.IsBuyAll,
+		ExpiredTime:  o.ExpiredTime,
+		PendingTime:  o.PendingTime,
+		PendedTime:   o.PendedTime,
+		MatchedTime:  o.MatchedTime,
+		FinishedTime: o.FinishedTime,
+		RawUUID:      o.RawUUID,
+		Metadata:     o.Metadata,
+		FinalCost:    float64(o.FinalCost) / Multiple,
+		Type:         o.Type,
+		Price:        float64(o.Price) / Multiple,
+	}
+}
+
+// rebuild 从账本重建挂单、买卖队列和最新成交价
+// redis中已有挂单时，force为true才清空买卖队列和工作队列后重建
+func rebuild(force bool) (*RebuildResult, error) {
+	err := prepareRebuild(force)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := getOrderTerms()
+	if err != nil {
+		return nil, err
+	}
+	var terms []*OrderTerms
+	err = json.Unmarshal([]byte(js), &terms)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err = getTxLogs()
+	if err != nil {
+		return nil, err
+	}
+	var txs []*OrderInt
+	err = json.Unmarshal([]byte(js), &txs)
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[string][]*Order)
+	lastTxs := make(map[string]*Order)
+	for _, v := range txs {
+		child := fromOrderInt(v)
+		children[child.RawUUID] = append(children[child.RawUUID], child)
+
+		pair := getPairID(child.SrcCurrency, child.DesCurrency)
+		if last, ok := lastTxs[pair]; !ok || child.MatchedTime > last.MatchedTime {
+			lastTxs[pair] = child
+		}
+	}
+
+	result := &RebuildResult{Skipped: []string{}}
+	for _, v := range terms {
+		err = rebuildOrder(v, children[v.UUID], result)
+		if err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%s: %s", v.UUID, err))
+		}
+	}
+
+	// 最新成交价按各交易对最后一笔交易恢复，恢复后检查止损单是否需要触发
+	for _, v := range lastTxs {
+		if v.SrcCount > 0 {
+			setLastPrice(v.SrcCurrency, v.DesCurrency, round(v.DesCount/v.SrcCount, 6))
+		}
+	}
+	initQueues()
+	for _, v := range lastTxs {
+		triggerStopOrders(v.SrcCurrency, v.DesCurrency)
+	}
+
+	return result, nil
+}
+
+// prepareRebuild 检查redis中是否已有挂单，force为true时清空买卖队列和工作队列
+func prepareRebuild(force bool) error {
+	pairs, err := getPairs()
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	for _, v := range pairs {
+		keys = append(keys, getBSKey(v.SrcCurrency, v.DesCurrency), getStopKey(v.SrcCurrency, v.DesCurrency))
+	}
+
+	if !force {
+		pended, err := client.SCard(PendSuccessOrdersKey).Result()
+		if err != nil {
+			return err
+		}
+		if len(pairs) > 0 || pended > 0 {
+			return errors.New("Redis already has orders, use \"rebuild force\" to overwrite them.")
+		}
+		return nil
+	}
+
+	for _, key := range queueKeys {
+		keys = append(keys, key, getQueueStream(key), getQueueEntries(key), getRetryKey(key), getRetryAttemptsKey(key))
+	}
+	keys = append(keys, BatchesKey, ExpiryKey)
+
+	// 账户的未完成挂单和统计按重建的挂单重新计数
+	for _, pattern := range []string{OpenOrdersKey + "_*", RiskTotalsKey + "_*"} {
+		accounts, err := scanKeys(pattern)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, accounts...)
+	}
+	return client.Del(keys...).Err()
+}
+
+// rebuildOrder 按挂单快照和执行的子单重建挂单，并放回对应的队列
+func rebuildOrder(t *OrderTerms, children []*Order, result *RebuildResult) error {
+	if t.Terms == nil {
+		return errors.New("No order terms.")
+	}
+
+	order := *t.Terms
+	order.UUID = t.UUID
+	order.Amending = ""
+	histories := order.History
+	order.History = nil
+	order.PendedTime = t.LockTime
+	order.PendedDate = time.Unix(t.LockTime, 0).Format("2006-01-02 15:04:05")
+
+	// 母单UUID的交易记录为最后一笔成交
+	var final *Order
+	parts := []*Order{}
+	for _, v := range children {
+		if v.UUID == t.UUID {
+			final = v
+		} else {
+			parts = append(parts, v)
+		}
+	}
+	sort.Stable(childOrders(parts))
+
+	// 快照之前撮合的子单已计入快照的FilledCost，不再扣除
+	i, cost := 0, 0.0
+	for ; i < len(parts) && round(cost+parts[i].FinalCost, 6) <= round(t.Terms.FilledCost, 6); i++ {
+		cost += parts[i].FinalCost
+	}
+	filled := 0.0
+	for _, v := range parts[i:] {
+		order.FilledCost = round(order.FilledCost+v.FinalCost, 6)
+		if order.IsBuyAll {
+			filled += v.DesCount
+		} else {
+			filled += v.SrcCount
+		}
+	}
+	if isStopOrder(&order) && order.TriggeredTime == 0 && len(parts) > 0 {
+		order.TriggeredTime = parts[0].MatchedTime
+		order.TriggeredDate = time.Unix(order.TriggeredTime, 0).Format("2006-01-02 15:04:05")
+	}
+
+	status := t.Status
+	if final != nil {
+		order.SrcCount = final.SrcCount
+		order.DesCount = final.DesCount
+		order.FinalCost = final.FinalCost
+		order.HiddenCount = 0
+		order.MatchedTime = final.MatchedTime
+		order.MatchedDate = time.Unix(final.MatchedTime, 0).Format("2006-01-02 15:04:05")
+		status = EventFinished
+	} else if err := setRemainingCount(&order, t.Terms, filled); err != nil {
+		return err
+	}
+
+	if status == TermsFinished && final == nil {
+		return errors.New("No final transaction of the finished order.")
+	}
+
+	pipe := client.TxPipeline()
+	for _, v := range parts {
+		child := rebuildChild(&order, v)
+		js, _ := json.Marshal(child)
+		pipe.Set(child.UUID, string(js), 0)
+		restoreOrderHistory(pipe, child.UUID, getTxHistory(v, nil))
+		pipe.SAdd(ExchangeSuccessKey, child.UUID)
+		pipe.SAdd("user_"+child.Account, child.UUID)
+	}
+
+	switch status {
+	case TermsCanceled:
+		histories = appendHistory(histories, t.UpdateTime, EventCanceled)
+	case TermsExpired:
+		histories = appendHistory(histories, t.UpdateTime, EventExpired)
+	}
+	if final != nil {
+		histories = getTxHistory(final, histories)
+	}
+	restoreOrderHistory(pipe, order.UUID, histories)
+
+	js, _ := json.Marshal(&order)
+	pipe.Set(order.UUID, string(js), 0)
+	pipe.SAdd(PendSuccessOrdersKey, order.UUID)
+	pipe.SAdd("user_"+order.Account, order.UUID)
+	if order.ClientOrderID != "" {
+		pipe.SetNX(getClientOrderKey(order.Account, order.ClientOrderID), order.UUID, 0)
+	}
+	switch status {
+	case EventFinished:
+		pipe.SAdd(ExchangeSuccessKey, order.UUID)
+	case TermsCanceled:
+		pipe.SAdd(CancelSuccessOrderKey, order.UUID)
+	case TermsExpired:
+		pipe.SAdd(ExpiredSuccessOrderKey, order.UUID)
+	default:
+		pipe.ZAdd(getBookKey(&order), redis.Z{Member: order.UUID, Score: getBookScore(&order)})
+		pipe.SAdd(getOpenOrdersKey(order.Account), order.UUID)
+		addRiskTotals(pipe, &order, 1, 0, getRemainingLock(&order))
+		scheduleExpiry(pipe, &order)
+		trackImmediate(pipe, &order)
+		registerPair(pipe, order.SrcCurrency, order.DesCurrency)
+	}
+	_, err := pipe.Exec()
+	if err != nil {
+		return err
+	}
+
+	for _, v := range parts {
+		addOrderHistory(v.UUID, EventRebuilt, EventFinished)
+	}
+	addOrderHistory(order.UUID, EventRebuilt, status)
+
+	result.Children += len(parts)
+	switch status {
+	case EventFinished:
+		result.Finished++
+	case TermsCanceled:
+		result.Canceled++
+	case TermsExpired:
+		result.Expired++
+	default:
+		result.Open++
+	}
+	return nil
+}
+
+// getTermsSnapshot 传给chaincode保存的挂单快照，包括当前的挂单历史
+func getTermsSnapshot(order *Order) *Order {
+	terms := *order
+	terms.Amending = ""
+	terms.History, _ = getOrderHistory(order.UUID)
+	return &terms
+}
+
+// appendHistory 历史中没有该事件时补充
+func appendHistory(histories []OrderHistory, timeStamp int64, event string) []OrderHistory {
+	for _, v := range histories {
+		if v.Event == event {
+			return histories
+		}
+	}
+	return append(histories, OrderHistory{
+		Time:  timeStamp,
+		Date:  time.Unix(timeStamp, 0).Format("2006-01-02 15:04:05"),
+		Event: event,
+	})
+}
+
+// getTxHistory 按账本上的交易记录补充撮合和交易完成事件
+func getTxHistory(tx *Order, histories []OrderHistory) []OrderHistory {
+	histories = appendHistory(histories, tx.MatchedTime, EventMatched)
+	finished := tx.FinishedTime
+	if finished == 0 {
+		finished = tx.MatchedTime
+	}
+	return appendHistory(histories, finished, EventFinished)
+}
+
+// restoreOrderHistory 覆盖redis中的挂单历史，重建事件在写入后另行添加
+func restoreOrderHistory(pipe *redis.Pipeline, uuid string, histories []OrderHistory) {
+	key := OrderHistoryKey + "_" + uuid
+	pipe.Del(key)
+	for _, v := range histories {
+		js, _ := json.Marshal(&v)
+		pipe.RPush(key, string(js))
+	}
+}
+
+// setRemainingCount 按快照数量减去快照之后成交的数量设置挂单剩余数量，冰山单重新拆分可见部分
+func setRemainingCount(order, terms *Order, filled float64) error {
+	total := terms.SrcCount
+	if terms.IsBuyAll {
+		total = terms.DesCount
+	}
+	remaining := round(total+terms.HiddenCount-filled, 6)
+	if remaining*Multiple < 1 {
+		return errors.New("No remaining count without the final transaction.")
+	}
+
+	if isIceberg(order) {
+		slice := math.Min(order.DisplayCount, remaining)
+		order.HiddenCount = round(remaining-slice, 6)
+		setSliceCount(order, slice)
+		return nil
+	}
+
+	// 部分成交后剩余部分按原挂单的兑换比例计算
+	ratio := terms.DesCount / terms.SrcCount
+	if order.IsBuyAll {
+		order.DesCount = remaining
+		order.SrcCount = round(remaining/ratio, 6)
+	} else {
+		order.SrcCount = remaining
+		order.DesCount = round(remaining*ratio, 6)
+	}
+	return nil
+}
+
+// rebuildChild 按母单和账本上的交易记录重建子单
+func rebuildChild(order, tx *Order) *Order {
+	child := *order
+	child.UUID = tx.UUID
+	child.RawUUID = order.UUID
+	child.SrcCount = tx.SrcCount
+	child.DesCount = tx.DesCount
+	child.FinalCost = tx.FinalCost
+	child.HiddenCount = 0
+	child.MatchedTime = tx.MatchedTime
+	child.MatchedDate = time.Unix(tx.MatchedTime, 0).Format("2006-01-02 15:04:05")
+	return &child
+}
+
+// runRebuild 重建命令
+func runRebuild(args []string) {
+	initRedis()
+	defer client.Close()
+
+	force := len(args) == 1 && args[0] == "force"
+	if len(args) > 0 && !force {
+		fmt.Println("Usage: rebuild [force]")
+		os.Exit(1)
+	}
+
+	result, err := rebuild(force)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	js, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(js))
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestSetRemainingCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		terms    Order
+		filled   float64
+		src, des float64
+		hidden   float64
+		err      bool
+	}{
+		{"sell all", Order{SrcCount: 10, DesCount: 20}, 4, 6, 12, 0, false},
+		{"buy all", Order{SrcCount: 10, DesCount: 20, IsBuyAll: true}, 5, 7.5, 15, 0, false},
+		{"not filled", Order{SrcCount: 10, DesCount: 20}, 0, 10, 20, 0, false},
+		{"filled", Order{SrcCount: 10, DesCount: 20}, 10, 0, 0, 0, true},
+		{"iceberg", Order{SrcCount: 3, DesCount: 6, Price: 2, DisplayCount: 3, HiddenCount: 7}, 2, 3, 6, 5, false},
+		{"iceberg last slice", Order{SrcCount: 3, DesCount: 6, Price: 2, DisplayCount: 3, HiddenCount: 7}, 8.5, 1.5, 3, 0, false},
+		{"iceberg buy all", Order{SrcCount: 1.5, DesCount: 3, Price: 2, DisplayCount: 3, HiddenCount: 5, IsBuyAll: true}, 1, 1.5, 3, 4, false},
+	}
+	for _, tt := range tests {
+		terms := tt.terms
+		order := tt.terms
+		err := setRemainingCount(&order, &terms, tt.filled)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: setRemainingCount() succeeded, want error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: setRemainingCount() error: %s", tt.name, err)
+			continue
+		}
+		if order.SrcCount != tt.src || order.DesCount != tt.des || order.HiddenCount != tt.hidden {
+			t.Errorf("%s: setRemainingCount() = %v, %v, %v, want %v, %v, %v",
+				tt.name, order.SrcCount, order.DesCount, order.HiddenCount, tt.src, tt.des, tt.hidden)
+		}
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/util"
+	"github.com/spf13/viper"
+	"gopkg.in/redis.v5"
+)
+
+// 对账：按账户和币种比较redis中挂单应锁定的数量与账本上的锁定数量
+// 账本上挂单的剩余锁定 = 锁定 - 解锁 - 已执行交易的消耗，改单的锁定和解锁计入原始挂单
+// redis中挂单应剩余的锁定 = 未完成挂单的剩余锁定 + 已撮合等待执行的子单消耗
+// 对账结果先作为待审批的报告保存，审批后才提交修正解锁
+
+const (
+	ReconcileClean     = "clean"     //没有需要修正的锁定
+	ReconcileDryRun    = "dryRun"    //有需要修正的锁定，等待审批
+	ReconcileSubmitted = "submitted" //已审批并提交修正解锁
+	ReconcileSuccess   = "success"   //修正解锁全部成功
+	ReconcileFailed    = "failed"    //修正解锁部分或全部失败
+)
+
+// 对账发现的问题
+const (
+	ReconcileOrphanLock    = "orphanLock"    //挂单已完成或不存在，账本上仍有锁定
+	ReconcileNoLock        = "noLock"        //挂单未完成，账本上没有锁定
+	ReconcileDoubleUnlock  = "doubleUnlock"  //账本上解锁和消耗的数量超过锁定的数量
+	ReconcileMismatch      = "mismatch"      //挂单剩余锁定与账本不一致
+	ReconcilePendingLocked = "pendingLocked" //挂单仍在待挂单队列，账本上已锁定
+)
+
+// OrderLock 账本上挂单的锁定情况
+type OrderLock struct {
+	OrderId  string `json:"orderId"`
+	Currency string `json:"currency"`
+	Locked   int64  `json:"locked"`
+	Unlocked int64  `json:"unlocked"`
+	Cost     int64  `json:"cost"`
+}
+
+// ReconcileItem 挂单的对账问题，数量为乘以Multiple后的整数
+type ReconcileItem struct {
+	Owner    string `json:"owner"`
+	Currency string `json:"currency"`
+	OrderId  string `json:"orderId"`
+	Problem  string `json:"problem"`
+	Expected int64  `json:"expected"` //redis中应锁定的数量
+	Ledger   int64  `json:"ledger"`   //账本上剩余锁定的数量
+}
+
+// ReconcileTotal 账户币种的锁定汇总，三者不一致时记录
+type ReconcileTotal struct {
+	Owner     string `json:"owner"`
+	Currency  string `json:"currency"`
+	Expected  int64  `json:"expected"`  //redis中各挂单应锁定的数量之和
+	Orders    int64  `json:"orders"`    //账本上各挂单剩余锁定的数量之和
+	LockCount int64  `json:"lockCount"` //账本上资产的锁定数量
+}
+
+// Reconciliation 对账报告
+type Reconciliation struct {
+	ID          string            `json:"id"`
+	Time        int64             `json:"time"`
+	Date        string            `json:"date"`
+	Status      string            `json:"status"`
+	Items       []*ReconcileItem  `json:"items"`
+	Totals      []*ReconcileTotal `json:"totals"`
+	Corrections []*LockInfo       `json:"corrections"` //修正解锁，挂单号为“原始挂单号@对账ID”
+	TxID        string            `json:"txid"`
+	Fails       []FailInfo        `json:"fails"`
+	Info        string            `json:"info"`
+}
+
+var errReconciliationNotFound = errors.New("Reconciliation not found.")
+
+// reconciliations 按对账时间倒序
+type reconciliations []*Reconciliation
+
+func (r reconciliations) Len() int           { return len(r) }
+func (r reconciliations) Less(i, j int) bool { return r[i].Time > r[j].Time }
+func (r reconciliations) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// expectedLock redis中挂单应锁定的数量
+// lockKey 账户挂单在某币种上的锁定，对应账本上的一条OrderLock
+type lockKey struct {
+	currency string
+	orderID  string
+}
+
+type expectedLock struct {
+	count   int64
+	open    bool //挂单未完成
+	pending bool //挂单在待挂单队列中，尚未锁定
+}
+
+// reconcileTask 定时对账，只生成待审批的报告
+func reconcileTask() {
+	for {
+		time.Sleep(time.Duration(viper.GetInt64("app.reconcile.interval")) * time.Second)
+		waitKillSwitch("reconcileTask")
+
+		if _, err := reconcile(); err != nil {
+			myLogger.Errorf("Failed reconciling: %s", err)
+		}
+	}
+}
+
+// reconcile 对账并保存报告
+func reconcile() (*Reconciliation, error) {
+	now := time.Now()
+	r := &Reconciliation{
+		ID:   util.GenerateUUID(),
+		Time: now.Unix(),
+		Date: now.Format("2006-01-02 15:04:05"),
+	}
+
+	items, totals, err := compareLocks()
+	if err != nil {
+		return nil, err
+	}
+	r.Items = items
+	r.Totals = totals
+	r.Corrections = getCorrections(r.ID, items)
+
+	r.Status = ReconcileClean
+	if len(r.Corrections) > 0 {
+		r.Status = ReconcileDryRun
+	}
+
+	return r, saveReconciliation(r)
+}
+
+// getCorrections 账本上多余的锁定生成修正解锁，其他问题需人工处理
+func getCorrections(id string, items []*ReconcileItem) []*LockInfo {
+	corrections := []*LockInfo{}
+	for _, v := range items {
+		if v.Problem != ReconcileOrphanLock {
+			continue
+		}
+		corrections = append(corrections, &LockInfo{
+			Owner:    v.Owner,
+			Currency: v.Currency,
+			OrderId:  v.OrderId + "@" + id,
+			Count:    v.Ledger - v.Expected,
+		})
+	}
+	return corrections
+}
+
+// compareLocks 比较所有账户的锁定
+func compareLocks() ([]*ReconcileItem, []*ReconcileTotal, error) {
+	owners, err := getReconcileOwners()
+	if err != nil {
+		return nil, nil, err
+	}
+	matchedCosts, err := getMatchedCosts()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	items := []*ReconcileItem{}
+	totals := []*ReconcileTotal{}
+	for owner, uuids := range owners {
+		ownerItems, ownerTotals, err := compareOwnerLocks(owner, uuids, matchedCosts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed reconciling owner [%s]: %s", owner, err)
+		}
+		items = append(items, ownerItems...)
+		totals = append(totals, ownerTotals...)
+	}
+	return items, totals, nil
+}
+
+// getReconcileOwners 有挂单的账户及其挂单
+func getReconcileOwners() (map[string][]string, error) {
+	owners := make(map[string][]string)
+
+	keys, err := scanKeys("user_*")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		uuids, err := getAllSetMember(key)
+		if err != nil {
+			return nil, err
+		}
+		owner := strings.TrimPrefix(key, "user_")
+		owners[owner] = append(owners[owner], uuids...)
+	}
+
+	// 待挂单尚未加入账户挂单集合
+	pendings, err := getAllSetMember(PendingOrdersKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range pendings {
+		order, err := getOrder(v)
+		if err != nil {
+			continue
+		}
+		owners[order.Account] = append(owners[order.Account], v)
+	}
+	return owners, nil
+}
+
+// getMatchedCosts 已撮合等待执行的子单在各原始挂单上的消耗
+func getMatchedCosts() (map[lockKey]int64, error) {
+	members, err := getAllSetMember(MatchedOrdersKey)
+	if err != nil {
+		return nil, err
+	}
+
+	costs := make(map[lockKey]int64)
+	for _, member := range members {
+		for _, v := range strings.Split(member, ",") {
+			order, err := getOrder(v)
+			if err != nil {
+				continue
+			}
+			costs[lockKey{order.SrcCurrency, order.RawUUID}] += int64(order.FinalCost * Multiple)
+		}
+	}
+	return costs, nil
+}
+
+// getExpectedLocks redis中账户各原始挂单应锁定的数量，按币种和原始挂单号区分
+func getExpectedLocks(uuids []string, matchedCosts map[lockKey]int64) map[lockKey]*expectedLock {
+	expected := make(map[lockKey]*expectedLock)
+	for _, v := range uuids {
+		order, err := getOrder(v)
+		if err != nil || (order.RawUUID != "" && order.RawUUID != v) {
+			continue
+		}
+		// 改单差额处理中的挂单不对账
+		if order.Amending != "" {
+			continue
+		}
+
+		key := lockKey{order.SrcCurrency, v}
+		e := &expectedLock{count: matchedCosts[key]}
+		if ok, _ := isInSet(PendingOrdersKey, v); ok {
+			e.pending = true
+		} else if isInZSet(getBookKey(order), v) {
+			e.open = true
+		} else if ok, _ := isInSet(CancelingOrderKey, v); ok {
+			e.open = true
+		} else if ok, _ := isInSet(ExpiredOrdersKey, v); ok {
+			e.open = true
+		}
+		if e.open {
+			e.count += getRemainingLock(order)
+		}
+		expected[key] = e
+	}
+	return expected
+}
+
+// compareOwnerLocks 比较账户各挂单和各币种的锁定
+func compareOwnerLocks(owner string, uuids []string, matchedCosts map[lockKey]int64) ([]*ReconcileItem, []*ReconcileTotal, error) {
+	tolerance := viper.GetInt64("app.reconcile.tolerance")
+
+	result, err := getLocks(owner)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ledger struct {
+		Assets []struct {
+			Currency  string `json:"currency"`
+			LockCount int64  `json:"lockCount"`
+		} `json:"assets"`
+		Orders []*OrderLock `json:"orders"`
+	}
+	err = json.Unmarshal([]byte(result), &ledger)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	expected := getExpectedLocks(uuids, matchedCosts)
+	totals := make(map[string]*ReconcileTotal)
+	getTotal := func(currency string) *ReconcileTotal {
+		if _, ok := totals[currency]; !ok {
+			totals[currency] = &ReconcileTotal{Owner: owner, Currency: currency}
+		}
+		return totals[currency]
+	}
+
+	items := []*ReconcileItem{}
+	for _, v := range ledger.Orders {
+		key := lockKey{v.Currency, v.OrderId}
+		outstanding := v.Locked - v.Unlocked - v.Cost
+		e, ok := expected[key]
+		if !ok {
+			e = &expectedLock{}
+		}
+		delete(expected, key)
+
+		total := getTotal(v.Currency)
+		total.Orders += outstanding
+		total.Expected += e.count
+
+		item := &ReconcileItem{Owner: owner, Currency: v.Currency, OrderId: v.OrderId, Expected: e.count, Ledger: outstanding}
+		switch {
+		case e.pending:
+			if v.Locked > 0 {
+				item.Problem = ReconcilePendingLocked
+			}
+		case outstanding < -tolerance:
+			item.Problem = ReconcileDoubleUnlock
+		case e.open && v.Locked == 0:
+			item.Problem = ReconcileNoLock
+		case math.Abs(float64(outstanding-e.count)) <= float64(tolerance):
+			// 一致
+		case e.open || outstanding < e.count:
+			item.Problem = ReconcileMismatch
+		default:
+			item.Problem = ReconcileOrphanLock
+		}
+		if item.Problem != "" {
+			items = append(items, item)
+		}
+	}
+
+	// 账本上没有任何锁定记录的未完成挂单
+	for key, e := range expected {
+		if !e.open {
+			continue
+		}
+		getTotal(key.currency).Expected += e.count
+		items = append(items, &ReconcileItem{
+			Owner:    owner,
+			Currency: key.currency,
+			OrderId:  key.orderID,
+			Problem:  ReconcileNoLock,
+			Expected: e.count,
+		})
+	}
+
+	for _, v := range ledger.Assets {
+		getTotal(v.Currency).LockCount = v.LockCount
+	}
+	ownerTotals := []*ReconcileTotal{}
+	for _, v := range totals {
+		if v.Expected != v.Orders || v.Orders != v.LockCount {
+			ownerTotals = append(ownerTotals, v)
+		}
+	}
+
+	return items, ownerTotals, nil
+}
+
+func saveReconciliation(r *Reconciliation) error {
+	js, _ := json.Marshal(r)
+	return client.HSet(ReconciliationsKey, r.ID, string(js)).Err()
+}
+
+func getReconciliation(id string) (*Reconciliation, error) {
+	js, err := client.HGet(ReconciliationsKey, id).Result()
+	if err == redis.Nil {
+		return nil, errReconciliationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var r Reconciliation
+	err = json.Unmarshal([]byte(js), &r)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// getReconciliations 按对账时间倒序的所有对账报告
+func getReconciliations() ([]*Reconciliation, error) {
+	values, err := client.HGetAll(ReconciliationsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []*Reconciliation{}
+	for _, v := range values {
+		var r Reconciliation
+		if err := json.Unmarshal([]byte(v), &r); err != nil {
+			continue
+		}
+		list = append(list, &r)
+	}
+	sort.Sort(reconciliations(list))
+	return list, nil
+}
+
+// approveReconciliation 审批对账报告，重新对账后只提交仍然需要的修正解锁
+func approveReconciliation(id string) (*Reconciliation, error) {
+	r, err := getReconciliation(id)
+	if err != nil {
+		return nil, err
+	}
+	if r.Status != ReconcileDryRun {
+		return nil, fmt.Errorf("Reconciliation is %s.", r.Status)
+	}
+
+	items, _, err := compareLocks()
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[lockKey]int64)
+	for _, v := range getCorrections(id, items) {
+		current[lockKey{v.Currency, v.OrderId}] = v.Count
+	}
+	corrections := []*LockInfo{}
+	ids := []string{}
+	for _, v := range r.Corrections {
+		if count, ok := current[lockKey{v.Currency, v.OrderId}]; ok && count == v.Count {
+			corrections = append(corrections, v)
+			ids = append(ids, v.OrderId)
+		}
+	}
+	r.Corrections = corrections
+
+	if len(corrections) == 0 {
+		r.Status = ReconcileClean
+		r.Info = "Corrections are no longer needed."
+		return r, saveReconciliation(r)
+	}
+
+	lockInfos, _ := json.Marshal(&corrections)
+	txid, err := lock(string(lockInfos), false, "reconcile")
+	submitBatch("reconcile", ids, txid, err)
+	if err != nil {
+		r.Status = ReconcileFailed
+		r.Info = err.Error()
+	} else {
+		r.Status = ReconcileSubmitted
+		r.TxID = txid
+	}
+	return r, saveReconciliation(r)
+}
+
+// finishReconciliation chaincode修正解锁的结果，挂单号中带有对账ID
+func finishReconciliation(success []string, fails []FailInfo) {
+	ids := append([]string{}, success...)
+	for _, v := range fails {
+		ids = append(ids, v.Id)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	parts := strings.SplitN(ids[0], "@", 2)
+	if len(parts) != 2 {
+		return
+	}
+
+	r, err := getReconciliation(parts[1])
+	if err != nil {
+		return
+	}
+	r.Fails = fails
+	r.Status = ReconcileSuccess
+	if len(fails) > 0 {
+		r.Status = ReconcileFailed
+	}
+	saveReconciliation(r)
+
+	for _, v := range success {
+		addOrderHistory(strings.SplitN(v, "@", 2)[0], EventReconcile, v)
+	}
+}
+
+// runReconcile 对账命令
+func runReconcile(args []string) {
+	initRedis()
+	defer client.Close()
+
+	var r *Reconciliation
+	var err error
+	if len(args) == 2 && args[0] == "approve" {
+		r, err = approveReconciliation(args[1])
+	} else if len(args) == 0 {
+		r, err = reconcile()
+	} else {
+		err = errors.New("Usage: reconcile [approve <id>]")
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	js, _ := json.MarshalIndent(r, "", "  ")
+	fmt.Println(string(js))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"math"
 	"os"
 
@@ -18,20 +19,94 @@ const (
 	PendingOrdersKey       = "pendingOrders"       //待挂单队列
 	PendSuccessOrdersKey   = "pendSuccessOrders"   //挂单失败队列
 	PendFailOrdersKey      = "pendFailOrders"      //挂单失败队列
-	ExchangeKey            = "exchange"            //交易队列  exchange_[srcCurrency]_[desCurrency] 格式
+	ExchangeKey            = "exchange"            //交易队列  exchange_[交易对ID] 格式
 	ExchangeSuccessKey     = "exchangeSuccess"     //交易执行成功队列
-	LastPriceKey           = "lastPrice"           //上次成交价
+	LastPriceKey           = "lastPrice"           //各交易对最新成交价  field为交易对ID
 	MatchedOrdersKey       = "matchedOrders"       //撮合的交易等待chaincode处理
 	ExpiredOrdersKey       = "expiredOrders"       //过期挂单队列
 	ExpiredSuccessOrderKey = "expiredSuccessOrder" //过期处理成功
 	CancelingOrderKey      = "cancelingOrders"     //待撤销挂单
 	CancelSuccessOrderKey  = "cancelSuccessOrders" //撤销挂单成功
 	CancelFailOrderKey     = "cancelFailOrders"    //撤销挂单失败
+	OrderHistoryKey        = "history"             //挂单历史  history_[uuid] 格式
+	StopOrdersKey          = "stop"                //止损单触发队列  stop_[交易对ID] 格式
+	AmendmentsKey          = "amendments"          //改单记录  field为改单ID
+	OpenOrdersKey          = "openOrders"          //账户未完成的挂单  openOrders_[account] 格式，挂单结束时移除
+	RiskTotalsKey          = "riskTotals"          //账户风控统计  riskTotals_[account] 格式的hash，count为未完成挂单数，reserved_[币种]和notional_[币种]为已提交尚未锁定和已锁定的数量
+	ClientOrderKey         = "clientOrder"         //客户端挂单ID对应的挂单UUID  clientOrder_[account]_[clientOrderId] 格式，“%”和“_”转义
+	IdempotencyKey         = "idempotency"         //Idempotency-Key请求的响应  idempotency_[account]_[path]_[key] 格式
+	BatchesKey             = "batches"             //已提交chaincode等待结果的批次  field为txid
+	RetryKey               = "retry"               //等待重试的队列成员  retry_[队列集合key] 格式，score为重试时间
+	RetryAttemptsKey       = "retryAttempts"       //队列成员已失败次数  retryAttempts_[队列集合key] 格式
+	DeadLetterKey          = "deadLetter"          //死信  field为队列成员
+	ListenerCheckpointKey  = "listenerCheckpoint"  //事件监听已处理的区块高度
+	TxResultKey            = "txResult"            //chaincode交易结果  txResult_[txid] 格式
+	ReconciliationsKey     = "reconciliations"     //对账报告  field为对账ID
+	ExpiryKey              = "expiry"              //买卖队列中有过期时间的挂单  score为过期时间
+	PairsKey               = "pairs"               //已有挂单的交易方向  成员为交易对ID
+	HaltsKey               = "halts"               //熔断暂停撮合的交易对  field为两个方向中较小的交易对ID
+	HaltEventsKey          = "haltEvents"          //熔断的暂停和恢复事件  haltEvents_[交易对ID] 格式
+	TradesKey              = "trades"              //交易对最近的成交记录  trades_[交易对ID] 格式
+	TradeStatsKey          = "tradeStats"          //交易对24小时内的成交记录  tradeStats_[交易对ID] 格式，score为成交时间
+	CandlesKey             = "candles"             //K线  candles_[交易对ID]_[周期] 格式，field为周期开始时间
+	CandleTradesKey        = "candleTrades"        //K线待汇总的成交Stream
+	PushChannel            = "push"                //推送消息发布的redis频道
+	PushSeqKey             = "pushSeq"             //推送频道的消息序号  field为频道名，私有频道为[频道名]_[account]
+	DepthSnapshotKey       = "depthSnapshot"       //最近一次推送的盘口  field为交易对ID
+	BalanceChangedKey      = "balanceChanged"      //余额有变化等待推送的账户
+	TxWatchKey             = "txWatch"             //等待推送结果的币交易  txWatch_[txid] 格式
+	SessionKey             = "session"             //登录会话  session_[会话ID] 格式，值为账户
+	CredentialsKey         = "credentials"         //enrollSecret的bcrypt哈希  field为enrollID
+	APIKeysKey             = "apiKeys"             //API Key  field为Key ID；apiKeys_[account] 格式为账户的Key ID集合
+	APINonceKey            = "apiNonce"            //已使用的API Key nonce  apiNonce_[Key ID]_[nonce] 格式
+	RateLimitKey           = "rateLimit"           //限流令牌桶  rateLimit_[类别]_[account|key|ip]_[ID] 格式，field为tokens和ts
+	ImmediateOrdersKey     = "immediate"           //买卖队列中的IOC/FOK挂单  immediate_[交易对ID] 格式，撮合结束后撤销剩余部分
+	RolesKey               = "roles"               //设置过角色的账户  field为enrollID；roles_[enrollID] 格式为账户的角色集合
+	KillSwitchKey          = "killSwitch"          //紧急停止的操作人和原因，存在时所有任务暂停
+	AuditKey               = "audit"               //管理操作的审计日志，最新的在前
+	CancelBatchKey         = "cancelBatch"         //批量撤单的批次  cancelBatch_[批次ID] 格式
+	CancelBatchOrdersKey   = "cancelBatchOrders"   //批量撤单中等待结果的挂单  field为挂单UUID，值为批次ID
+	CancelJobsKey          = "cancelJobs"          //排队的管理员批量撤单  member为批次ID
 
 )
 
+// 挂单历史事件
+const (
+	EventPending    = "pending"    //提交挂单
+	EventPended     = "pended"     //锁定余额成功，进入买卖队列
+	EventPendFail   = "pendFail"   //锁定余额失败
+	EventMatched    = "matched"    //撮合成功，等待chaincode执行交易
+	EventFinished   = "finished"   //交易完成
+	EventCancel     = "cancel"     //进入待撤单队列
+	EventCanceled   = "canceled"   //撤单成功
+	EventCancelFail = "cancelFail" //撤单失败
+	EventExpire     = "expire"     //进入过期队列
+	EventExpired    = "expired"    //过期处理成功
+	EventTriggered  = "triggered"  //止损单触发，进入买卖队列
+	EventRefilled   = "refilled"   //冰山单从隐藏数量补充可见部分
+	EventAmend      = "amend"      //提交改单
+	EventAmended    = "amended"    //改单完成
+	EventAmendFail  = "amendFail"  //改单失败
+	EventSelfTrade  = "selfTrade"  //自成交防范减量
+	EventRetry      = "retry"      //chaincode处理失败，等待重试
+	EventDeadLetter = "deadLetter" //重试次数用完或不可重试，移入死信
+	EventResolved   = "resolved"   //管理员强制处理死信
+	EventReconcile  = "reconcile"  //对账修正解锁
+	EventRebuilt    = "rebuilt"    //从账本重建
+)
+
+// OrderHistory 挂单历史记录
+type OrderHistory struct {
+	Time   int64  `json:"time"`
+	Date   string `json:"date"`
+	Event  string `json:"event"`  //事件
+	Reason string `json:"reason"` //原因，如撤单原因、失败信息
+}
+
 var client *redis.Client
 
+var errNotInBook = errors.New("Order is not in the book.")
+
 func initRedis() {
 	addr := viper.GetString("redis.address")
 	pwd := viper.GetString("redis.pwd")
@@ -51,6 +126,9 @@ func initRedis() {
 	} else {
 		// myLogger.Debugf("Connection redis [%s] successed.", addr)
 	}
+
+	initQueues()
+	initPairs()
 }
 
 func addOrder(key string, value *Order) error {
@@ -77,6 +155,71 @@ func getOrder(uuid string) (*Order, error) {
 	return &order, nil
 }
 
+// getOrders 用一次pipeline读取多个挂单，不存在或无法解析的挂单对应位置为nil
+func getOrders(uuids []string) ([]*Order, error) {
+	orders := make([]*Order, len(uuids))
+	if len(uuids) == 0 {
+		return orders, nil
+	}
+
+	pipe := client.Pipeline()
+	defer pipe.Close()
+	cmds := make([]*redis.StringCmd, len(uuids))
+	for i, v := range uuids {
+		cmds[i] = pipe.Get(v)
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for i, cmd := range cmds {
+		js, err := cmd.Result()
+		if err != nil {
+			continue
+		}
+		var order Order
+		if json.Unmarshal([]byte(js), &order) == nil {
+			orders[i] = &order
+		}
+	}
+	return orders, nil
+}
+
+// updateOrder 在事务中读取并修改挂单，挂单被并发修改时重试
+// fn返回错误时放弃修改，fn中可向pipe添加需同时执行的命令
+func updateOrder(uuid string, fn func(order *Order, pipe *redis.Pipeline) error) error {
+	var err error
+	for i := 0; i < 3; i++ {
+		err = client.Watch(func(tx *redis.Tx) error {
+			js, err := tx.Get(uuid).Result()
+			if err != nil {
+				return err
+			}
+			var order Order
+			err = json.Unmarshal([]byte(js), &order)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Pipelined(func(pipe *redis.Pipeline) error {
+				err := fn(&order, pipe)
+				if err != nil {
+					return err
+				}
+
+				js, _ := json.Marshal(&order)
+				pipe.Set(uuid, string(js), 0)
+				return nil
+			})
+			return err
+		}, uuid)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return errors.New("Order is being modified, please retry.")
+}
+
 func saveOrderMetadata(uuid, msg string) error {
 	order, err := getOrder(uuid)
 	if err != nil {
@@ -93,6 +236,133 @@ func saveOrderMetadata(uuid, msg string) error {
 	return nil
 }
 
+func saveOrderReason(uuid, reason string) error {
+	order, err := getOrder(uuid)
+	if err != nil {
+		return err
+	}
+
+	order.Reason = reason
+
+	return addOrder(uuid, order)
+}
+
+// addOrderHistory 记录挂单历史
+func addOrderHistory(uuid, event, reason string) error {
+	now := time.Now()
+	js, err := json.Marshal(&OrderHistory{
+		Time:   now.Unix(),
+		Date:   now.Format("2006-01-02 15:04:05"),
+		Event:  event,
+		Reason: reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = client.RPush(OrderHistoryKey+"_"+uuid, string(js)).Err()
+	if err != nil {
+		return err
+	}
+
+	pushOrderEvent(uuid, event, reason)
+	return nil
+}
+
+// getOrderHistory 获取挂单历史
+func getOrderHistory(uuid string) ([]OrderHistory, error) {
+	values, err := client.LRange(OrderHistoryKey+"_"+uuid, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	histories := []OrderHistory{}
+	for _, v := range values {
+		var history OrderHistory
+		if err := json.Unmarshal([]byte(v), &history); err != nil {
+			continue
+		}
+		histories = append(histories, history)
+	}
+	return histories, nil
+}
+
+// getOrderStatus 挂单状态 0：待交易，1：完成，2：过期，3：撤单
+func getOrderStatus(uuid string) int {
+	if ok, _ := isInSet(ExchangeSuccessKey, uuid); ok {
+		return 1
+	} else if ok, _ := isInSet(ExpiredSuccessOrderKey, uuid); ok {
+		return 2
+	} else if ok, _ := isInSet(CancelSuccessOrderKey, uuid); ok {
+		return 3
+	}
+	return 0
+}
+
+// getClientOrderKey 账户和客户端挂单ID中的“%”和“_”转义，不同账户的挂单ID不会对应同一个键
+func getClientOrderKey(account, clientOrderID string) string {
+	return ClientOrderKey + "_" + keyPartEscaper.Replace(account) + "_" + keyPartEscaper.Replace(clientOrderID)
+}
+
+// placeOrder 保存新挂单并放入待处理队列，客户端挂单ID在同一事务中绑定，不会绑定到不存在的挂单
+// 客户端挂单ID已绑定时不保存挂单，返回原挂单UUID和false
+func placeOrder(uuid string, order *Order) (string, bool, error) {
+	js, err := json.Marshal(order)
+	if err != nil {
+		return "", false, err
+	}
+
+	queue := func(pipe *redis.Pipeline) {
+		pipe.Set(uuid, string(js), 0)
+		pipe.SAdd(PendingOrdersKey, uuid)
+		pipe.SAdd(getOpenOrdersKey(order.Account), uuid)
+		lock := getRemainingLock(order)
+		addRiskTotals(pipe, order, 1, lock, lock)
+		enqueue(pipe, PendingOrdersKey, uuid)
+	}
+
+	if order.ClientOrderID == "" {
+		pipe := client.TxPipeline()
+		queue(pipe)
+		_, err = pipe.Exec()
+		return uuid, err == nil, err
+	}
+
+	key := getClientOrderKey(order.Account, order.ClientOrderID)
+	rawUUID := uuid
+	for i := 0; i < 3; i++ {
+		err = client.Watch(func(tx *redis.Tx) error {
+			bound, err := tx.Get(key).Result()
+			if err == nil {
+				rawUUID = bound
+				return nil
+			}
+			if err != redis.Nil {
+				return err
+			}
+
+			_, err = tx.Pipelined(func(pipe *redis.Pipeline) error {
+				pipe.Set(key, uuid, 0)
+				queue(pipe)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return rawUUID, rawUUID == uuid, nil
+}
+
+// getUUIDByClientOrderID 按客户端挂单ID取挂单UUID
+func getUUIDByClientOrderID(account, clientOrderID string) (string, error) {
+	return getString(getClientOrderKey(account, clientOrderID))
+}
+
 // updateTime 更新挂单完成时间和交易完成时间
 func updateOrderTime(uuid string, PendedTime, FinishedTime int64) error {
 	order, err := getOrder(uuid)
@@ -120,14 +390,39 @@ func getString(key string) (string, error) {
 	return client.Get(key).Result()
 }
 
-func getLastPrice() int64 {
-	price, _ := client.Get(LastPriceKey).Int64()
+// getLastPrice 交易对最新成交价，即每个源币换得的目标币数量
+func getLastPrice(srcCurrency, desCurrency string) float64 {
+	price, _ := client.HGet(LastPriceKey, getPairID(srcCurrency, desCurrency)).Float64()
 
 	return price
 }
 
-func setLastPrice(price int64) error {
-	return client.Set(LastPriceKey, price, 0).Err()
+func setLastPrice(srcCurrency, desCurrency string, price float64) error {
+	return client.HSet(LastPriceKey, getPairID(srcCurrency, desCurrency), price).Err()
+}
+
+// updateLastPrice 按成交的一对挂单“买入挂单UUID,卖出挂单UUID”更新两个方向的最新成交价
+func updateLastPrice(uuid string) (*Order, error) {
+	uuid2 := strings.Split(uuid, ",")
+	buyOrder, err := getOrder(uuid2[0])
+	if err != nil {
+		return nil, err
+	}
+	sellOrder, err := getOrder(uuid2[1])
+	if err != nil {
+		return nil, err
+	}
+	if buyOrder.FinalCost <= 0 || sellOrder.FinalCost <= 0 {
+		return nil, errors.New("FinalCost must be greater than 0.")
+	}
+
+	// 买单消耗的源币即卖单得到的目标币，反之亦然
+	pipe := client.Pipeline()
+	pipe.HSet(LastPriceKey, getPairID(buyOrder.SrcCurrency, buyOrder.DesCurrency), round(sellOrder.FinalCost/buyOrder.FinalCost, 6))
+	pipe.HSet(LastPriceKey, getPairID(sellOrder.SrcCurrency, sellOrder.DesCurrency), round(buyOrder.FinalCost/sellOrder.FinalCost, 6))
+	_, err = pipe.Exec()
+
+	return buyOrder, err
 }
 
 func isKeyExists(key string) (bool, error) {
@@ -138,12 +433,34 @@ func getKeys(pattern string) ([]string, error) {
 	return client.Keys(pattern).Result()
 }
 
-func addSet(key, value string) error {
-	return client.SAdd(key, value).Err()
+// scanKeys 使用SCAN分批查找匹配的键，不阻塞redis，扫描期间增删的键可能遗漏或重复
+func scanKeys(pattern string) ([]string, error) {
+	found := make(map[string]bool)
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(cursor, pattern, 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			found[key] = true
+		}
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	return keys, nil
 }
 
-func getBathSetMember(key string, count int64) ([]string, error) {
-	return client.SRandMemberN(key, count).Result()
+func addSet(key, value string) error {
+	return client.SAdd(key, value).Err()
 }
 
 func getAllSetMember(key string) ([]string, error) {
@@ -184,21 +501,25 @@ func mvPending2BS(uuid string) error {
 	// ******************************************
 	// *******将挂单移到买卖队列，确保事务性**********
 	// ******************************************
-	pipe := client.Pipeline()
+	pipe := client.TxPipeline()
 	// multi := client.Multi()
 
-	//从待挂单队列中移除
+	//从待挂单队列中移除，已锁定的数量不再计入已提交尚未锁定的数量
 	pipe.SRem(PendingOrdersKey, uuid)
-	//添加到买卖队列
+	addRiskTotals(pipe, order, 0, -getRemainingLock(order), 0)
+	//添加到买卖队列，止损单添加到触发队列
 	member := redis.Z{Member: uuid}
 
-	key := getBSKey(order.SrcCurrency, order.DesCurrency)
+	key := getBookKey(order)
 
 	// x个币A->y个币B 存入ZSet的score为y/x，相当于A的卖出价格，B的买入价格即为y/x
 	// X个币B->Y个币A 存入ZSet的score为Y/X，相当于B的卖出价格，A的买入价格即为X/Y
 	// 这样，两个都按从小到大排序，那么恰好就是卖出按价格从小到大，买入价格从大到小
-	member.Score = getScore(order.SrcCount, order.DesCount, order.PendingTime)
+	member.Score = getBookScore(order)
 	pipe.ZAdd(key, member)
+	scheduleExpiry(pipe, order)
+	trackImmediate(pipe, order)
+	registerPair(pipe, order.SrcCurrency, order.DesCurrency)
 
 	// 添加到挂单成功队列
 	pipe.SAdd(PendSuccessOrdersKey, uuid)
@@ -216,10 +537,62 @@ func temp() error {
 }
 
 func mvPending2Failed(uuid string) error {
-	return client.SMove(PendingOrdersKey, PendFailOrdersKey, uuid).Err()
+	return closeOrder(PendingOrdersKey, PendFailOrdersKey, uuid)
 }
 
+// dealMatchOrder 在事务中处理撮合成功的两个挂单
+// 挂单在读取后被改单等并发修改时放弃本次撮合，由下一轮撮合重新读取
 func dealMatchOrder(buyOrder, sellOrder *Order, timeStamp int64) error {
+	buyJS, _ := json.Marshal(buyOrder)
+	sellJS, _ := json.Marshal(sellOrder)
+
+	return client.Watch(func(tx *redis.Tx) error {
+		if tx.Get(buyOrder.UUID).Val() != string(buyJS) || tx.Get(sellOrder.UUID).Val() != string(sellJS) {
+			return errors.New("Order has been modified.")
+		}
+
+		return execMatchOrder(tx.Pipeline(), buyOrder, sellOrder, timeStamp)
+	}, buyOrder.UUID, sellOrder.UUID)
+}
+
+// orderMatch 一次撮合生成的成交对和补充了可见数量的冰山单
+type orderMatch struct {
+	buyUUID  string
+	sellUUID string
+	refilled []string
+}
+
+func execMatchOrder(pipe *redis.Pipeline, buyOrder, sellOrder *Order, timeStamp int64) error {
+	match := queueMatchOrder(pipe, buyOrder, sellOrder, timeStamp)
+
+	_, err := pipe.Exec()
+	if err != nil {
+		return err
+	}
+
+	addMatchHistory(match)
+	return nil
+}
+
+// addMatchHistory 撮合写入成功后记录挂单历史
+func addMatchHistory(match *orderMatch) {
+	addOrderHistory(match.buyUUID, EventMatched, "")
+	addOrderHistory(match.sellUUID, EventMatched, "")
+	for _, v := range match.refilled {
+		addOrderHistory(v, EventRefilled, "")
+	}
+}
+
+// getMatchPrice 撮合的成交价，即买单每个源币换得的目标币数量，以较早挂单的价格为准
+func getMatchPrice(buyOrder, sellOrder *Order) float64 {
+	if getBookTime(buyOrder) > getBookTime(sellOrder) {
+		return sellOrder.SrcCount / sellOrder.DesCount
+	}
+	return buyOrder.DesCount / buyOrder.SrcCount
+}
+
+// queueMatchOrder 在pipe中写入一次撮合，买卖挂单更新为撮合后的剩余部分
+func queueMatchOrder(pipe *redis.Pipeline, buyOrder, sellOrder *Order, timeStamp int64) *orderMatch {
 	// ***********************注意**********************
 	// ******买单的源币目标币正好与卖单的源币目标币相反********
 	// ******只要撮合成功，则必定不会出现锁定余额不足的情况********
@@ -228,10 +601,7 @@ func dealMatchOrder(buyOrder, sellOrder *Order, timeStamp int64) error {
 	// 成交价=目标币（buyOrder中的）数量/源币（buyOrder中的）数量  以撮合成的订单中较早挂单的价格为准
 	buyPrice := buyOrder.DesCount / buyOrder.SrcCount
 	sellPrice := sellOrder.SrcCount / sellOrder.DesCount
-	endPrice := buyPrice
-	if buyOrder.PendingTime > sellOrder.PendingTime {
-		endPrice = sellPrice
-	}
+	endPrice := getMatchPrice(buyOrder, sellOrder)
 
 	// 成交量=min(买单最小可交易数量,卖单最小可交易数量)
 	endCount := math.Min(math.Min(buyOrder.SrcCount*endPrice, buyOrder.DesCount), math.Min(sellOrder.SrcCount, sellOrder.DesCount*endPrice))
@@ -239,18 +609,19 @@ func dealMatchOrder(buyOrder, sellOrder *Order, timeStamp int64) error {
 	// ******************************************
 	// *******将处理挂单撮合，确保事务性**********
 	// ******************************************
-	pipe := client.Pipeline()
-	// multi := client.Multi()
 
 	//匹配的成对UUID，“买入挂单UUID,卖出挂单UUID”
 	matchBuyUUID := buyOrder.UUID
 	matchSellUUID := sellOrder.UUID
 	matchUUID := ""
+	refilled := []string{}
+	buyLock := getRemainingLock(buyOrder)
+	sellLock := getRemainingLock(sellOrder)
 
 	// 1.将完成的挂单从队列中移除,并修改撮合时间
 	// 2.将未完成的挂单剩余部分修改对应key的交易数量
 	buyOrder.FinalCost = endCount / endPrice
-	if !buyOrder.IsBuyAll && buyOrder.SrcCount*endPrice > endCount {
+	if !buyOrder.IsBuyAll && (buyOrder.SrcCount*endPrice > endCount || buyOrder.HiddenCount > 0) {
 		// 卖完为止时，源币有剩余则生成新单
 		tempBuyOrder := *buyOrder
 		tempBuyOrder.UUID = util.GenerateUUID()
@@ -259,10 +630,16 @@ func dealMatchOrder(buyOrder, sellOrder *Order, timeStamp int64) error {
 		tempBuyOrder.MatchedTime = timeStamp
 		tempBuyOrder.MatchedDate = time.Unix(timeStamp, 0).Format("2006-01-02 15:04:05")
 		tempBuyOrder.FinalCost = tempBuyOrder.SrcCount
+		buyOrder.FilledCost += tempBuyOrder.FinalCost
 
 		buyOrder.SrcCount = buyOrder.SrcCount - endCount/endPrice
 		buyOrder.DesCount = buyOrder.SrcCount * buyPrice
 
+		// 冰山单可见部分成交完时从隐藏数量补充
+		if refillIceberg(pipe, buyOrder, timeStamp) {
+			refilled = append(refilled, buyOrder.UUID)
+		}
+
 		js, _ := json.Marshal(buyOrder)
 		pipe.Set(buyOrder.UUID, string(js), 0)
 
@@ -271,7 +648,7 @@ func dealMatchOrder(buyOrder, sellOrder *Order, timeStamp int64) error {
 		pipe.SAdd("user_"+tempBuyOrder.Account, tempBuyOrder.UUID)
 
 		matchBuyUUID = tempBuyOrder.UUID
-	} else if buyOrder.IsBuyAll && buyOrder.DesCount > endCount {
+	} else if buyOrder.IsBuyAll && (buyOrder.DesCount > endCount || buyOrder.HiddenCount > 0) {
 		// 买完为止时，目标币有剩余则生成新单
 		tempBuyOrder := *buyOrder
 		tempBuyOrder.UUID = util.GenerateUUID()
@@ -280,10 +657,16 @@ func dealMatchOrder(buyOrder, sellOrder *Order, timeStamp int64) error {
 		tempBuyOrder.MatchedTime = timeStamp
 		tempBuyOrder.MatchedDate = time.Unix(timeStamp, 0).Format("2006-01-02 15:04:05")
 		tempBuyOrder.FinalCost = tempBuyOrder.SrcCount
+		buyOrder.FilledCost += tempBuyOrder.FinalCost
 
 		buyOrder.DesCount = buyOrder.DesCount - endCount
 		buyOrder.SrcCount = buyOrder.DesCount / buyPrice
 
+		// 冰山单可见部分成交完时从隐藏数量补充
+		if refillIceberg(pipe, buyOrder, timeStamp) {
+			refilled = append(refilled, buyOrder.UUID)
+		}
+
 		js, _ := json.Marshal(buyOrder)
 		pipe.Set(buyOrder.UUID, string(js), 0)
 
@@ -294,6 +677,7 @@ func dealMatchOrder(buyOrder, sellOrder *Order, timeStamp int64) error {
 		matchBuyUUID = tempBuyOrder.UUID
 	} else {
 		pipe.ZRem(getBSKey(buyOrder.SrcCurrency, buyOrder.DesCurrency), buyOrder.UUID)
+		pipe.ZRem(ExpiryKey, buyOrder.UUID)
 
 		buyOrder.MatchedTime = timeStamp
 		buyOrder.MatchedDate = time.Unix(timeStamp, 0).Format("2006-01-02 15:04:05")
@@ -305,7 +689,7 @@ func dealMatchOrder(buyOrder, sellOrder *Order, timeStamp int64) error {
 	}
 
 	sellOrder.FinalCost = endCount
-	if !sellOrder.IsBuyAll && sellOrder.SrcCount > endCount {
+	if !sellOrder.IsBuyAll && (sellOrder.SrcCount > endCount || sellOrder.HiddenCount > 0) {
 		// 卖完为止时，源币有剩余则生成新单
 		tempSellOrder := *sellOrder
 		tempSellOrder.UUID = util.GenerateUUID()
@@ -314,10 +698,16 @@ func dealMatchOrder(buyOrder, sellOrder *Order, timeStamp int64) error {
 		tempSellOrder.MatchedTime = timeStamp
 		tempSellOrder.MatchedDate = time.Unix(timeStamp, 0).Format("2006-01-02 15:04:05")
 		tempSellOrder.FinalCost = tempSellOrder.SrcCount
+		sellOrder.FilledCost += tempSellOrder.FinalCost
 
 		sellOrder.SrcCount = sellOrder.SrcCount - endCount
 		sellOrder.DesCount = sellOrder.SrcCount / sellPrice
 
+		// 冰山单可见部分成交完时从隐藏数量补充
+		if refillIceberg(pipe, sellOrder, timeStamp) {
+			refilled = append(refilled, sellOrder.UUID)
+		}
+
 		js, _ := json.Marshal(sellOrder)
 		pipe.Set(sellOrder.UUID, string(js), 0)
 
@@ -326,7 +716,7 @@ func dealMatchOrder(buyOrder, sellOrder *Order, timeStamp int64) error {
 		pipe.SAdd("user_"+tempSellOrder.Account, tempSellOrder.UUID)
 
 		matchSellUUID = tempSellOrder.UUID
-	} else if sellOrder.IsBuyAll && sellOrder.DesCount > endCount/endPrice {
+	} else if sellOrder.IsBuyAll && (sellOrder.DesCount > endCount/endPrice || sellOrder.HiddenCount > 0) {
 		// 买完为止时，目标币有剩余则生成新单
 		tempSellOrder := *sellOrder
 		tempSellOrder.UUID = util.GenerateUUID()
@@ -335,10 +725,16 @@ func dealMatchOrder(buyOrder, sellOrder *Order, timeStamp int64) error {
 		tempSellOrder.MatchedTime = timeStamp
 		tempSellOrder.MatchedDate = time.Unix(timeStamp, 0).Format("2006-01-02 15:04:05")
 		tempSellOrder.FinalCost = tempSellOrder.SrcCount
+		sellOrder.FilledCost += tempSellOrder.FinalCost
 
 		sellOrder.DesCount = sellOrder.DesCount - endCount/endPrice
 		sellOrder.SrcCount = sellOrder.DesCount * sellPrice
 
+		// 冰山单可见部分成交完时从隐藏数量补充
+		if refillIceberg(pipe, sellOrder, timeStamp) {
+			refilled = append(refilled, sellOrder.UUID)
+		}
+
 		js, _ := json.Marshal(sellOrder)
 		pipe.Set(sellOrder.UUID, string(js), 0)
 
@@ -349,6 +745,7 @@ func dealMatchOrder(buyOrder, sellOrder *Order, timeStamp int64) error {
 		matchSellUUID = tempSellOrder.UUID
 	} else {
 		pipe.ZRem(getBSKey(sellOrder.SrcCurrency, sellOrder.DesCurrency), sellOrder.UUID)
+		pipe.ZRem(ExpiryKey, sellOrder.UUID)
 
 		sellOrder.MatchedTime = timeStamp
 		sellOrder.MatchedDate = time.Unix(timeStamp, 0).Format("2006-01-02 15:04:05")
@@ -360,31 +757,57 @@ func dealMatchOrder(buyOrder, sellOrder *Order, timeStamp int64) error {
 	}
 
 	matchUUID = matchBuyUUID + "," + matchSellUUID
+	addMatchTotals(pipe, buyOrder, buyLock, matchBuyUUID == buyOrder.UUID)
+	addMatchTotals(pipe, sellOrder, sellLock, matchSellUUID == sellOrder.UUID)
 
 	// 3.将撮合成功的两个挂单放到别处等待chaincode处理
 	// 部分交易的挂单要赋予新的uuid，以免跟剩余部分的uuid重复
 	pipe.SAdd(MatchedOrdersKey, matchUUID)
+	enqueue(pipe, MatchedOrdersKey, matchUUID)
 
-	_, err := pipe.Exec()
-
-	return err
+	return &orderMatch{buyUUID: matchBuyUUID, sellUUID: matchSellUUID, refilled: refilled}
 }
 
 func getBSKeyByUUID(uuid string) string {
 	order, _ := getOrder(uuid)
-	return getBSKey(order.SrcCurrency, order.DesCurrency)
+	return getBookKey(order)
 }
 
-func mvBS2Expired(uuid string) error {
-	pipe := client.Pipeline()
-	// mutli := client.Multi()
-
-	pipe.SAdd(ExpiredOrdersKey, uuid)
-	pipe.ZRem(getBSKeyByUUID(uuid), uuid)
-
-	_, err := pipe.Exec()
+// leaveBookScript 将挂单从买卖队列或触发队列移到过期或待撤单队列，同时减少账户的未完成挂单数
+// KEYS[1]挂单所在的队列 KEYS[2]过期调度 KEYS[3]目标队列集合 KEYS[4]目标工作队列 KEYS[5]账户统计 ARGV[1]挂单UUID
+// 已不在队列中（已成交或撤单）的挂单不移动，返回0
+var leaveBookScript = redis.NewScript(`
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("SADD", KEYS[3], ARGV[1])
+redis.call("XADD", KEYS[4], "*", "member", ARGV[1])
+redis.call("HINCRBY", KEYS[5], "count", -1)
+return 1
+`)
+
+// leaveBook 将挂单从所在队列移到key对应的队列，已不在队列中时返回errNotInBook
+func leaveBook(order *Order, key string) error {
+	keys := []string{getBookKey(order), ExpiryKey, key, getQueueStream(key), getRiskTotalsKey(order.Account)}
+	result, err := leaveBookScript.Run(client, keys, order.UUID).Result()
+	if err != nil {
+		return err
+	}
+	if n, _ := result.(int64); n == 0 {
+		return errNotInBook
+	}
+	return nil
+}
 
-	return err
+// mvBS2Expired 将买卖队列中的挂单移到过期队列
+// 已不在买卖队列中（已成交或撤单）的挂单不再移动
+func mvBS2Expired(uuid string) error {
+	order, err := getOrder(uuid)
+	if err != nil {
+		return err
+	}
+	return leaveBook(order, ExpiredOrdersKey)
 }
 
 func rmSetMember(key, member string) error {
@@ -397,16 +820,26 @@ func clearFailedOrder(uuid string) {
 	rmSetMember(PendFailOrdersKey, uuid)
 }
 
-func mvBS2Cancel(bsKey, uuid string) error {
-	pipe := client.Pipeline()
-	// mutil := client.Multi()
+func mvBS2Cancel(order *Order) error {
+	return leaveBook(order, CancelingOrderKey)
+}
 
-	pipe.ZRem(bsKey, uuid)
-	pipe.SAdd(CancelingOrderKey, uuid)
+// cancelOrder 将买卖队列中的挂单移到待撤单队列，并记录撤单原因
+func cancelOrder(order *Order, reason string) error {
+	// 改单差额未处理完时不能撤单，否则会重复解锁
+	if current, err := getOrder(order.UUID); err == nil && current.Amending != "" {
+		return errors.New("Order is being amended.")
+	}
 
-	_, err := pipe.Exec()
+	err := mvBS2Cancel(order)
+	if err != nil {
+		return err
+	}
 
-	return err
+	saveOrderReason(order.UUID, reason)
+	addOrderHistory(order.UUID, EventCancel, reason)
+
+	return nil
 }
 
 func mvCancel2BS(uuid string) error {
@@ -414,19 +847,22 @@ func mvCancel2BS(uuid string) error {
 	if err != nil {
 		return err
 	}
-	key := getBSKey(order.SrcCurrency, order.DesCurrency)
+	key := getBookKey(order)
 	// ******************************************
 	// *******将撤单失败的还原回买卖队列，确保事务性**********
 	// ******************************************
-	pipe := client.Pipeline()
+	pipe := client.TxPipeline()
 	// multi := client.Multi()
 
-	//从待撤单队列中移除
-	pipe.SRem(PendingOrdersKey, uuid)
+	//从待撤单队列中移除，重新计入未完成挂单
+	pipe.SRem(CancelingOrderKey, uuid)
+	addRiskTotals(pipe, order, 1, 0, 0)
 	//还原到买卖队列
 	member := redis.Z{Member: uuid}
-	member.Score = order.DesCount / order.SrcCount
+	member.Score = getBookScore(order)
 	pipe.ZAdd(key, member)
+	scheduleExpiry(pipe, order)
+	trackImmediate(pipe, order)
 
 	// 添加到挂单失败队列
 	pipe.SAdd(CancelFailOrderKey, uuid)
@@ -437,11 +873,11 @@ func mvCancel2BS(uuid string) error {
 }
 
 func mvCancle2Success(uuid string) error {
-	return client.SMove(CancelingOrderKey, CancelSuccessOrderKey, uuid).Err()
+	return closeOrder(CancelingOrderKey, CancelSuccessOrderKey, uuid)
 }
 
 func mvExpired2Success(uuid string) error {
-	return client.SMove(ExpiredOrdersKey, ExpiredSuccessOrderKey, uuid).Err()
+	return closeOrder(ExpiredOrdersKey, ExpiredSuccessOrderKey, uuid)
 }
 
 func mvExec2Success(key, uuid string) error {
@@ -455,24 +891,47 @@ func mvExec2Success(key, uuid string) error {
 	// 修改时间，没必要事务处理，单独处理即可
 	updateOrderTime(uuid2[0], 0, time.Now().Unix())
 	updateOrderTime(uuid2[1], 0, time.Now().Unix())
+	addOrderHistory(uuid2[0], EventFinished, "")
+	addOrderHistory(uuid2[1], EventFinished, "")
 
 	_, err := pipe.Exec()
 
 	return err
 }
 
+// getOppositeOrders 按价格从优到劣取对手盘中未过期的挂单，最多取配置的深度
+func getOppositeOrders(srcCurrency, desCurrency string) ([]*Order, error) {
+	depth := viper.GetInt64("exchange.market.depth")
+
+	uuids, err := client.ZRange(getBSKey(desCurrency, srcCurrency), 0, depth-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	orders := []*Order{}
+	for _, v := range uuids {
+		order, err := getOrder(v)
+		if err != nil {
+			continue
+		}
+		if order.ExpiredTime > 0 && order.ExpiredTime <= time.Now().Unix() {
+			continue
+		}
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+// getAllBS 所有已登记交易对的买卖队列中的挂单
 func getAllBS() ([]string, error) {
-	// 所有以ExchangeKey开头的key
-	keys, err := getKeys(ExchangeKey + "*")
+	pairs, err := getPairs()
 	if err != nil {
 		return nil, err
 	}
 
 	uuids := []string{}
-	for _, v := range keys {
-		count := client.ZCard(v).Val()
-
-		copy(uuids, client.ZRange(v, 0, count).Val())
+	for _, v := range pairs {
+		uuids = append(uuids, client.ZRange(getBSKey(v.SrcCurrency, v.DesCurrency), 0, -1).Val()...)
 	}
 	return uuids, nil
 }
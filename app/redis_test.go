@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestGetMatchPrice(t *testing.T) {
+	// 买单每个源币换得2个目标币，卖单每个目标币花费2.5个源币
+	buy := func(pending int64) *Order {
+		return &Order{SrcCount: 10, DesCount: 20, PendingTime: pending}
+	}
+	sell := func(pending int64) *Order {
+		return &Order{SrcCount: 25, DesCount: 10, PendingTime: pending}
+	}
+	tests := []struct {
+		name      string
+		buy, sell *Order
+		want      float64
+	}{
+		{"buy order first", buy(1), sell(2), 2},
+		{"sell order first", buy(2), sell(1), 2.5},
+		{"same time", buy(1), sell(1), 2},
+		{"amended buy order", &Order{SrcCount: 10, DesCount: 20, PendingTime: 1, AmendedTime: 3}, sell(2), 2.5},
+	}
+	for _, tt := range tests {
+		if got := getMatchPrice(tt.buy, tt.sell); got != tt.want {
+			t.Errorf("%s: getMatchPrice() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"gopkg.in/redis.v5"
+)
+
+// 挂单前的风控检查：不满足的挂单直接拒绝，不再提交chaincode锁定
+// 可用余额为chaincode中未锁定的数量减去已提交但尚未锁定的挂单
+// 账户的未完成挂单数和锁定数量按riskTotals_[account]计数，与挂单、锁定、撮合、撤单和过期的状态转移在同一事务或脚本中修改
+// 限额按源币种配置在app.risk下，未单独配置的币种使用default，0表示不限
+// chaincode中的未锁定数量按账户缓存，同一账户并发挂单或缓存未过期时检查可能同时通过，余额以chaincode锁定为准
+
+// 风控检查项
+const (
+	RiskInsufficientBalance = "INSUFFICIENT_BALANCE" //可用余额不足
+	RiskMaxOrderValue       = "MAX_ORDER_VALUE"      //单笔挂单数量超限
+	RiskMaxOpenOrders       = "MAX_OPEN_ORDERS"      //未完成挂单数超限
+	RiskMaxNotional         = "MAX_NOTIONAL"         //未完成挂单锁定的总数量超限
+)
+
+// RiskError 风控检查未通过的原因，数量为实际数量
+type RiskError struct {
+	Code     string  `json:"code"`
+	Msg      string  `json:"msg"`
+	Currency string  `json:"currency,omitempty"`
+	Limit    float64 `json:"limit"` //限额，余额不足时为可用余额
+	Value    float64 `json:"value"` //加上本挂单后的数值
+}
+
+func (e *RiskError) Error() string {
+	return e.Msg
+}
+
+// riskResult 风控拒绝的响应，在restResult的基础上增加检查项
+type riskResult struct {
+	OK   interface{}
+	Err  string
+	Risk *RiskError
+}
+
+// openOrders 账户未完成挂单中某个币种的统计
+type openOrders struct {
+	count    int64
+	reserved int64 //已提交尚未锁定的数量
+	notional int64 //未完成挂单锁定的数量
+}
+
+// 账户统计的字段，数量字段后接币种代码
+const (
+	riskCount    = "count"
+	riskReserved = "reserved_"
+	riskNotional = "notional_"
+)
+
+// balanceEntry 缓存的账户未锁定数量，按币种
+type balanceEntry struct {
+	assets  map[string]int64
+	expires int64
+}
+
+// balances 本实例缓存的账户未锁定数量
+var balances = struct {
+	sync.Mutex
+	entries map[string]*balanceEntry
+}{entries: make(map[string]*balanceEntry)}
+
+// closeOrderScript 将挂单从队列集合移到结束集合，同时从账户未完成挂单中移除并修改账户统计
+// KEYS[1]队列集合 KEYS[2]结束集合 KEYS[3]账户未完成挂单 KEYS[4]账户统计 ARGV[1]挂单UUID ARGV[2...]字段和增量
+// 已不在队列集合中（重复的结果）时不修改，返回0
+var closeOrderScript = redis.NewScript(`
+if redis.call("SMOVE", KEYS[1], KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("SREM", KEYS[3], ARGV[1])
+for i = 2, #ARGV, 2 do
+	redis.call("HINCRBY", KEYS[4], ARGV[i], ARGV[i + 1])
+end
+return 1
+`)
+
+func getOpenOrdersKey(account string) string {
+	return OpenOrdersKey + "_" + account
+}
+
+func getRiskTotalsKey(account string) string {
+	return RiskTotalsKey + "_" + account
+}
+
+// getRiskFields 账户统计需修改的字段和增量，增量为0的字段不修改
+func getRiskFields(currency string, count, reserved, notional int64) []interface{} {
+	fields := []interface{}{}
+	if count != 0 {
+		fields = append(fields, riskCount, count)
+	}
+	if reserved != 0 {
+		fields = append(fields, riskReserved+currency, reserved)
+	}
+	if notional != 0 {
+		fields = append(fields, riskNotional+currency, notional)
+	}
+	return fields
+}
+
+// addRiskTotals 在pipe中修改账户统计，需与挂单状态的转移在同一事务中执行
+func addRiskTotals(pipe *redis.Pipeline, order *Order, count, reserved, notional int64) {
+	key := getRiskTotalsKey(order.Account)
+	fields := getRiskFields(order.SrcCurrency, count, reserved, notional)
+	for i := 0; i < len(fields); i += 2 {
+		pipe.HIncrBy(key, fields[i].(string), fields[i+1].(int64))
+	}
+}
+
+// addMatchTotals 撮合后修改账户统计，lock为撮合前剩余的锁定数量
+// 全部成交的挂单不再计入未完成挂单，剩余的锁定由chaincode执行交易时结算
+func addMatchTotals(pipe *redis.Pipeline, order *Order, lock int64, filled bool) {
+	if filled {
+		pipe.SRem(getOpenOrdersKey(order.Account), order.UUID)
+		addRiskTotals(pipe, order, -1, 0, -lock)
+		return
+	}
+	addRiskTotals(pipe, order, 0, 0, getRemainingLock(order)-lock)
+}
+
+// closeOrder 挂单处理结束，从队列集合移到结束集合并解除锁定数量的统计
+// 挂单失败时还减少挂单数和已提交尚未锁定的数量，撤单和过期已在移出买卖队列时减少挂单数
+func closeOrder(from, to, uuid string) error {
+	order, err := getOrder(uuid)
+	if err != nil {
+		return client.SMove(from, to, uuid).Err()
+	}
+
+	lock := getRemainingLock(order)
+	fields := getRiskFields(order.SrcCurrency, 0, 0, -lock)
+	if from == PendingOrdersKey {
+		fields = getRiskFields(order.SrcCurrency, -1, -lock, -lock)
+	}
+	keys := []string{from, to, getOpenOrdersKey(order.Account), getRiskTotalsKey(order.Account)}
+	args := append([]interface{}{uuid}, fields...)
+	return closeOrderScript.Run(client, keys, args...).Err()
+}
+
+// getRiskLimit 币种的限额，放大Multiple倍
+// 币种代码可以包含“.”和“_”，不能拼接为viper的键，按配置中的键逐个比较（viper的键不区分大小写）
+func getRiskLimit(name, currency string) int64 {
+	key := "app.risk." + name
+	for k, v := range viper.GetStringMap(key) {
+		if k != "default" && strings.EqualFold(k, currency) {
+			return int64(cast.ToFloat64(v) * Multiple)
+		}
+	}
+	return int64(viper.GetFloat64(key+".default") * Multiple)
+}
+
+// getAvailableBalance chaincode中未锁定的数量，放大Multiple倍，没有该币种时为0
+// 查询结果按账户缓存app.risk.balanceTTL秒，挂单锁定成功后失效
+func getAvailableBalance(account, currency string) (int64, error) {
+	now := time.Now().Unix()
+	balances.Lock()
+	entry, ok := balances.entries[account]
+	balances.Unlock()
+	if ok && entry.expires > now {
+		return entry.assets[currency], nil
+	}
+
+	entry = &balanceEntry{assets: make(map[string]int64), expires: now + viper.GetInt64("app.risk.balanceTTL")}
+	result, err := getAsset(account)
+	if err != nil && !strings.Contains(err.Error(), "No row data") {
+		return 0, err
+	}
+	// chaincode的NoDataErr，账户没有任何币
+	if err == nil {
+		var assets []struct {
+			Currency string `json:"currency"`
+			Count    int64  `json:"count"`
+		}
+		err = json.Unmarshal([]byte(result), &assets)
+		if err != nil {
+			return 0, err
+		}
+		for _, v := range assets {
+			entry.assets[v.Currency] = v.Count
+		}
+	}
+
+	balances.Lock()
+	balances.entries[account] = entry
+	balances.Unlock()
+	return entry.assets[currency], nil
+}
+
+// invalidateBalance 挂单锁定后账户的未锁定数量减少，缓存失效
+func invalidateBalance(account string) {
+	balances.Lock()
+	delete(balances.entries, account)
+	balances.Unlock()
+}
+
+// getOpenOrders 账户的未完成挂单数和币种的锁定数量
+func getOpenOrders(account, currency string) (*openOrders, error) {
+	values, err := client.HMGet(getRiskTotalsKey(account), riskCount, riskReserved+currency, riskNotional+currency).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return &openOrders{
+		count:    cast.ToInt64(values[0]),
+		reserved: cast.ToInt64(values[1]),
+		notional: cast.ToInt64(values[2]),
+	}, nil
+}
+
+// checkOrderRisk 检查挂单的可用余额和账户限额
+func checkOrderRisk(order *Order) error {
+	currency := order.SrcCurrency
+	value := int64(order.LockedCount * Multiple)
+
+	if limit := getRiskLimit("maxOrderValue", currency); limit > 0 && value > limit {
+		return &RiskError{
+			Code:     RiskMaxOrderValue,
+			Msg:      fmt.Sprintf("Order of [%s] exceeds the maximum order value.", currency),
+			Currency: currency,
+			Limit:    float64(limit) / Multiple,
+			Value:    float64(value) / Multiple,
+		}
+	}
+
+	open, err := getOpenOrders(order.Account, currency)
+	if err != nil {
+		return err
+	}
+	if limit := viper.GetInt64("app.risk.maxOpenOrders"); limit > 0 && open.count+1 > limit {
+		return &RiskError{
+			Code:  RiskMaxOpenOrders,
+			Msg:   "Too many open orders.",
+			Limit: float64(limit),
+			Value: float64(open.count + 1),
+		}
+	}
+	if limit := getRiskLimit("maxNotional", currency); limit > 0 && open.notional+value > limit {
+		return &RiskError{
+			Code:     RiskMaxNotional,
+			Msg:      fmt.Sprintf("Open orders of [%s] exceed the maximum notional.", currency),
+			Currency: currency,
+			Limit:    float64(limit) / Multiple,
+			Value:    float64(open.notional+value) / Multiple,
+		}
+	}
+
+	balance, err := getAvailableBalance(order.Account, currency)
+	if err != nil {
+		return err
+	}
+	available := balance - open.reserved
+	if value > available {
+		return &RiskError{
+			Code:     RiskInsufficientBalance,
+			Msg:      fmt.Sprintf("Available balance of [%s] is insufficient.", currency),
+			Currency: currency,
+			Limit:    float64(available) / Multiple,
+			Value:    float64(value) / Multiple,
+		}
+	}
+	return nil
+}
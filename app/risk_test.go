@@ -0,0 +1,24 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetRiskFields(t *testing.T) {
+	tests := []struct {
+		count, reserved, notional int64
+		want                      []interface{}
+	}{
+		{0, 0, 0, []interface{}{}},
+		{1, 100, 100, []interface{}{"count", int64(1), "reserved_BTC", int64(100), "notional_BTC", int64(100)}},
+		{0, -100, 0, []interface{}{"reserved_BTC", int64(-100)}},
+		{-1, 0, -50, []interface{}{"count", int64(-1), "notional_BTC", int64(-50)}},
+	}
+	for _, tt := range tests {
+		got := getRiskFields("BTC", tt.count, tt.reserved, tt.notional)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getRiskFields(%d, %d, %d) = %v, want %v", tt.count, tt.reserved, tt.notional, got, tt.want)
+		}
+	}
+}
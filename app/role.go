@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gocraft/web"
+	"github.com/spf13/viper"
+	"gopkg.in/redis.v5"
+)
+
+// 角色：按enrollID保存，各路由由中间件检查
+//   issuer   币的创建、发布和分发
+//   trader   挂单和改单；撤销自己的挂单不需要角色
+//   operator 死信处理和对账等运维接口
+//   admin    角色的授予和撤销，拥有全部角色
+// 没有设置过角色的账户使用app.roles.default；app.roles.admins中的账户始终是admin，用于初始化第一个管理员
+
+// 角色
+const (
+	RoleIssuer   = "issuer"
+	RoleTrader   = "trader"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roles = map[string]bool{
+	RoleIssuer:   true,
+	RoleTrader:   true,
+	RoleOperator: true,
+	RoleAdmin:    true,
+}
+
+// roleScript 授予或撤销角色，第一次设置时先写入默认角色
+var roleScript = redis.NewScript(`
+if redis.call("HSETNX", KEYS[1], ARGV[1], 1) == 1 then
+	for i = 4, #ARGV do
+		redis.call("SADD", KEYS[2], ARGV[i])
+	end
+end
+if ARGV[2] == "grant" then
+	redis.call("SADD", KEYS[2], ARGV[3])
+else
+	redis.call("SREM", KEYS[2], ARGV[3])
+end
+return redis.call("SMEMBERS", KEYS[2])
+`)
+
+func getRolesKey(enrollID string) string {
+	return RolesKey + "_" + enrollID
+}
+
+// isBuiltinAdmin 是否配置的管理员
+func isBuiltinAdmin(enrollID string) bool {
+	for _, v := range viper.GetStringSlice("app.roles.admins") {
+		if v == enrollID {
+			return true
+		}
+	}
+	return false
+}
+
+// getRoles 账户的角色，没有设置过的返回默认角色
+func getRoles(enrollID string) ([]string, error) {
+	var result []string
+	ok, err := client.HExists(RolesKey, enrollID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		result, err = getAllSetMember(getRolesKey(enrollID))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		result = viper.GetStringSlice("app.roles.default")
+	}
+
+	if isBuiltinAdmin(enrollID) {
+		for _, v := range result {
+			if v == RoleAdmin {
+				return result, nil
+			}
+		}
+		result = append(result, RoleAdmin)
+	}
+	return result, nil
+}
+
+// hasRole 账户是否有该角色，admin拥有全部角色
+func hasRole(enrollID, role string) (bool, error) {
+	result, err := getRoles(enrollID)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range result {
+		if v == role || v == RoleAdmin {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// setRole 授予或撤销账户的角色，返回设置后的角色
+func setRole(enrollID, role string, grant bool) ([]string, error) {
+	if !roles[role] {
+		return nil, fmt.Errorf("Unknown role [%s], must be issuer, trader, operator or admin.", role)
+	}
+	op := "revoke"
+	if grant {
+		op = "grant"
+	}
+
+	args := []interface{}{enrollID, op, role}
+	for _, v := range viper.GetStringSlice("app.roles.default") {
+		args = append(args, v)
+	}
+	result, err := roleScript.Run(client, []string{RolesKey, getRolesKey(enrollID)}, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	members := []string{}
+	for _, v := range result.([]interface{}) {
+		members = append(members, v.(string))
+	}
+	return members, nil
+}
+
+// requireRole 需要登录且有该角色
+func (a *AppREST) requireRole(role string, rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if a.Account == "" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(rw).Encode(restResp{Status: FAILED, Result: respErr{Code: NOTLOGIN, Msg: errNotLogin.Error()}})
+		return
+	}
+	ok, err := hasRole(a.Account, role)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(rw).Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		return
+	}
+	if !ok {
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(restResult{Err: fmt.Sprintf("Role %s is required.", role)})
+		return
+	}
+	next(rw, req)
+}
+
+// RequireIssuerRole 需要issuer角色
+func (a *AppREST) RequireIssuerRole(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	a.requireRole(RoleIssuer, rw, req, next)
+}
+
+// RequireTraderRole 需要trader角色
+func (a *AppREST) RequireTraderRole(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	a.requireRole(RoleTrader, rw, req, next)
+}
+
+// RequireOperatorRole 需要operator角色
+func (a *AppREST) RequireOperatorRole(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	a.requireRole(RoleOperator, rw, req, next)
+}
+
+// RequireAdminRole 需要admin角色
+func (a *AppREST) RequireAdminRole(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	a.requireRole(RoleAdmin, rw, req, next)
+}
+
+// Roles 账户的角色
+func (a *AppREST) Roles(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing get roles request...")
+
+	encoder := json.NewEncoder(rw)
+
+	result, err := getRoles(req.PathParams["enrollID"])
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error redis operation: %s", err)})
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: result})
+}
+
+// GrantRole 授予角色，请求内容 {"role":"issuer"}
+func (a *AppREST) GrantRole(rw web.ResponseWriter, req *web.Request) {
+	a.changeRole(rw, req, true)
+}
+
+// RevokeRole 撤销角色，请求内容 {"role":"issuer"}
+func (a *AppREST) RevokeRole(rw web.ResponseWriter, req *web.Request) {
+	a.changeRole(rw, req, false)
+}
+
+func (a *AppREST) changeRole(rw web.ResponseWriter, req *web.Request, grant bool) {
+	myLogger.Info("REST processing change role request...")
+
+	encoder := json.NewEncoder(rw)
+	enrollID := req.PathParams["enrollID"]
+
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(restResult{Err: "Internal JSON error when reading request body."})
+
+		myLogger.Error("Internal JSON error when reading request body.")
+		return
+	}
+
+	var change struct {
+		Role string `json:"role"`
+	}
+	err = json.Unmarshal(reqBody, &change)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: fmt.Sprintf("Error unmarshalling role request payload: %s", err)})
+		return
+	}
+	if !grant && change.Role == RoleAdmin && isBuiltinAdmin(enrollID) {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: "Role admin of app.roles.admins can't be revoked."})
+		return
+	}
+
+	result, err := setRole(enrollID, change.Role, grant)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(restResult{Err: err.Error()})
+		return
+	}
+	myLogger.Infof("Role [%s] of [%s] changed by [%s], grant: %t", change.Role, enrollID, a.Account, grant)
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(restResult{OK: result})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 登录会话：按membership service的enrollID和enrollSecret注册并初始化crypto客户端
+// 本节点已注册过的客户端不会再向CA校验enrollSecret，因此首次注册成功时保存enrollSecret的bcrypt哈希，之后按哈希校验
+// 保存哈希之前已注册的客户端（如启动时注册的admin）由运维通过credentials命令设置哈希后才能登录
+// 登录成功后签发会话令牌“base64url(SessionClaims).base64url(HMAC-SHA256)”，会话同时保存在redis中，过期或退出后失效
+// 令牌放在SessionCookie中，或按“Authorization: Bearer [令牌]”传递；接口的账户一律取自令牌
+
+const SessionCookie = "session"
+
+var (
+	errNotLogin           = errors.New("not login")
+	errInvalidCredentials = errors.New("Invalid enrollID or enrollSecret.")
+	errNoCredentials      = errors.New("The enrollment was registered on this node before credentials were saved, please ask an operator to reset it.")
+)
+
+// SessionClaims 会话令牌的内容
+type SessionClaims struct {
+	ID      string `json:"id"`
+	Account string `json:"account"`
+	Expires int64  `json:"exp"`
+}
+
+func getSessionKey(id string) string {
+	return SessionKey + "_" + id
+}
+
+// signSession 会话令牌的签名，密钥为app.session.secret
+func signSession(payload string) string {
+	mac := hmac.New(sha256.New, []byte(viper.GetString("app.session.secret")))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newSession 为账户创建会话并签发令牌，有效期为app.session.ttl
+func newSession(account string) (string, *SessionClaims, error) {
+	if viper.GetString("app.session.secret") == "" {
+		return "", nil, errors.New("app.session.secret is not configured.")
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	ttl := time.Duration(viper.GetInt64("app.session.ttl")) * time.Second
+	claims := &SessionClaims{
+		ID:      hex.EncodeToString(b),
+		Account: account,
+		Expires: time.Now().Add(ttl).Unix(),
+	}
+
+	err := client.Set(getSessionKey(claims.ID), account, ttl).Err()
+	if err != nil {
+		return "", nil, err
+	}
+
+	js, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(js)
+	return payload + "." + signSession(payload), claims, nil
+}
+
+// parseSession 校验令牌的签名、有效期，以及会话是否已退出
+func parseSession(token string) (*SessionClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signSession(parts[0]))) {
+		return nil, errNotLogin
+	}
+	js, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errNotLogin
+	}
+	var claims SessionClaims
+	if err := json.Unmarshal(js, &claims); err != nil || claims.Expires <= time.Now().Unix() {
+		return nil, errNotLogin
+	}
+
+	account, err := getString(getSessionKey(claims.ID))
+	if err != nil || account != claims.Account {
+		return nil, errNotLogin
+	}
+	return &claims, nil
+}
+
+// getSessionToken 请求中的会话令牌，Authorization头优先
+func getSessionToken(req *web.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if cookie, err := req.Cookie(SessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// getSession 请求的会话
+func getSession(req *web.Request) (*SessionClaims, error) {
+	token := getSessionToken(req)
+	if token == "" {
+		return nil, errNotLogin
+	}
+	return parseSession(token)
+}
+
+// checkLogin 请求的会话对应的账户
+func checkLogin(req *web.Request) (string, error) {
+	claims, err := getSession(req)
+	if err != nil {
+		return "", err
+	}
+	return claims.Account, nil
+}
+
+// revokeSession 退出会话，令牌在有效期内也不能再使用
+func revokeSession(id string) error {
+	return client.Del(getSessionKey(id)).Err()
+}
+
+// isEnrolled 本节点是否已注册过该客户端
+func isEnrolled(enrollID string) bool {
+	_, err := os.Stat(filepath.Join(viper.GetString("peer.fileSystemPath"), "crypto", "client", enrollID))
+	return err == nil
+}
+
+// verifyCredentials 校验enrollID和enrollSecret
+// 已保存哈希的按哈希校验；否则通过setCryptoClient向membership service注册，成功后保存哈希
+func verifyCredentials(enrollID, enrollSecret string) error {
+	hash, err := client.HGet(CredentialsKey, enrollID).Result()
+	if err == nil {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(enrollSecret)) != nil {
+			return errInvalidCredentials
+		}
+		_, err = setCryptoClient(enrollID, enrollSecret)
+		return err
+	}
+
+	if isEnrolled(enrollID) {
+		return errNoCredentials
+	}
+	if _, err := setCryptoClient(enrollID, enrollSecret); err != nil {
+		myLogger.Errorf("Failed enrolling [%s]: %s", enrollID, err)
+		return errInvalidCredentials
+	}
+
+	b, err := bcrypt.GenerateFromPassword([]byte(enrollSecret), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return client.HSet(CredentialsKey, enrollID, string(b)).Err()
+}
+
+// resetCredentials 设置enrollID的enrollSecret哈希，用于保存哈希之前已在本节点注册的客户端
+// 未在本节点注册过的按正常登录流程向CA注册，不能预先设置
+func resetCredentials(enrollID, enrollSecret string) error {
+	if enrollID == "" || enrollSecret == "" {
+		return errors.New("enrollID and enrollSecret must not be empty.")
+	}
+	if !isEnrolled(enrollID) {
+		return errors.New("The enrollment is not registered on this node, log in to register it.")
+	}
+
+	b, err := bcrypt.GenerateFromPassword([]byte(enrollSecret), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return client.HSet(CredentialsKey, enrollID, string(b)).Err()
+}
+
+// runCredentials 命令行设置登录凭证：credentials [enrollID]，enrollSecret从标准输入读取，避免留在命令历史中
+func runCredentials(args []string) {
+	initRedis()
+	defer client.Close()
+
+	if len(args) != 1 {
+		fmt.Println("Usage: credentials <enrollID>, reads enrollSecret from stdin")
+		os.Exit(1)
+	}
+
+	secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := resetCredentials(args[0], strings.TrimRight(secret, "\r\n")); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Credentials of %s reset.\n", args[0])
+}
+
+// setSessionCookie 设置或清除会话cookie
+func setSessionCookie(rw web.ResponseWriter, token string, expires int64) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Unix(expires, 0),
+		MaxAge:   int(expires - time.Now().Unix()),
+		HttpOnly: true,
+		Secure:   viper.GetBool("app.tls.enabled"),
+	})
+}
+
+// Authenticate 按请求的API Key签名或会话令牌设置账户，没有有效会话时账户为空
+// 带X-API-Key的请求签名校验失败时直接拒绝，不再按会话处理
+func (a *AppREST) Authenticate(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if req.Header.Get("X-API-Key") != "" {
+		key, err := verifyAPIRequest(req)
+		if err != nil {
+			rw.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(rw).Encode(restResp{Status: FAILED, Result: respErr{Code: NOTLOGIN, Msg: err.Error()}})
+			return
+		}
+		a.Account, a.APIKey = key.Account, key
+		next(rw, req)
+		return
+	}
+
+	a.Account, _ = checkLogin(req)
+	next(rw, req)
+}
+
+// RequireLogin 需要登录的接口
+func (a *AppREST) RequireLogin(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if a.Account == "" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(rw).Encode(restResp{Status: FAILED, Result: respErr{Code: NOTLOGIN, Msg: errNotLogin.Error()}})
+		return
+	}
+	next(rw, req)
+}
+
+// isOwnOrder 挂单是否属于账户，不属于的按挂单不存在处理
+func isOwnOrder(uuid, account string) bool {
+	order, err := getOrder(uuid)
+	return err == nil && order.Account == account
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+const (
+	OrderTypeStop      = "stop"      //止损市价单，触发后按市价单成交
+	OrderTypeStopLimit = "stopLimit" //止损限价单，触发后按限价单挂单
+
+	CancelReasonNoLiquidity = "noLiquidity" //止损市价单触发时对手盘为空
+)
+
+// 止损价StopPrice与Price同义，即每个源币换得的目标币数量
+// 交易对最新成交价跌到StopPrice及以下时触发，即源币的止损卖出，也即目标币的突破买入
+
+// isStopOrder 是否为止损单
+func isStopOrder(order *Order) bool {
+	return order.Type == OrderTypeStop || order.Type == OrderTypeStopLimit
+}
+
+// isWaitingTrigger 是否为等待触发的止损单
+func isWaitingTrigger(order *Order) bool {
+	return isStopOrder(order) && order.TriggeredTime == 0
+}
+
+func getStopKey(srcCurrency, desCurrency string) string {
+	return StopOrdersKey + "_" + getPairID(srcCurrency, desCurrency)
+}
+
+// getBookKey 挂单所在的队列，等待触发的止损单在触发队列，其他在买卖队列
+func getBookKey(order *Order) string {
+	if isWaitingTrigger(order) {
+		return getStopKey(order.SrcCurrency, order.DesCurrency)
+	}
+	return getBSKey(order.SrcCurrency, order.DesCurrency)
+}
+
+// getBookScore 挂单在所在队列中的score，触发队列按止损价排列
+func getBookScore(order *Order) float64 {
+	if isWaitingTrigger(order) {
+		return order.StopPrice
+	}
+	return getScore(order.SrcCount, order.DesCount, getBookTime(order))
+}
+
+// getBookTime 挂单最近一次进入买卖队列的时间
+// 止损单为触发时间，冰山单为最近一次补充的时间，改价或加量的挂单为改单时间
+func getBookTime(order *Order) int64 {
+	t := order.PendingTime
+	for _, v := range []int64{order.TriggeredTime, order.RefilledTime, order.AmendedTime} {
+		if v > t {
+			t = v
+		}
+	}
+	return t
+}
+
+// prepareStopOrder 校验止损单
+// 止损市价单挂单时按SrcCount锁定余额：卖完为止时SrcCount为卖出数量，买完为止时SrcCount为最多花费的数量
+func prepareStopOrder(order *Order) error {
+	if order.StopPrice <= 0 {
+		return errors.New("StopPrice must be greater than 0.")
+	}
+	if order.Type == OrderTypeStopLimit {
+		return nil
+	}
+
+	if order.SrcCount <= 0 {
+		return errors.New("SrcCount must be greater than 0.")
+	}
+	if order.IsBuyAll && order.DesCount <= 0 {
+		return errors.New("DesCount must be greater than 0.")
+	}
+	if !order.IsBuyAll {
+		// 触发时按对手盘重新推算，此处按止损价预估
+		order.DesCount = round(order.SrcCount*order.StopPrice, 6)
+	}
+	order.Slippage = marketSlippage(order.Slippage)
+
+	return nil
+}
+
+// triggerStopOrders 交易对最新成交价达到止损价时，将触发队列中的止损单移到买卖队列
+func triggerStopOrders(srcCurrency, desCurrency string) {
+	last := getLastPrice(srcCurrency, desCurrency)
+	if last <= 0 {
+		return
+	}
+
+	uuids, err := client.ZRangeByScore(getStopKey(srcCurrency, desCurrency), redis.ZRangeBy{
+		Min: fmt.Sprintf("%f", last),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return
+	}
+
+	for _, v := range uuids {
+		order, err := getOrder(v)
+		if err != nil {
+			continue
+		}
+		triggerStopOrder(order)
+	}
+}
+
+// triggerScript 将止损单从触发队列移到买卖队列
+// KEYS[1]触发队列 KEYS[2]挂单 KEYS[3]买卖队列 KEYS[4]即时成交集合
+// ARGV[1]挂单UUID ARGV[2]触发后的挂单 ARGV[3]买卖队列score ARGV[4]读取时的改单次数 ARGV[5]是否即时成交
+// 正在改单、读取后已改单或已不在触发队列中（已撤单、过期或已被触发）的止损单不移动，返回0
+var triggerScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[2])
+if not current then
+	return 0
+end
+local order = cjson.decode(current)
+if type(order.amending) == "string" and order.amending ~= "" then
+	return 0
+end
+if tostring(order.amendCount or 0) ~= ARGV[4] then
+	return 0
+end
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("SET", KEYS[2], ARGV[2])
+redis.call("ZADD", KEYS[3], ARGV[3], ARGV[1])
+if ARGV[5] == "1" then
+	redis.call("SADD", KEYS[4], ARGV[1])
+end
+return 1
+`)
+
+// triggerStopOrder 触发止损单，余额已在挂单时锁定
+func triggerStopOrder(order *Order) error {
+	stopKey := getBookKey(order)
+
+	if order.Type == OrderTypeStop {
+		// 止损市价单按对手盘推算挂单数量，花费不超过锁定的数量
+		err := prepareMarketOrder(order)
+		if err != nil {
+			return cancelOrder(order, CancelReasonNoLiquidity)
+		}
+		if order.SrcCount > order.LockedCount {
+			order.DesCount = round(order.DesCount*order.LockedCount/order.SrcCount, 6)
+			order.SrcCount = order.LockedCount
+		}
+		order.Price = order.DesCount / order.SrcCount
+	}
+
+	now := time.Now()
+	order.TriggeredTime = now.Unix()
+	order.TriggeredDate = now.Format("2006-01-02 15:04:05")
+
+	js, _ := json.Marshal(order)
+	immediate := "0"
+	if isImmediate(order) {
+		immediate = "1"
+	}
+	keys := []string{stopKey, order.UUID, getBookKey(order), getImmediateKey(order.SrcCurrency, order.DesCurrency)}
+	result, err := triggerScript.Run(client, keys, order.UUID, string(js), getBookScore(order), order.AmendCount, immediate).Result()
+	if err != nil {
+		return err
+	}
+	if n, _ := result.(int64); n == 0 {
+		return errNotInBook
+	}
+
+	addOrderHistory(order.UUID, EventTriggered, "")
+
+	return nil
+}
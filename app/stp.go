@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+
+	"github.com/spf13/viper"
+)
+
+// 自成交防范模式，撮合时买卖双方为同一账户则按配置处理，不生成成交
+const (
+	STPNone         = "none"         //不防范，允许自成交
+	STPCancelNewest = "cancelNewest" //撤销较新的挂单
+	STPCancelOldest = "cancelOldest" //撤销较早的挂单
+	STPCancelBoth   = "cancelBoth"   //撤销两个挂单
+	STPDecrement    = "decrement"    //两个挂单减去可成交的数量，减完的挂单撤销，冰山单优先减少隐藏数量
+)
+
+// stpMode 配置的自成交防范模式，未配置时撤销较新的挂单
+func stpMode() string {
+	mode := viper.GetString("exchange.stp.mode")
+	if mode == "" {
+		return STPCancelNewest
+	}
+	return mode
+}
+
+// isSelfTrade 两个挂单是否为自成交
+func isSelfTrade(buyOrder, sellOrder *Order) bool {
+	return buyOrder.Account == sellOrder.Account && stpMode() != STPNone
+}
+
+// preventSelfTrade 在撮合前处理自成交的两个挂单，被撤销的挂单由撤单流程解锁余额
+// 返回是否需要继续撮合，即至少处理了一个挂单
+func preventSelfTrade(buyOrder, sellOrder *Order) bool {
+	mode := stpMode()
+	reason := "selfTrade:" + mode
+
+	newest, oldest := buyOrder, sellOrder
+	if getBookTime(buyOrder) < getBookTime(sellOrder) {
+		newest, oldest = sellOrder, buyOrder
+	}
+
+	switch mode {
+	case STPCancelNewest:
+		return cancelOrder(newest, reason) == nil
+	case STPCancelOldest:
+		return cancelOrder(oldest, reason) == nil
+	case STPDecrement:
+		return decrementSelfTrade(buyOrder, sellOrder, reason)
+	default:
+		return cancelSelfTradeBoth(buyOrder, sellOrder, reason)
+	}
+}
+
+func cancelSelfTradeBoth(buyOrder, sellOrder *Order, reason string) bool {
+	err1 := cancelOrder(buyOrder, reason)
+	err2 := cancelOrder(sellOrder, reason)
+	return err1 == nil || err2 == nil
+}
+
+// decrementSelfTrade 两个挂单按可成交数量同价减量并解锁差额，减完的挂单撤销
+// 可成交数量按买单的目标币（即卖单的源币）计；冰山单优先减少隐藏数量，隐藏数量减完时才撤销
+// 挂单不能减量时撤销该挂单
+func decrementSelfTrade(buyOrder, sellOrder *Order, reason string) bool {
+	count := math.Min(buyOrder.DesCount, sellOrder.SrcCount)
+	if count <= 0 {
+		return cancelSelfTradeBoth(buyOrder, sellOrder, reason)
+	}
+
+	orders := []*Order{buyOrder, sellOrder}
+	decrements := []float64{toOrderCount(buyOrder, count, false), toOrderCount(sellOrder, count, true)}
+
+	// 先撤销减完的挂单，以免另一挂单减量后再次与之撮合
+	handled := false
+	for i, v := range orders {
+		if (getTotalCount(v)-decrements[i])*Multiple >= 1 {
+			continue
+		}
+		if err := cancelOrder(v, reason); err != nil {
+			return handled
+		}
+		handled = true
+	}
+
+	for i, v := range orders {
+		if (getTotalCount(v)-decrements[i])*Multiple < 1 {
+			continue
+		}
+		decrementOrder(v, decrements[i], reason)
+		handled = true
+	}
+
+	return handled
+}
+
+// toOrderCount 将源币（isSrc）或目标币数量按挂单价格换算为挂单的数量，卖完为止为源币数量，买完为止为目标币数量
+func toOrderCount(order *Order, count float64, isSrc bool) float64 {
+	if order.IsBuyAll != isSrc {
+		return count
+	}
+	if isSrc {
+		return round(count*order.DesCount/order.SrcCount, 6)
+	}
+	return round(count*order.SrcCount/order.DesCount, 6)
+}
+
+// decrementOrder 挂单同价减少count数量，冰山单由decrementIceberg处理，不能减量时撤销
+func decrementOrder(order *Order, count float64, reason string) {
+	var amend *Amendment
+	var err error
+	if isIceberg(order) {
+		amend, err = decrementIceberg(order.UUID, count)
+	} else {
+		var srcCount, desCount float64
+		if order.IsBuyAll {
+			desCount = round(order.DesCount-count, 6)
+			srcCount = round(desCount*order.SrcCount/order.DesCount, 6)
+		} else {
+			srcCount = round(order.SrcCount-count, 6)
+			desCount = round(srcCount*order.DesCount/order.SrcCount, 6)
+		}
+		amend, err = amendOrder(order.UUID, srcCount, desCount)
+	}
+	if err != nil {
+		myLogger.Warningf("Self-trade decrement of order [%s] failed, cancel it: %s", order.UUID, err)
+		cancelOrder(order, reason)
+		return
+	}
+	addOrderHistory(order.UUID, EventSelfTrade, reason)
+	submitAmendment(amend)
+}
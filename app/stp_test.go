@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestToOrderCount(t *testing.T) {
+	sellAll := &Order{SrcCount: 10, DesCount: 20}
+	buyAll := &Order{SrcCount: 10, DesCount: 20, IsBuyAll: true}
+	tests := []struct {
+		name  string
+		order *Order
+		count float64
+		isSrc bool
+		want  float64
+	}{
+		{"sell all by source", sellAll, 4, true, 4},
+		{"sell all by destination", sellAll, 4, false, 2},
+		{"buy all by destination", buyAll, 4, false, 4},
+		{"buy all by source", buyAll, 4, true, 8},
+		{"rounded", &Order{SrcCount: 3, DesCount: 1}, 1, false, 3},
+		{"rounded fraction", &Order{SrcCount: 1, DesCount: 3}, 1, false, 0.333333},
+	}
+	for _, tt := range tests {
+		if got := toOrderCount(tt.order, tt.count, tt.isSrc); got != tt.want {
+			t.Errorf("%s: toOrderCount() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
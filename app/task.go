@@ -13,6 +13,7 @@ type LockInfo struct {
 	Currency string `json:"currency"`
 	OrderId  string `json:"orderId"`
 	Count    int64  `json:"count"`
+	Terms    *Order `json:"terms,omitempty"` //挂单快照，chaincode保存后用于从账本重建挂单
 }
 
 // lockBalance 锁定挂单余额
@@ -20,9 +21,15 @@ func lockBalance() {
 	batch := viper.GetInt64("redis.batch.pending")
 
 	for {
+		waitKillSwitch("lockBalance")
+
 		// 1.取出待挂单
-		uuids, err := getBathSetMember(PendingOrdersKey, batch)
-		if err != nil || len(uuids) == 0 {
+		uuids, err := readQueue(PendingOrdersKey, batch)
+		if err != nil {
+			waitQueueError(err)
+			continue
+		}
+		if len(uuids) == 0 {
 			continue
 		}
 
@@ -30,21 +37,37 @@ func lockBalance() {
 
 		// 2.调用chaincode锁定相关信息
 		lockInfo := getLockInfo(uuids)
-		lock(lockInfo, true, "lock")
-
-		time.Sleep(5 * time.Second)
+		txid, err := lock(lockInfo, true, "lock")
+		submitBatch("lock", uuids, txid, err)
 	}
 }
 
 // lockSuccess 锁定成功
 func lockSuccess(uuids []string) {
 	for _, uuid := range uuids {
+		// 重复的结果不再处理
+		if ok, _ := isInSet(PendingOrdersKey, uuid); !ok {
+			continue
+		}
+
 		// 1.修改挂单完成时间
 		updateOrderTime(uuid, time.Now().Unix(), 0)
 
 		// 2.将挂单放到买卖队列,并放到账户对应的挂单集合中
 		mvPending2BS(uuid)
+		addOrderHistory(uuid, EventPended, "")
+
+		// 3.止损单挂单时最新成交价可能已达到止损价；锁定后账户的未锁定数量已减少
+		if order, err := getOrder(uuid); err == nil {
+			invalidateBalance(order.Account)
+			if isWaitingTrigger(order) {
+				triggerStopOrders(order.SrcCurrency, order.DesCurrency)
+			}
+		}
 	}
+
+	// 4.chaincode结果确认后ack
+	ackQueue(PendingOrdersKey, uuids...)
 }
 
 // lockFail 锁定失败
@@ -54,61 +77,116 @@ func lockFail(fails []FailInfo) {
 		saveOrderMetadata(v.Id, v.Info)
 		// 2.将之从待挂单队列移动到挂单失败队列
 		mvPending2Failed(v.Id)
+		addOrderHistory(v.Id, EventPendFail, v.Info)
+		// 3.chaincode结果确认后ack
+		ackQueue(PendingOrdersKey, v.Id)
 	}
 }
 
 // matchTx 撮合交易
 func matchTx() {
 	for {
-		// 买卖队列所有key
-		keys, _ := getKeys(ExchangeKey + "*")
+		waitKillSwitch("matchTx")
+
+		// 已登记的交易对
+		pairs, _ := getPairs()
 		keyMap := make(map[string]string, 0)
 
-		for _, key := range keys {
+		for _, pair := range pairs {
+			key := getBSKey(pair.SrcCurrency, pair.DesCurrency)
 			if _, ok := keyMap[key]; ok {
 				continue
 			}
-
-			// 1.取买卖队列中的第一个挂单
-			buyUUID, err := getFirstZSet(key)
-			if err != nil || len(buyUUID) == 0 {
+			opposite := getBSKey(pair.DesCurrency, pair.SrcCurrency)
+
+			// 熔断暂停期间不撮合，即时成交的挂单无法成交，撤销剩余部分
+			if marketHalted(pair.SrcCurrency, pair.DesCurrency) {
+				keyMap[key] = key
+				keyMap[opposite] = opposite
+				cancelImmediateOrders(pair.SrcCurrency, pair.DesCurrency)
+				cancelImmediateOrders(pair.DesCurrency, pair.SrcCurrency)
 				continue
 			}
-			// 2.校验挂单是否过期
-			buyOrder, isExpired := checkExpired(buyUUID)
-			if isExpired {
-				continue
+
+			// 即时成交（IOC/FOK）的挂单在本轮连续撮合，直到全部成交或无法继续成交
+			for matchFirst(key, opposite, keyMap) {
 			}
+			// 本轮撮合结束后仍在买卖队列中的即时成交挂单无法继续成交，撤销剩余部分
+			cancelImmediateOrders(pair.SrcCurrency, pair.DesCurrency)
+			cancelImmediateOrders(pair.DesCurrency, pair.SrcCurrency)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
 
-			keyMap[key] = key
-			key = getBSKeyByOne(key)
-			keyMap[key] = key
+// matchFirst 撮合买卖队列与对应队列中的第一个挂单
+// 返回是否需要继续撮合，即时成交的挂单撮合后仍有剩余时需要继续
+func matchFirst(key, opposite string, keyMap map[string]string) bool {
+	// 1.取买卖队列中的第一个挂单
+	buyUUID, err := getFirstZSet(key)
+	if err != nil || len(buyUUID) == 0 {
+		return false
+	}
+	// 2.校验挂单是否过期，过期挂单已移出买卖队列时继续撮合后面的挂单
+	buyOrder, isExpired := checkExpired(buyUUID)
+	if isExpired {
+		return !isInZSet(key, buyUUID)
+	}
 
-			// 3.取买卖出队列中对应的第一个挂单
-			sellUUID, err := getFirstZSet(key)
-			if err != nil || len(sellUUID) == 0 {
-				continue
-			}
-			// 4.校验是否过期
-			sellOrder, isExpired := checkExpired(sellUUID)
-			if isExpired {
-				continue
-			}
+	keyMap[key] = key
+	key = opposite
+	keyMap[key] = key
 
-			// myLogger.Debugf("%s 的卖出价：%f/%f=%.6f %s", buyOrder.SrcCurrency, buyOrder.DesCount, buyOrder.SrcCount, buyOrder.DesCount/buyOrder.SrcCount, buyOrder.DesCurrency)
-			// myLogger.Debugf("%s 的买入价：%f/%f=%.6f %s", sellOrder.DesCurrency, sellOrder.SrcCount, sellOrder.DesCount, sellOrder.SrcCount/sellOrder.DesCount, sellOrder.SrcCurrency)
-			// 5.比较价格，进行撮合
-			if buyOrder.DesCount/buyOrder.SrcCount > sellOrder.SrcCount/sellOrder.DesCount {
-				continue
-			}
+	// 3.取买卖出队列中对应的第一个挂单
+	sellUUID, err := getFirstZSet(key)
+	if err != nil || len(sellUUID) == 0 {
+		// 对手盘为空，即时成交的挂单剩余部分撤销
+		cancelImmediateRemainder(buyOrder)
+		return false
+	}
+	// 4.校验是否过期
+	sellOrder, isExpired := checkExpired(sellUUID)
+	if isExpired {
+		return !isInZSet(key, sellUUID)
+	}
 
-			// myLogger.Debugf("匹配成功，买入挂单：%s, 卖出挂单：%s", buyUUID, sellUUID)
+	// FOK挂单作为主动方一次性与对手盘成交，不能全部成交则整单撤销
+	if buyOrder.TimeInForce == TimeInForceFOK {
+		return fillOrKill(buyOrder)
+	}
+	if sellOrder.TimeInForce == TimeInForceFOK {
+		return fillOrKill(sellOrder)
+	}
 
-			// 6.撮合成功，处理买卖挂单
-			dealMatchOrder(buyOrder, sellOrder, time.Now().Unix())
-		}
-		time.Sleep(5 * time.Second)
+	// myLogger.Debugf("%s 的卖出价：%f/%f=%.6f %s", buyOrder.SrcCurrency, buyOrder.DesCount, buyOrder.SrcCount, buyOrder.DesCount/buyOrder.SrcCount, buyOrder.DesCurrency)
+	// myLogger.Debugf("%s 的买入价：%f/%f=%.6f %s", sellOrder.DesCurrency, sellOrder.SrcCount, sellOrder.DesCount, sellOrder.SrcCount/sellOrder.DesCount, sellOrder.SrcCurrency)
+	// 5.比较价格，进行撮合
+	if buyOrder.DesCount/buyOrder.SrcCount > sellOrder.SrcCount/sellOrder.DesCount {
+		// 价格无法成交，即时成交的挂单剩余部分撤销
+		cancelImmediateRemainder(buyOrder)
+		cancelImmediateRemainder(sellOrder)
+		return false
+	}
+
+	// 6.买卖双方为同一账户时按自成交防范模式处理，不生成成交
+	if isSelfTrade(buyOrder, sellOrder) {
+		return preventSelfTrade(buyOrder, sellOrder)
+	}
+
+	// 7.成交价变动超过熔断限制时暂停撮合，本次不成交
+	if checkCircuitBreaker(buyOrder.SrcCurrency, buyOrder.DesCurrency, getMatchPrice(buyOrder, sellOrder)) {
+		return false
+	}
+
+	// myLogger.Debugf("匹配成功，买入挂单：%s, 卖出挂单：%s", buyUUID, sellUUID)
+
+	// 8.撮合成功，处理买卖挂单
+	err = dealMatchOrder(buyOrder, sellOrder, time.Now().Unix())
+	if err != nil {
+		return false
 	}
+
+	return isImmediateLeft(buyOrder) || isImmediateLeft(sellOrder)
 }
 
 type ExchangeOrder struct {
@@ -121,9 +199,15 @@ func execTx() {
 	batch := viper.GetInt64("redis.batch.matched")
 
 	for {
+		waitKillSwitch("execTx")
+
 		// 1.取出撮合好的一对交易
-		uuids, err := getBathSetMember(MatchedOrdersKey, batch)
-		if err != nil || len(uuids) == 0 {
+		uuids, err := readQueue(MatchedOrdersKey, batch)
+		if err != nil {
+			waitQueueError(err)
+			continue
+		}
+		if len(uuids) == 0 {
 			continue
 		}
 
@@ -159,6 +243,8 @@ func execTx() {
 				RawUUID:      buyOrder.RawUUID,
 				Metadata:     buyOrder.Metadata,
 				FinalCost:    int64(buyOrder.FinalCost * Multiple),
+				Type:         buyOrder.Type,
+				Price:        int64(buyOrder.Price * Multiple),
 			}
 
 			sellOrderInt := &OrderInt{
@@ -177,36 +263,57 @@ func execTx() {
 				RawUUID:      sellOrder.RawUUID,
 				Metadata:     sellOrder.Metadata,
 				FinalCost:    int64(sellOrder.FinalCost * Multiple),
+				Type:         sellOrder.Type,
+				Price:        int64(sellOrder.Price * Multiple),
 			}
 			exchangeOrder := &ExchangeOrder{BuyOrder: buyOrderInt, SellOrder: sellOrderInt}
 			exchanges = append(exchanges, exchangeOrder)
 		}
 		exchangeStr, _ := json.Marshal(&exchanges)
 
-		exchange(string(exchangeStr))
-
-		time.Sleep(5 * time.Second)
+		txid, err := exchange(string(exchangeStr))
+		submitBatch("exchange", uuids, txid, err)
 	}
 }
 
 // execTxSuccess 执行交易成功
 func execTxSuccess(uuids []string) {
 	for _, v := range uuids {
-		// 1.从撮合好队列移动到交易成功队列，并修改交易完成时间
+		// 重复的结果不再处理
+		if ok, _ := isInSet(MatchedOrdersKey, v); !ok {
+			continue
+		}
+
+		// 1.从撮合好队列移动到交易成功队列，修改交易完成时间并保存成交记录
 		mvExec2Success(MatchedOrdersKey, v)
+		ackQueue(MatchedOrdersKey, v)
+		recordTrade(v)
+
+		// 2.更新交易对最新成交价，并触发两个方向达到止损价的止损单
+		order, err := updateLastPrice(v)
+		if err != nil {
+			continue
+		}
+		triggerStopOrders(order.SrcCurrency, order.DesCurrency)
+		triggerStopOrders(order.DesCurrency, order.SrcCurrency)
 	}
 }
 
 // execTxFail 执行交易失败
+// 临时错误按退避时间重试，其他移入死信
 func execTxFail(fails []FailInfo) {
-	// 暂无处理
+	retryFails(MatchedOrdersKey, fails)
 }
 
 // dealExpired 处理过期挂单
 func dealExpired(uuids ...string) {
 	for _, uuid := range uuids {
-		// 1.从买卖队列移到过期队列中
-		mvBS2Expired(uuid)
+		// 1.从买卖队列移到过期队列中，已不在买卖队列中的不再处理
+		if err := mvBS2Expired(uuid); err != nil {
+			continue
+		}
+		saveOrderReason(uuid, ExpireReasonGTD)
+		addOrderHistory(uuid, EventExpire, ExpireReasonGTD)
 	}
 }
 
@@ -215,9 +322,15 @@ func execExpired(uuid ...string) {
 	batch := viper.GetInt64("redis.batch.expired")
 
 	for {
+		waitKillSwitch("execExpired")
+
 		// 1.从过期队列中取出一个
-		uuids, err := getBathSetMember(ExpiredOrdersKey, batch)
-		if err != nil || len(uuids) == 0 {
+		uuids, err := readQueue(ExpiredOrdersKey, batch)
+		if err != nil {
+			waitQueueError(err)
+			continue
+		}
+		if len(uuids) == 0 {
 			continue
 		}
 
@@ -225,9 +338,8 @@ func execExpired(uuid ...string) {
 
 		// 2.chaincode处理过期交易
 		lockInfo := getLockInfo(uuids)
-		lock(lockInfo, false, "expire")
-
-		time.Sleep(5 * time.Second)
+		txid, err := lock(lockInfo, false, "expire")
+		submitBatch("expire", uuids, txid, err)
 	}
 }
 
@@ -240,26 +352,15 @@ func expiredSuccess(uuids []string) {
 	// 1.从过期队列移到过期成功队列
 	for _, v := range uuids {
 		mvExpired2Success(v)
+		addOrderHistory(v, EventExpired, "")
 	}
+	ackQueue(ExpiredOrdersKey, uuids...)
 }
 
 // expiredFail 处理过期挂单失败
+// 临时错误按退避时间重试，其他移入死信
 func expiredFail(fails []FailInfo) {
-	//暂无处理
-}
-
-// findExpired 定时任务查找过期挂单
-func findExpired() {
-
-	for {
-		// 取出买卖队列中所有挂单进行判断
-		uuidsBuy, _ := getAllBS()
-		for _, v := range uuidsBuy {
-			checkExpired(v)
-		}
-
-		time.Sleep(time.Second * 5)
-	}
+	retryFails(ExpiredOrdersKey, fails)
 }
 
 // checkExpired 校验过期
@@ -270,6 +371,10 @@ func checkExpired(uuid string) (*Order, bool) {
 	}
 
 	if order.ExpiredTime > 0 && order.ExpiredTime <= time.Now().Unix() {
+		// 改单差额未处理完时暂不处理过期，否则会重复解锁
+		if order.Amending != "" {
+			return nil, true
+		}
 		dealExpired(uuid)
 		// myLogger.Debugf("挂单 %s 已过期", uuid)
 
@@ -283,9 +388,15 @@ func execCancel() {
 	batch := viper.GetInt64("redis.batch.cancel")
 
 	for {
+		waitKillSwitch("execCancel")
+
 		// 1.从撤单队列中取出一个
-		uuids, err := getBathSetMember(CancelingOrderKey, batch)
-		if err != nil || len(uuids) == 0 {
+		uuids, err := readQueue(CancelingOrderKey, batch)
+		if err != nil {
+			waitQueueError(err)
+			continue
+		}
+		if len(uuids) == 0 {
 			continue
 		}
 
@@ -293,9 +404,8 @@ func execCancel() {
 
 		// 2.chaincode处理撤销交易
 		lockInfo := getLockInfo(uuids)
-		lock(lockInfo, false, "cancel")
-
-		time.Sleep(time.Second * 5)
+		txid, err := lock(lockInfo, false, "cancel")
+		submitBatch("cancel", uuids, txid, err)
 	}
 }
 
@@ -304,19 +414,40 @@ func cancelSuccess(uuids []string) {
 	// 1.从待撤单队列移到撤单成功队列
 	for _, v := range uuids {
 		mvCancle2Success(v)
+		addOrderHistory(v, EventCanceled, "")
 	}
+	pushCancelBatches(uuids...)
+	ackQueue(CancelingOrderKey, uuids...)
 }
 
 // cancelFailed 撤单失败
 func cancelFailed(fails []FailInfo) {
 	for _, v := range fails {
+		// 重复的结果不再处理
+		if ok, _ := isInSet(CancelingOrderKey, v.Id); !ok {
+			continue
+		}
+
 		// 1.保存失败信息
 		saveOrderMetadata(v.Id, v.Info)
 		// 2.将挂单放回买卖队列，并保存撤单失败信息
 		mvCancel2BS(v.Id)
+		addOrderHistory(v.Id, EventCancelFail, v.Info)
+		ackQueue(CancelingOrderKey, v.Id)
+		pushCancelBatches(v.Id)
+	}
+}
+
+// getRemainingLock 挂单剩余的锁定数量
+func getRemainingLock(order *Order) int64 {
+	if order.LockedCount > 0 {
+		// 部分成交后剩余的挂单，结余为锁定数量减去已撮合子单的消耗
+		return int64(order.LockedCount*Multiple) - int64(order.FilledCost*Multiple)
 	}
+	return int64(order.SrcCount * Multiple)
 }
 
+// getLockInfo 挂单锁定或解锁的数量，同时传入挂单快照
 func getLockInfo(uuids []string) string {
 	locks := []*LockInfo{}
 	for _, v := range uuids {
@@ -328,7 +459,8 @@ func getLockInfo(uuids []string) string {
 			Owner:    order.Account,
 			Currency: order.SrcCurrency,
 			OrderId:  order.UUID,
-			Count:    int64(order.SrcCount * Multiple),
+			Count:    getRemainingLock(order),
+			Terms:    getTermsSnapshot(order),
 		}
 
 		locks = append(locks, &lockinfo)
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestGetRemainingLock(t *testing.T) {
+	tests := []struct {
+		name  string
+		order Order
+		want  int64
+	}{
+		{"not locked", Order{SrcCount: 1.5}, 1500000},
+		{"locked", Order{SrcCount: 1.5, LockedCount: 2}, 2000000},
+		{"partly filled", Order{SrcCount: 0.5, LockedCount: 2, FilledCost: 1.25}, 750000},
+		{"filled", Order{LockedCount: 2, FilledCost: 2}, 0},
+	}
+	for _, tt := range tests {
+		if got := getRemainingLock(&tt.order); got != tt.want {
+			t.Errorf("%s: getRemainingLock() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
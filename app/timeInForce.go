@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/redis.v5"
+)
+
+const (
+	TimeInForceGTC = "GTC" //一直有效，直到成交或撤单
+	TimeInForceIOC = "IOC" //立即成交，剩余部分撤销
+	TimeInForceFOK = "FOK" //全部成交，否则整单撤销
+	TimeInForceGTD = "GTD" //有效至ExpiredTime，过期自动撤销
+
+	CancelReasonUser  = "user"  //用户撤单
+	CancelReasonIOC   = "IOC"   //IOC挂单未成交部分
+	CancelReasonFOK   = "FOK"   //FOK挂单无法全部成交
+	CancelReasonAdmin = "admin" //管理员批量撤单
+	ExpireReasonGTD   = "GTD"   //GTD挂单到期
+)
+
+// prepareTimeInForce 校验并补全挂单的有效期类型
+// 未指定时：市价单为IOC，指定了ExpiredTime为GTD，否则为GTC
+func prepareTimeInForce(order *Order) error {
+	if order.TimeInForce == "" {
+		if order.Type == OrderTypeMarket || order.Type == OrderTypeStop {
+			order.TimeInForce = TimeInForceIOC
+		} else if order.ExpiredTime > 0 {
+			order.TimeInForce = TimeInForceGTD
+		} else {
+			order.TimeInForce = TimeInForceGTC
+		}
+	}
+
+	switch order.TimeInForce {
+	case TimeInForceGTC, TimeInForceIOC, TimeInForceFOK:
+		if (order.Type == OrderTypeMarket || order.Type == OrderTypeStop) && order.TimeInForce == TimeInForceGTC {
+			return errors.New("Market order must be IOC or FOK.")
+		}
+		// 指定了过期时间却不是GTD时拒绝，以免按客户端未要求的有效期挂单
+		if order.ExpiredTime != 0 {
+			return errors.New("ExpiredTime is only valid with GTD.")
+		}
+		order.ExpiredDate = ""
+	case TimeInForceGTD:
+		if order.Type == OrderTypeMarket || order.Type == OrderTypeStop {
+			return errors.New("Market order must be IOC or FOK.")
+		}
+		if order.ExpiredTime <= time.Now().Unix() {
+			return errors.New("ExpiredTime must be later than now.")
+		}
+		order.ExpiredDate = time.Unix(order.ExpiredTime, 0).Format("2006-01-02 15:04:05")
+	default:
+		return errors.New("TimeInForce must be GTC, IOC, FOK or GTD.")
+	}
+
+	return nil
+}
+
+// isImmediate 是否为即时成交的挂单
+func isImmediate(order *Order) bool {
+	return order != nil && (order.TimeInForce == TimeInForceIOC || order.TimeInForce == TimeInForceFOK)
+}
+
+// isImmediateLeft 即时成交的挂单是否还有剩余在买卖队列中
+func isImmediateLeft(order *Order) bool {
+	return isImmediate(order) && isInZSet(getBSKey(order.SrcCurrency, order.DesCurrency), order.UUID)
+}
+
+// cancelImmediateRemainder 即时成交的挂单无法继续成交时撤销剩余部分，由撤单流程解锁结余
+func cancelImmediateRemainder(order *Order) error {
+	if !isImmediate(order) {
+		return nil
+	}
+
+	reason := CancelReasonIOC
+	if order.TimeInForce == TimeInForceFOK {
+		reason = CancelReasonFOK
+	}
+	return cancelOrder(order, reason)
+}
+
+// fillOrKillAttempts FOK挂单撮合期间对手盘有变化时的重试次数
+const fillOrKillAttempts = 3
+
+var (
+	errCannotFill = errors.New("FOK order can't be filled.")
+	errSelfTrade  = errors.New("FOK order reached an order of the same account.")
+)
+
+// fillOrKill FOK挂单作为主动方与对手盘一次性成交，不能全部成交则整单撤销
+// 返回是否需要继续撮合
+func fillOrKill(order *Order) bool {
+	for i := 0; i < fillOrKillAttempts; i++ {
+		matches, resting, err := dealFillOrKill(order)
+		if err == nil {
+			for _, v := range matches {
+				addMatchHistory(v)
+			}
+			return true
+		}
+		if err == errCannotFill {
+			break
+		}
+		// 已不在买卖队列中（已撤单）
+		if err == errNotInBook || err == redis.Nil {
+			return true
+		}
+		// 熔断暂停撮合，剩余部分由撮合任务按即时成交挂单撤销
+		if err == errMarketHalted {
+			return false
+		}
+		if err != redis.TxFailedErr && err != errSelfTrade {
+			myLogger.Errorf("Failed matching FOK order [%s]: %s", order.UUID, err)
+			return false
+		}
+
+		// 挂单或对手盘在此期间有变化，重新读取
+		current, err := getOrder(order.UUID)
+		if err != nil || !isInZSet(getBSKey(order.SrcCurrency, order.DesCurrency), order.UUID) {
+			return true
+		}
+		order = current
+
+		// 扫到同账户的挂单时按自成交防范模式处理，处理后由撮合任务继续撮合
+		if resting != nil {
+			return preventSelfTrade(order, resting)
+		}
+	}
+
+	cancelOrder(order, CancelReasonFOK)
+	return true
+}
+
+// dealFillOrKill 按价格优先依次与对手盘撮合，全部成交时所有撮合在一个事务中写入，否则不写入
+// 挂单、买卖队列和读取的对手盘都被WATCH，事务期间有变化时返回TxFailedErr；过期的挂单不计入对手盘
+// 扫到同账户的挂单时不写入，返回该挂单和errSelfTrade
+func dealFillOrKill(order *Order) ([]*orderMatch, *Order, error) {
+	bsKey := getBSKey(order.SrcCurrency, order.DesCurrency)
+	opposite := getBSKey(order.DesCurrency, order.SrcCurrency)
+	depth := viper.GetInt64("exchange.market.depth")
+
+	var matches []*orderMatch
+	var resting *Order
+	err := client.Watch(func(tx *redis.Tx) error {
+		js, err := tx.Get(order.UUID).Result()
+		if err != nil {
+			return err
+		}
+		var taker Order
+		if err := json.Unmarshal([]byte(js), &taker); err != nil {
+			return err
+		}
+		if tx.ZScore(bsKey, taker.UUID).Err() != nil {
+			return errNotInBook
+		}
+
+		uuids, err := tx.ZRange(opposite, 0, depth-1).Result()
+		if err != nil {
+			return err
+		}
+		if len(uuids) == 0 {
+			return errCannotFill
+		}
+		if err := tx.Watch(uuids...).Err(); err != nil {
+			return err
+		}
+		values, err := tx.MGet(uuids...).Result()
+		if err != nil {
+			return err
+		}
+
+		pipe := tx.Pipeline()
+		timeStamp := time.Now().Unix()
+		matches = []*orderMatch{}
+		for _, value := range values {
+			js, ok := value.(string)
+			if !ok {
+				continue
+			}
+			v := &Order{}
+			if json.Unmarshal([]byte(js), v) != nil {
+				continue
+			}
+			if v.ExpiredTime > 0 && v.ExpiredTime <= timeStamp {
+				continue
+			}
+			if taker.DesCount/taker.SrcCount > v.SrcCount/v.DesCount {
+				break
+			}
+			if isSelfTrade(&taker, v) {
+				pipe.Close()
+				resting = v
+				return errSelfTrade
+			}
+			if checkCircuitBreaker(taker.SrcCurrency, taker.DesCurrency, getMatchPrice(&taker, v)) {
+				pipe.Close()
+				return errMarketHalted
+			}
+			matches = append(matches, queueMatchOrder(pipe, &taker, v, timeStamp))
+			// 主动方全部成交时才写入
+			if taker.MatchedTime == timeStamp {
+				_, err := pipe.Exec()
+				return err
+			}
+		}
+		pipe.Close()
+		return errCannotFill
+	}, order.UUID, bsKey, opposite)
+
+	return matches, resting, err
+}
+
+func getImmediateKey(srcCurrency, desCurrency string) string {
+	return ImmediateOrdersKey + "_" + getPairID(srcCurrency, desCurrency)
+}
+
+// trackImmediate 即时成交的挂单进入买卖队列时加入集合，撮合结束后撤销剩余部分，需与加入买卖队列同时执行
+func trackImmediate(pipe *redis.Pipeline, order *Order) {
+	if isImmediate(order) && !isWaitingTrigger(order) {
+		pipe.SAdd(getImmediateKey(order.SrcCurrency, order.DesCurrency), order.UUID)
+	}
+}
+
+// cancelImmediateOrders 撤销买卖队列中未能全部成交的即时成交挂单的剩余部分
+// 已不在买卖队列中的（全部成交或已撤销）从集合中移除
+func cancelImmediateOrders(srcCurrency, desCurrency string) {
+	key := getImmediateKey(srcCurrency, desCurrency)
+	uuids, err := getAllSetMember(key)
+	if err != nil {
+		return
+	}
+
+	bsKey := getBSKey(srcCurrency, desCurrency)
+	for _, v := range uuids {
+		if isInZSet(bsKey, v) {
+			// 撤单失败（如改单未完成）时留在集合中，下一轮再撤
+			if order, err := getOrder(v); err == nil && cancelImmediateRemainder(order) != nil {
+				continue
+			}
+		}
+		client.SRem(key, v)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"math"
 	"strconv"
 	"strings"
@@ -59,13 +60,27 @@ func convertPriceReciprocal(num int64) float64 {
 }
 
 func getBSKey(srcCurrency, desCurrency string) string {
-	return ExchangeKey + "_" + srcCurrency + "_" + desCurrency
+	return ExchangeKey + "_" + getPairID(srcCurrency, desCurrency)
 }
 
-func getBSKeyByOne(key string) string {
-	splits := strings.Split(key, "_")
+var (
+	keyPartEscaper   = strings.NewReplacer("%", "%25", "_", "%5F")
+	keyPartUnescaper = strings.NewReplacer("%5F", "_", "%25", "%")
+)
+
+// getPairID 交易对ID “源币种_目标币种”，币种代码中的“%”和“_”转义，任意币种代码都能还原
+func getPairID(srcCurrency, desCurrency string) string {
+	return keyPartEscaper.Replace(srcCurrency) + "_" + keyPartEscaper.Replace(desCurrency)
+}
+
+// parsePairID 由交易对ID还原源币种和目标币种
+func parsePairID(id string) (string, string, error) {
+	splits := strings.Split(id, "_")
+	if len(splits) != 2 {
+		return "", "", fmt.Errorf("Invalid pair [%s]", id)
+	}
 
-	return getBSKey(splits[2], splits[1])
+	return keyPartUnescaper.Replace(splits[0]), keyPartUnescaper.Replace(splits[1]), nil
 }
 
 // round 四舍五入
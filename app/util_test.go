@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestPairID(t *testing.T) {
+	tests := []struct {
+		src, des string
+		id       string
+	}{
+		{"BTC", "USD", "BTC_USD"},
+		{"BTC_OLD", "USD", "BTC%5FOLD_USD"},
+		{"USD", "A_B_C", "USD_A%5FB%5FC"},
+		{"A%5F", "B", "A%255F_B"},
+		{"100%", "_", "100%25_%5F"},
+		{"", "", "_"},
+	}
+	for _, tt := range tests {
+		id := getPairID(tt.src, tt.des)
+		if id != tt.id {
+			t.Errorf("getPairID(%q, %q) = %q, want %q", tt.src, tt.des, id, tt.id)
+		}
+		src, des, err := parsePairID(id)
+		if err != nil || src != tt.src || des != tt.des {
+			t.Errorf("parsePairID(%q) = %q, %q, %v, want %q, %q", id, src, des, err, tt.src, tt.des)
+		}
+	}
+}
+
+func TestParsePairIDInvalid(t *testing.T) {
+	for _, id := range []string{"", "BTC", "BTC_USD_EUR"} {
+		if _, _, err := parsePairID(id); err == nil {
+			t.Errorf("parsePairID(%q) succeeded, want error", id)
+		}
+	}
+}
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		val    float64
+		places int
+		want   float64
+	}{
+		{1.2345674, 6, 1.234567},
+		{1.2345675, 6, 1.234568},
+		{-1.2345675, 6, -1.234568},
+		{0.1 + 0.2, 6, 0.3},
+		{2.5, 0, 3},
+		{-2.5, 0, -3},
+		{0, 6, 0},
+	}
+	for _, tt := range tests {
+		if got := round(tt.val, tt.places); got != tt.want {
+			t.Errorf("round(%v, %d) = %v, want %v", tt.val, tt.places, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/gorilla/websocket"
+	"github.com/spf13/viper"
+)
+
+// WebSocket连接：客户端发送 {"op":"subscribe","channels":[...]} 或 {"op":"unsubscribe","channels":[...]}
+// 订阅成功返回频道快照，之后转发频道消息；发送缓冲区满的慢连接直接断开，客户端重连后重新订阅
+
+// 客户端操作
+const (
+	PushOpSubscribe   = "subscribe"
+	PushOpUnsubscribe = "unsubscribe"
+)
+
+const (
+	pushWriteWait = 10 * time.Second //写消息超时
+	pushReadLimit = 4096             //客户端消息的最大长度
+)
+
+// PushRequest 客户端请求
+type PushRequest struct {
+	Op       string   `json:"op"`
+	Channels []string `json:"channels"`
+}
+
+// PushReply 请求的结果，订阅成功返回快照，不返回PushReply
+type PushReply struct {
+	Op      string `json:"op"`
+	Channel string `json:"channel"`
+	Err     string `json:"error,omitempty"`
+}
+
+// pushConn WebSocket连接，account为空表示未登录
+type pushConn struct {
+	ws       *websocket.Conn
+	account  string
+	send     chan []byte
+	closing  sync.Once
+	channels map[string]bool //已订阅的频道，只在读消息的goroutine中访问
+
+	sync.Mutex
+	pending map[string][]*pushPending //正在取快照的频道暂存的消息，快照发送后再发送
+}
+
+// pushPending 暂存的频道消息
+type pushPending struct {
+	seq     int64
+	payload []byte
+}
+
+// pushHub 本实例的连接按频道（私有频道按账户）索引
+type pushHub struct {
+	sync.RWMutex
+	conns map[string]map[*pushConn]bool
+}
+
+var hub = &pushHub{conns: make(map[string]map[*pushConn]bool)}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkPushOrigin,
+}
+
+// checkPushOrigin 未配置允许的来源时只允许同源，私有频道使用cookie登录，不能允许任意来源
+func checkPushOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, v := range viper.GetStringSlice("app.websocket.origins") {
+		if v == "*" || v == origin {
+			return true
+		}
+	}
+	return strings.HasSuffix(origin, "://"+req.Host)
+}
+
+func (h *pushHub) add(key string, c *pushConn) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.conns[key] == nil {
+		h.conns[key] = make(map[*pushConn]bool)
+	}
+	h.conns[key][c] = true
+}
+
+func (h *pushHub) remove(key string, c *pushConn) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.conns[key], c)
+	if len(h.conns[key]) == 0 {
+		delete(h.conns, key)
+	}
+}
+
+// dispatch 转发redis发布的消息给订阅的连接
+func (h *pushHub) dispatch(payload string) {
+	var msg PushMessage
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		return
+	}
+
+	key := getPushSeqField(msg.Channel, msg.Account)
+	h.RLock()
+	defer h.RUnlock()
+	for c := range h.conns[key] {
+		c.deliver(key, msg.Seq, payload)
+	}
+}
+
+// pushListener 订阅redis的推送消息，每个app实例运行一个
+func pushListener() {
+	for {
+		pubsub, err := client.Subscribe(PushChannel)
+		if err != nil {
+			myLogger.Errorf("Failed subscribing push channel: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for {
+			msg, err := pubsub.ReceiveMessage()
+			if err != nil {
+				myLogger.Errorf("Failed receiving push message: %s", err)
+				break
+			}
+			hub.dispatch(msg.Payload)
+		}
+		pubsub.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+// deliver 发送频道消息，频道正在取快照时先暂存
+func (c *pushConn) deliver(key string, seq int64, payload string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if pending, ok := c.pending[key]; ok {
+		c.pending[key] = append(pending, &pushPending{seq: seq, payload: []byte(payload)})
+		return
+	}
+	c.write([]byte(payload))
+}
+
+// write 消息放入发送缓冲区，缓冲区满时断开连接
+func (c *pushConn) write(msg []byte) {
+	select {
+	case c.send <- msg:
+	default:
+		c.close()
+	}
+}
+
+func (c *pushConn) close() {
+	c.closing.Do(func() {
+		c.ws.Close()
+	})
+}
+
+// writeLoop 发送消息并定时ping，连接关闭时退出
+func (c *pushConn) writeLoop(done chan struct{}) {
+	ticker := time.NewTicker(time.Duration(viper.GetInt64("app.websocket.pingInterval")) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-c.send:
+			c.ws.SetWriteDeadline(time.Now().Add(pushWriteWait))
+			if err := c.ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			c.ws.SetWriteDeadline(time.Now().Add(pushWriteWait))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// readLoop 处理客户端的订阅请求，连接关闭时退订所有频道
+func (c *pushConn) readLoop() {
+	pongWait := 2 * time.Duration(viper.GetInt64("app.websocket.pingInterval")) * time.Second
+	c.ws.SetReadLimit(pushReadLimit)
+	c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		var req PushRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			c.reply(&PushReply{Err: "Request must be a JSON object."})
+			continue
+		}
+
+		for _, v := range req.Channels {
+			switch req.Op {
+			case PushOpSubscribe:
+				c.subscribe(v)
+			case PushOpUnsubscribe:
+				c.unsubscribe(v)
+				c.reply(&PushReply{Op: req.Op, Channel: v})
+			default:
+				c.reply(&PushReply{Op: req.Op, Channel: v, Err: "Unknown op."})
+			}
+		}
+	}
+
+	for v := range c.channels {
+		c.unsubscribe(v)
+	}
+}
+
+func (c *pushConn) reply(reply *PushReply) {
+	js, _ := json.Marshal(reply)
+	c.write(js)
+}
+
+// getPushKey 频道在hub中的索引，私有频道按账户区分
+func (c *pushConn) getPushKey(channel string) (string, error) {
+	if privateChannels[channel] {
+		if c.account == "" {
+			return "", errors.New("not login")
+		}
+		return getPushSeqField(channel, c.account), nil
+	}
+
+	i := strings.Index(channel, ".")
+	if i < 0 {
+		return "", errors.New("Unknown channel.")
+	}
+	switch channel[:i] {
+	case ChannelDepth, ChannelTrades, ChannelTicker:
+	default:
+		return "", errors.New("Unknown channel.")
+	}
+	if _, _, err := parsePairID(channel[i+1:]); err != nil {
+		return "", err
+	}
+	return channel, nil
+}
+
+// subscribe 先加入hub再取快照，取快照期间的消息暂存，快照之后只发送序号更大的消息
+func (c *pushConn) subscribe(channel string) {
+	key, err := c.getPushKey(channel)
+	if err != nil {
+		c.reply(&PushReply{Op: PushOpSubscribe, Channel: channel, Err: err.Error()})
+		return
+	}
+	if c.channels[channel] {
+		return
+	}
+	c.channels[channel] = true
+	c.Lock()
+	c.pending[key] = []*pushPending{}
+	c.Unlock()
+	hub.add(key, c)
+
+	account := ""
+	if privateChannels[channel] {
+		account = c.account
+	}
+	snapshot, err := getPushSnapshot(channel, account)
+
+	if err != nil {
+		hub.remove(key, c)
+		delete(c.channels, channel)
+	}
+
+	// hub转发时先锁hub再锁连接，这里不能在锁连接时操作hub
+	c.Lock()
+	defer c.Unlock()
+	pending := c.pending[key]
+	delete(c.pending, key)
+	if err != nil {
+		c.reply(&PushReply{Op: PushOpSubscribe, Channel: channel, Err: err.Error()})
+		return
+	}
+	js, _ := json.Marshal(snapshot)
+	c.write(js)
+	for _, v := range pending {
+		if v.seq > snapshot.Seq {
+			c.write(v.payload)
+		}
+	}
+}
+
+func (c *pushConn) unsubscribe(channel string) {
+	if !c.channels[channel] {
+		return
+	}
+	key, _ := c.getPushKey(channel)
+	hub.remove(key, c)
+	delete(c.channels, channel)
+}
+
+// Push WebSocket推送，公共频道不需要登录，私有频道推送登录账户的消息，使用API Key时需要read权限
+func (a *AppREST) Push(rw web.ResponseWriter, req *web.Request) {
+	myLogger.Info("REST processing push request...")
+
+	// 握手失败时Upgrade已返回错误响应
+	ws, err := upgrader.Upgrade(rw, req.Request, nil)
+	if err != nil {
+		return
+	}
+
+	// 没有read权限的API Key只能订阅公共频道
+	account := a.Account
+	if a.APIKey != nil && !a.APIKey.hasScope(ScopeRead) {
+		account = ""
+	}
+
+	c := &pushConn{
+		ws:       ws,
+		account:  account,
+		send:     make(chan []byte, viper.GetInt("app.websocket.sendBuffer")),
+		channels: make(map[string]bool),
+		pending:  make(map[string][]*pushPending),
+	}
+	done := make(chan struct{})
+	go c.writeLoop(done)
+	c.readLoop()
+	close(done)
+	c.close()
+}
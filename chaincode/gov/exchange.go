@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -45,10 +46,17 @@ const (
 	TableAssetLockLog       = "AssetLockLog"
 	TableTxLog              = "TxLog"
 	TableTxLog2             = "TxLog2"
+	TableOrderTerms         = "OrderTerms"
 	CNY                     = "CNY"
 	USD                     = "USD"
 	CheckErr                = ErrType("CheckErr")
 	WorldStateErr           = ErrType("WdErr")
+	PriceMultiple           = 1000000     //价格放大倍数，与币数量一致保留六位小数
+	TermsPended             = "pended"    //挂单已锁定
+	TermsCanceled           = "canceled"  //挂单已撤销
+	TermsExpired            = "expired"   //挂单已过期
+	TermsFinished           = "finished"  //挂单已全部成交
+	AdminCertKey            = "adminCert" //部署者的证书，lock和exchange只能由部署者调用
 )
 
 var (
@@ -75,7 +83,20 @@ func (c *ExchangeChaincode) Init(stub shim.ChaincodeStubInterface, function stri
 	c.stub = stub
 	c.args = args
 
-	err := c.createTable()
+	// 部署交易的metadata为管理员的证书
+	adminCert, err := stub.GetCallerMetadata()
+	if err != nil {
+		return nil, errors.New("Failed getting metadata")
+	}
+	if len(adminCert) == 0 {
+		return nil, errors.New("Invalid admin certificate. Empty.")
+	}
+	err = stub.PutState(AdminCertKey, adminCert)
+	if err != nil {
+		return nil, errors.New("Failed saving admin certificate")
+	}
+
+	err = c.createTable()
 	if err != nil {
 		// myLogger.Errorf("Init error1:%s", err)
 		return nil, err
@@ -178,9 +199,37 @@ func (c *ExchangeChaincode) createTable() error {
 		return errors.New("Failed creating TxLo2s table.")
 	}
 
+	return c.createOrderTermsTable()
+}
+
+// createOrderTermsTable 挂单条款，锁定、改单、撤单和过期时保存APP传入的挂单快照，交易完成时更新状态
+// 升级前部署的chaincode没有该表，首次保存条款时创建
+func (c *ExchangeChaincode) createOrderTermsTable() error {
+	err := c.stub.CreateTable(TableOrderTerms, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "UUID", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Owner", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Terms", Type: shim.ColumnDefinition_BYTES, Key: false},
+		&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "LockTime", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "UpdateTime", Type: shim.ColumnDefinition_INT64, Key: false},
+	})
+	if err != nil {
+		// myLogger.Errorf("createTable error8:%s", err)
+		return errors.New("Failed creating OrderTerms table.")
+	}
+
 	return nil
 }
 
+// hasOrderTermsTable 挂单条款表是否存在
+func (c *ExchangeChaincode) hasOrderTermsTable() (bool, error) {
+	_, err := c.stub.GetTable(TableOrderTerms)
+	if err == shim.ErrTableNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 func (c *ExchangeChaincode) initTable() error {
 	// 内置人民币CNY和美元USD
 	ok, err := c.stub.InsertRow(TableCurrency, shim.Row{Columns: []*shim.Column{
@@ -234,6 +283,8 @@ func (c *ExchangeChaincode) Invoke(stub shim.ChaincodeStubInterface, function st
 		return c.exchange()
 	} else if function == "lock" {
 		return c.lock()
+	} else if function == "saveOrderTerms" {
+		return c.saveTerms()
 	}
 
 	return nil, errors.New("Received unknown function invocation")
@@ -500,8 +551,9 @@ type FailInfo struct {
 type BatchResult struct {
 	EventName string     `json:"eventName"`
 	SrcMethod string     `json:"srcMethod"`
-	Success   []string   `json:""success`
+	Success   []string   `json:"success"`
 	Fail      []FailInfo `json:"fail"`
+	Trades    []*Order   `json:"trades,omitempty"` //执行成功的交易，买卖两个方向各一条，与TxLog中的记录相同
 }
 
 // lockBalance 锁定货币
@@ -509,18 +561,27 @@ type BatchResult struct {
 func (c *ExchangeChaincode) lock() ([]byte, error) {
 	myLogger.Debug("Lock Currency...")
 
+	ok, err := c.isAdmin()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("The caller is not the administrator.")
+	}
+
 	if len(c.args) != 3 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 3")
 	}
 
 	var lockInfos []struct {
-		Owner    string `json:"owner"`
-		Currency string `json:"currency"`
-		OrderId  string `json:"orderId"`
-		Count    int64  `json:"count"`
+		Owner    string          `json:"owner"`
+		Currency string          `json:"currency"`
+		OrderId  string          `json:"orderId"`
+		Count    int64           `json:"count"`
+		Terms    json.RawMessage `json:"terms"` //挂单快照，挂单锁定和改单时传入
 	}
 
-	err := json.Unmarshal([]byte(c.args[0]), &lockInfos)
+	err = json.Unmarshal([]byte(c.args[0]), &lockInfos)
 	if err != nil {
 		// myLogger.Errorf("lock error1:%s", err)
 		return nil, err
@@ -540,6 +601,15 @@ func (c *ExchangeChaincode) lock() ([]byte, error) {
 		owner := v.Owner
 		// TODO 如果是挂单锁定，要判断目标币存不存在
 
+		// 改单的差额在挂单完成后不再锁定或解锁，避免与结余结算重复
+		if c.args[2] == "amendLock" || c.args[2] == "amendUnlock" {
+			err = c.checkAmend(v.OrderId, islock)
+			if err != nil {
+				failInfos = append(failInfos, FailInfo{Id: v.OrderId, Info: err.Error()})
+				continue
+			}
+		}
+
 		err, errType := c.lockOrUnlockBalance(owner, v.Currency, v.OrderId, v.Count, islock)
 		if errType == CheckErr {
 			failInfos = append(failInfos, FailInfo{Id: v.OrderId, Info: err.Error()})
@@ -548,6 +618,11 @@ func (c *ExchangeChaincode) lock() ([]byte, error) {
 			// myLogger.Errorf("lock error3:%s", err)
 			return nil, err
 		}
+
+		err = c.saveOrderTerms(c.args[2], owner, v.OrderId, v.Terms)
+		if err != nil {
+			return nil, err
+		}
 		successInfos = append(successInfos, v.OrderId)
 	}
 
@@ -563,6 +638,165 @@ func (c *ExchangeChaincode) lock() ([]byte, error) {
 	return nil, nil
 }
 
+// checkAmend 校验改单差额能否锁定或解锁，改单ID为“挂单UUID@改单次数”
+// 挂单完成后不再追加锁定；买完为止的挂单完成时已结算结余，不再解锁
+func (c *ExchangeChaincode) checkAmend(amendID string, islock bool) error {
+	rawUUID := strings.SplitN(amendID, "@", 2)[0]
+
+	row, order, err := c.getTxLogByID(rawUUID)
+	if err != nil {
+		return err
+	}
+	if len(row.Columns) == 0 {
+		return nil
+	}
+	if islock || order.IsBuyAll {
+		return fmt.Errorf("The order [%s] has finished", rawUUID)
+	}
+	return nil
+}
+
+// saveOrderTerms 保存挂单条款，用于APP从账本重建挂单
+// 挂单锁定时新增，改单、撤单和过期时更新快照和状态；升级前锁定的挂单没有条款记录，有快照时补充
+func (c *ExchangeChaincode) saveOrderTerms(srcMethod, owner, orderID string, terms []byte) error {
+	var status string
+	switch srcMethod {
+	case "lock", "amend", "amendLock", "amendUnlock":
+		status = TermsPended
+	case "cancel":
+		status = TermsCanceled
+	case "expire":
+		status = TermsExpired
+	default:
+		return nil
+	}
+
+	ok, err := c.hasOrderTermsTable()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if len(terms) == 0 {
+			return nil
+		}
+		if err := c.createOrderTermsTable(); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().Unix()
+	rawUUID := strings.SplitN(orderID, "@", 2)[0]
+	row, err := c.stub.GetRow(TableOrderTerms, []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: rawUUID}},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed retrieving order terms [%s]: %s", rawUUID, err)
+	}
+	if len(row.Columns) == 0 {
+		if len(terms) == 0 {
+			return nil
+		}
+		_, err := c.stub.InsertRow(TableOrderTerms, shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_String_{String_: rawUUID}},
+				&shim.Column{Value: &shim.Column_String_{String_: owner}},
+				&shim.Column{Value: &shim.Column_Bytes{Bytes: terms}},
+				&shim.Column{Value: &shim.Column_String_{String_: status}},
+				&shim.Column{Value: &shim.Column_Int64{Int64: now}},
+				&shim.Column{Value: &shim.Column_Int64{Int64: now}},
+			},
+		})
+		if err != nil {
+			// myLogger.Errorf("saveOrderTerms error1:%s", err)
+			return errors.New("Failed inserting row.")
+		}
+		return nil
+	}
+
+	if len(terms) > 0 {
+		row.Columns[2].Value = &shim.Column_Bytes{Bytes: terms}
+	}
+	if srcMethod != "lock" {
+		row.Columns[3].Value = &shim.Column_String_{String_: status}
+	}
+	row.Columns[5].Value = &shim.Column_Int64{Int64: now}
+
+	_, err = c.stub.ReplaceRow(TableOrderTerms, row)
+	if err != nil {
+		// myLogger.Errorf("saveOrderTerms error2:%s", err)
+		return errors.New("Failed updating row.")
+	}
+	return nil
+}
+
+// finishOrderTerms 母单最后一笔成交（子单UUID为母单UUID）执行后，挂单条款标记为已全部成交
+func (c *ExchangeChaincode) finishOrderTerms(order *Order) error {
+	if order.RawUUID != "" && order.UUID != order.RawUUID {
+		return nil
+	}
+	ok, err := c.hasOrderTermsTable()
+	if err != nil || !ok {
+		return err
+	}
+
+	row, err := c.stub.GetRow(TableOrderTerms, []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: order.UUID}},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed retrieving order terms [%s]: %s", order.UUID, err)
+	}
+	if len(row.Columns) == 0 {
+		return nil
+	}
+	row.Columns[3].Value = &shim.Column_String_{String_: TermsFinished}
+	row.Columns[5].Value = &shim.Column_Int64{Int64: time.Now().Unix()}
+
+	_, err = c.stub.ReplaceRow(TableOrderTerms, row)
+	if err != nil {
+		// myLogger.Errorf("finishOrderTerms error1:%s", err)
+		return errors.New("Failed updating row.")
+	}
+	return nil
+}
+
+// saveTerms 不需锁定或解锁差额的改单只更新挂单快照
+// 参数：[{"owner":"","orderId":"改单ID","terms":{}}]
+func (c *ExchangeChaincode) saveTerms() ([]byte, error) {
+	myLogger.Debug("saveTerms...")
+
+	ok, err := c.isAdmin()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("The caller is not the administrator.")
+	}
+
+	if len(c.args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	var infos []struct {
+		Owner   string          `json:"owner"`
+		OrderId string          `json:"orderId"`
+		Terms   json.RawMessage `json:"terms"`
+	}
+	err = json.Unmarshal([]byte(c.args[0]), &infos)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range infos {
+		err = c.saveOrderTerms("amend", v.Owner, v.OrderId, v.Terms)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	myLogger.Debug("Done.")
+	return nil, nil
+}
+
 type Order struct {
 	UUID         string `json:"uuid"`         //UUID
 	Account      string `json:"account"`      //账户
@@ -579,6 +813,8 @@ type Order struct {
 	RawUUID      string `json:"rawUUID"`      //母单UUID
 	Metadata     string `json:"metadata"`     //存放其他数据，如挂单锁定失败信息
 	FinalCost    int64  `json:"finalCost"`    //源币的最终消耗数量，主要用于买完（IsBuyAll=true）的最后一笔交易计算结余，此时SrcCount有可能大于FinalCost
+	Type         string `json:"type"`         //挂单类型 limit：限价单，market：市价单
+	Price        int64  `json:"price"`        //母单限价，每个源币最少换得的目标币数量*10^6
 }
 
 // exchange 交易
@@ -586,6 +822,14 @@ type Order struct {
 func (c *ExchangeChaincode) exchange() ([]byte, error) {
 	myLogger.Debug("Exchange...")
 
+	ok, err := c.isAdmin()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("The caller is not the administrator.")
+	}
+
 	if len(c.args) != 1 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 1")
 	}
@@ -594,7 +838,7 @@ func (c *ExchangeChaincode) exchange() ([]byte, error) {
 		BuyOrder  Order `json:"buyOrder"`
 		SellOrder Order `json:"sellOrder"`
 	}
-	err := json.Unmarshal([]byte(c.args[0]), &exchangeOrders)
+	err = json.Unmarshal([]byte(c.args[0]), &exchangeOrders)
 	if err != nil {
 		// myLogger.Errorf("exchange error1:%s", err)
 		return nil, errors.New("Failed unmarshalling order")
@@ -602,6 +846,7 @@ func (c *ExchangeChaincode) exchange() ([]byte, error) {
 
 	var successInfos []string
 	var failInfos []FailInfo
+	var trades []*Order
 
 	for _, v := range exchangeOrders {
 		buyOrder := v.BuyOrder
@@ -621,17 +866,33 @@ func (c *ExchangeChaincode) exchange() ([]byte, error) {
 
 		// check 是否交易过
 		buyRow, _, err := c.getTxLogByID(buyOrder.UUID)
-		if err != nil || len(buyRow.Columns) > 0 {
+		if err == nil && len(buyRow.Columns) > 0 {
+			err = ExecedErr
+		}
+		if err != nil {
 			// myLogger.Errorf("exchange error2:%s", err)
 			failInfos = append(failInfos, FailInfo{Id: matchOrder, Info: err.Error()})
 			continue
 		}
 		sellRow, _, err := c.getTxLogByID(sellOrder.UUID)
-		if err != nil || len(sellRow.Columns) > 0 {
+		if err == nil && len(sellRow.Columns) > 0 {
+			err = ExecedErr
+		}
+		if err != nil {
 			// myLogger.Errorf("exchange error3:%s", err)
 			failInfos = append(failInfos, FailInfo{Id: matchOrder, Info: err.Error()})
 			continue
 		}
+		// 校验成交价格，同一母单的各笔成交价格可以不同，只要不劣于母单限价即可
+		err = checkPrice(&buyOrder)
+		if err == nil {
+			err = checkPrice(&sellOrder)
+		}
+		if err != nil {
+			failInfos = append(failInfos, FailInfo{Id: matchOrder, Info: err.Error()})
+			continue
+		}
+
 		// execTx
 		err, errType := c.execTx(&buyOrder, &sellOrder)
 		if errType == CheckErr {
@@ -648,11 +909,19 @@ func (c *ExchangeChaincode) exchange() ([]byte, error) {
 			// myLogger.Errorf("exchange error5:%s", err)
 			return nil, err
 		}
+		err = c.finishOrderTerms(&buyOrder)
+		if err == nil {
+			err = c.finishOrderTerms(&sellOrder)
+		}
+		if err != nil {
+			return nil, err
+		}
 
 		successInfos = append(successInfos, matchOrder)
+		trades = append(trades, &buyOrder, &sellOrder)
 	}
 
-	batch := BatchResult{EventName: "chaincode_exchange", Success: successInfos, Fail: failInfos}
+	batch := BatchResult{EventName: "chaincode_exchange", Success: successInfos, Fail: failInfos, Trades: trades}
 	result, err := json.Marshal(&batch)
 	if err != nil {
 		// myLogger.Errorf("exchange error6:%s", err)
@@ -794,6 +1063,20 @@ func (c *ExchangeChaincode) execTx(buyOrder, sellOrder *Order) (error, ErrType)
 	return nil, ErrType("")
 }
 
+// checkPrice 校验成交价格不劣于母单限价
+// 成交价=DesCount/FinalCost，市价单的限价为滑点上限对应的最差价格，未带限价的挂单不校验
+func checkPrice(order *Order) error {
+	if order.Price <= 0 || order.FinalCost <= 0 {
+		return nil
+	}
+
+	// 数量和价格均由APP截断取整，允许一个最小单位的误差
+	if float64(order.DesCount+1)*PriceMultiple < float64(order.Price)*float64(order.FinalCost) {
+		return fmt.Errorf("The price of order [%s] is worse than its limit price", order.UUID)
+	}
+	return nil
+}
+
 // saveTxLog 保存交易log
 func (c *ExchangeChaincode) saveTxLog(buyOrder, sellOrder *Order) error {
 	buyJson, _ := json.Marshal(buyOrder)
@@ -893,6 +1176,7 @@ func (c *ExchangeChaincode) isCreator(certificate []byte) (bool, error) {
 	}
 	if !ok {
 		myLogger.Error("Invalid signature")
+		return false, nil
 	}
 
 	myLogger.Debug("Check ...Verified!")
@@ -900,6 +1184,18 @@ func (c *ExchangeChaincode) isCreator(certificate []byte) (bool, error) {
 	return true, nil
 }
 
+// isAdmin 调用者是否为部署时登记的管理员
+func (c *ExchangeChaincode) isAdmin() (bool, error) {
+	adminCert, err := c.stub.GetState(AdminCertKey)
+	if err != nil {
+		return false, errors.New("Failed getting admin certificate")
+	}
+	if len(adminCert) == 0 {
+		return false, errors.New("Invalid admin certificate. Empty.")
+	}
+	return c.isCreator(adminCert)
+}
+
 func (c *ExchangeChaincode) getCurrencyByID(id string) (shim.Row, *Currency, error) {
 	var currency *Currency
 
@@ -1084,6 +1380,15 @@ func (c *ExchangeChaincode) computeBalance(owner string, srcCurrency, desCurrenc
 	}
 
 	lock := row.Columns[4].GetInt64()
+
+	// 改单追加锁定和解锁的差额
+	amend, err := c.getAmendCount(owner, srcCurrency, rawUUID)
+	if err != nil {
+		// myLogger.Errorf("computeBalance error3:%s", err)
+		return 0, err
+	}
+	lock += amend
+
 	sumCost := int64(0)
 	for _, tx := range txs {
 		sumCost += tx.FinalCost
@@ -1092,6 +1397,41 @@ func (c *ExchangeChaincode) computeBalance(owner string, srcCurrency, desCurrenc
 	return lock - sumCost - currentCost, nil
 }
 
+// getAmendCount 挂单各次改单的锁定数量之和，解锁记为负数
+// 改单的挂单号为“原始挂单号@改单次数”，对账修正解锁（“原始挂单号@对账ID”）不计入
+func (c *ExchangeChaincode) getAmendCount(owner string, currency, rawUUID string) (int64, error) {
+	rowChannel, err := c.stub.GetRows(TableAssetLockLog, []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: owner}},
+		shim.Column{Value: &shim.Column_String_{String_: currency}},
+	})
+	if err != nil {
+		// myLogger.Errorf("getAmendCount error1:%s", err)
+		return 0, fmt.Errorf("getAmendCount operation failed. %s", err)
+	}
+
+	count := int64(0)
+	for row := range rowChannel {
+		if !isAmendOrderID(row.Columns[2].GetString_(), rawUUID) {
+			continue
+		}
+		if row.Columns[3].GetBool() {
+			count += row.Columns[4].GetInt64()
+		} else {
+			count -= row.Columns[4].GetInt64()
+		}
+	}
+	return count, nil
+}
+
+// isAmendOrderID 锁定记录的挂单号是否为原始挂单的改单
+func isAmendOrderID(orderID, rawUUID string) bool {
+	if !strings.HasPrefix(orderID, rawUUID+"@") {
+		return false
+	}
+	_, err := strconv.ParseInt(strings.TrimPrefix(orderID, rawUUID+"@"), 10, 64)
+	return err == nil
+}
+
 func (c *ExchangeChaincode) getTXs(owner string, srcCurrency, desCurrency, rawOrder string) ([]shim.Row, []*Order, error) {
 	rowChannel, err := c.stub.GetRows(TableTxLog, []shim.Column{
 		shim.Column{Value: &shim.Column_String_{String_: owner}},
@@ -1132,7 +1472,7 @@ func (c *ExchangeChaincode) getTXs(owner string, srcCurrency, desCurrency, rawOr
 }
 
 func (c *ExchangeChaincode) getTxLogByID(uuid string) (shim.Row, *Order, error) {
-	var order *Order
+	order := new(Order)
 	row, err := c.stub.GetRow(TableTxLog2, []shim.Column{
 		shim.Column{Value: &shim.Column_String_{String_: uuid}},
 	})
@@ -1171,6 +1511,10 @@ func (c *ExchangeChaincode) Query(stub shim.ChaincodeStubInterface, function str
 		return c.queryAssetByOwner()
 	} else if function == "queryMyCurrency" {
 		return c.queryMyCurrency()
+	} else if function == "queryLocksByOwner" {
+		return c.queryLocksByOwner()
+	} else if function == "queryOrderTerms" {
+		return c.queryOrderTerms()
 	}
 
 	return nil, errors.New("Received unknown function query")
@@ -1222,6 +1566,83 @@ func (c *ExchangeChaincode) queryAssetByOwner() ([]byte, error) {
 	return json.Marshal(&assets)
 }
 
+// OrderLock 挂单在账本上的锁定情况，改单的锁定和解锁计入原始挂单
+type OrderLock struct {
+	OrderId  string `json:"orderId"`
+	Currency string `json:"currency"`
+	Locked   int64  `json:"locked"`   //锁定数量
+	Unlocked int64  `json:"unlocked"` //解锁数量
+	Cost     int64  `json:"cost"`     //已执行交易的消耗
+}
+
+// queryLocksByOwner 查询个人资产的锁定数量和各挂单的锁定情况，用于对账
+func (c *ExchangeChaincode) queryLocksByOwner() ([]byte, error) {
+	myLogger.Debug("queryLocksByOwner...")
+
+	if len(c.args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	owner := c.args[0]
+	_, assets, err := c.getOwnerAllAsset(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	type lockKey struct{ currency, rawUUID string }
+	locks := make(map[lockKey]*OrderLock)
+	getLock := func(currency, orderID string) *OrderLock {
+		rawUUID := strings.SplitN(orderID, "@", 2)[0]
+		key := lockKey{currency, rawUUID}
+		if _, ok := locks[key]; !ok {
+			locks[key] = &OrderLock{OrderId: rawUUID, Currency: currency}
+		}
+		return locks[key]
+	}
+
+	lockChannel, err := c.stub.GetRows(TableAssetLockLog, []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: owner}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getRows operation failed. %s", err)
+	}
+	for row := range lockChannel {
+		lock := getLock(row.Columns[1].GetString_(), row.Columns[2].GetString_())
+		if row.Columns[3].GetBool() {
+			lock.Locked += row.Columns[4].GetInt64()
+		} else {
+			lock.Unlocked += row.Columns[4].GetInt64()
+		}
+	}
+
+	txChannel, err := c.stub.GetRows(TableTxLog, []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: owner}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getRows operation failed. %s", err)
+	}
+	for row := range txChannel {
+		order := new(Order)
+		if err := json.Unmarshal(row.Columns[4].GetBytes(), order); err != nil {
+			continue
+		}
+		getLock(order.SrcCurrency, order.RawUUID).Cost += order.FinalCost
+	}
+
+	orders := []*OrderLock{}
+	for _, v := range locks {
+		orders = append(orders, v)
+	}
+
+	return json.Marshal(&struct {
+		Assets []*Asset     `json:"assets"`
+		Orders []*OrderLock `json:"orders"`
+	}{
+		Assets: assets,
+		Orders: orders,
+	})
+}
+
 // queryCurrency 查询币
 func (c *ExchangeChaincode) queryCurrencyByID() ([]byte, error) {
 	myLogger.Debug("queryCurrency...")
@@ -1300,6 +1721,52 @@ func (c *ExchangeChaincode) queryTxLogs() ([]byte, error) {
 	return json.Marshal(&infos)
 }
 
+// OrderTerms 挂单条款
+type OrderTerms struct {
+	UUID       string          `json:"uuid"`
+	Owner      string          `json:"owner"`
+	Terms      json.RawMessage `json:"terms"`  //APP传入的挂单快照
+	Status     string          `json:"status"` //pended：已锁定，canceled：已撤销，expired：已过期，finished：已全部成交
+	LockTime   int64           `json:"lockTime"`
+	UpdateTime int64           `json:"updateTime"`
+}
+
+// queryOrderTerms 查询所有挂单条款，用于从账本重建挂单
+func (c *ExchangeChaincode) queryOrderTerms() ([]byte, error) {
+	myLogger.Debug("queryOrderTerms...")
+
+	if len(c.args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	infos := []*OrderTerms{}
+	ok, err := c.hasOrderTermsTable()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return json.Marshal(&infos)
+	}
+
+	rowChannel, err := c.stub.GetRows(TableOrderTerms, nil)
+	if err != nil {
+		return nil, fmt.Errorf("getRows operation failed. %s", err)
+	}
+
+	for row := range rowChannel {
+		infos = append(infos, &OrderTerms{
+			UUID:       row.Columns[0].GetString_(),
+			Owner:      row.Columns[1].GetString_(),
+			Terms:      row.Columns[2].GetBytes(),
+			Status:     row.Columns[3].GetString_(),
+			LockTime:   row.Columns[4].GetInt64(),
+			UpdateTime: row.Columns[5].GetInt64(),
+		})
+	}
+
+	return json.Marshal(&infos)
+}
+
 func main() {
 	primitives.SetSecurityLevel("SHA3", 256)
 	err := shim.Start(new(ExchangeChaincode))
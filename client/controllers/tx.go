@@ -9,14 +9,16 @@ type TxController struct {
 func (c *TxController) Exchange() {
 	srcCurrency := c.GetString("srcCurrency")
 	desCurrency := c.GetString("desCurrency")
-	srcCount, err := c.GetFloat("srcCount")
+	orderType := c.GetString("type")
+	// 市价单只需填写花费的源币数量或买入的目标币数量之一
+	srcCount, err := c.GetFloat("srcCount", 0)
 	if err != nil {
 		logger.Errorf("ParseFloat error: %v", err)
 		c.Data["json"] = map[string]interface{}{"code": 0, "message": "挂单失败：" + err.Error()}
 		c.ServeJSON()
 		return
 	}
-	desCount, err := c.GetFloat("desCount")
+	desCount, err := c.GetFloat("desCount", 0)
 	if err != nil {
 		logger.Errorf("ParseFloat error: %v", err)
 		c.Data["json"] = map[string]interface{}{"code": 0, "message": "挂单失败：" + err.Error()}
@@ -30,23 +32,52 @@ func (c *TxController) Exchange() {
 		c.ServeJSON()
 		return
 	}
-	// expiredTime, err := c.GetInt64("expiredTime")
-	// if err != nil {
-	// 	logger.Errorf("ParseFloat error: %v", err)
-	// 	c.Data["json"] = map[string]interface{}{"code": 0, "message": "挂单失败：" + err.Error()}
-	// 	c.ServeJSON()
-	// 	return
-	// }
+	slippage, err := c.GetFloat("slippage", 0)
+	if err != nil {
+		logger.Errorf("ParseFloat error: %v", err)
+		c.Data["json"] = map[string]interface{}{"code": 0, "message": "挂单失败：" + err.Error()}
+		c.ServeJSON()
+		return
+	}
+	expiredTime, err := c.GetInt64("expiredTime", 0)
+	if err != nil {
+		logger.Errorf("ParseInt error: %v", err)
+		c.Data["json"] = map[string]interface{}{"code": 0, "message": "挂单失败：" + err.Error()}
+		c.ServeJSON()
+		return
+	}
+	timeInForce := c.GetString("timeInForce")
+	clientOrderID := c.GetString("clientOrderId")
+	stopPrice, err := c.GetFloat("stopPrice", 0)
+	if err != nil {
+		logger.Errorf("ParseFloat error: %v", err)
+		c.Data["json"] = map[string]interface{}{"code": 0, "message": "挂单失败：" + err.Error()}
+		c.ServeJSON()
+		return
+	}
+	displayCount, err := c.GetFloat("displayCount", 0)
+	if err != nil {
+		logger.Errorf("ParseFloat error: %v", err)
+		c.Data["json"] = map[string]interface{}{"code": 0, "message": "挂单失败：" + err.Error()}
+		c.ServeJSON()
+		return
+	}
 
 	// 挂单
 	order := &models.Order{
-		Account:     c.UserUserId,
-		SrcCurrency: srcCurrency,
-		SrcCount:    srcCount,
-		DesCurrency: desCurrency,
-		DesCount:    desCount,
-		IsBuyAll:    isBuyAll,
-		// ExpiredTime: expiredTime,
+		Account:       c.UserUserId,
+		SrcCurrency:   srcCurrency,
+		SrcCount:      srcCount,
+		DesCurrency:   desCurrency,
+		DesCount:      desCount,
+		IsBuyAll:      isBuyAll,
+		Type:          orderType,
+		Slippage:      slippage,
+		ExpiredTime:   expiredTime,
+		TimeInForce:   timeInForce,
+		StopPrice:     stopPrice,
+		DisplayCount:  displayCount,
+		ClientOrderID: clientOrderID,
 	}
 	_, err = models.TxExchange(order)
 	if err != nil {
@@ -106,3 +137,48 @@ func (c *TxController) CancelCheck() {
 	c.Data["json"] = map[string]interface{}{"code": 1, "message": code}
 	c.ServeJSON()
 }
+
+func (c *TxController) Amend() {
+	id := c.GetString("id")
+	srcCount, err := c.GetFloat("srcCount", 0)
+	if err != nil {
+		logger.Errorf("ParseFloat error: %v", err)
+		c.Data["json"] = map[string]interface{}{"code": 0, "message": "改单失败：" + err.Error()}
+		c.ServeJSON()
+		return
+	}
+	desCount, err := c.GetFloat("desCount", 0)
+	if err != nil {
+		logger.Errorf("ParseFloat error: %v", err)
+		c.Data["json"] = map[string]interface{}{"code": 0, "message": "改单失败：" + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	amendID, err := models.TxAmend(id, srcCount, desCount)
+	if err != nil {
+		logger.Errorf("TxAmend error: %v", err)
+
+		c.Data["json"] = map[string]interface{}{"code": 0, "message": "改单失败：" + err.Error()}
+		c.ServeJSON()
+
+		return
+	}
+	c.Data["json"] = map[string]interface{}{"code": 1, "message": "改单成功", "id": amendID}
+	c.ServeJSON()
+}
+
+func (c *TxController) AmendCheck() {
+	id := c.Ctx.Input.Param(":id")
+	code, err := models.CheckAmend(id)
+	if err != nil {
+		logger.Errorf("CheckAmend error: %v", err)
+
+		c.Data["json"] = map[string]interface{}{"code": 0, "message": "检测失败：" + err.Error()}
+		c.ServeJSON()
+
+		return
+	}
+	c.Data["json"] = map[string]interface{}{"code": 1, "message": code}
+	c.ServeJSON()
+}
@@ -7,27 +7,35 @@ import (
 
 // Order Order
 type Order struct {
-	UUID         string  `json:"uuid"`        //UUID
-	Account      string  `json:"account"`     //账户
-	SrcCurrency  string  `json:"srcCurrency"` //源币种代码
-	SrcCount     float64 `json:"srcCount"`    //源币种交易数量
-	DesCurrency  string  `json:"desCurrency"` //目标币种代码
-	DesCount     float64 `json:"desCount"`    //目标币种交易数量
-	IsBuyAll     bool    `json:"isBuyAll"`    //是否买入所有，即为true是以目标币全部兑完为主,否则算部分成交,买完为止；为false则是以源币全部兑完为主,否则算部分成交，卖完为止
-	ExpiredTime  int64   `json:"expiredTime"` //超时时间
-	ExpiredDate  string  `json:"expiredDate"`
-	PendingTime  int64   `json:"PendingTime"` //挂单时间
-	PendingDate  string  `json:"pendingDate"`
-	PendedTime   int64   `json:"PendedTime"` //挂单完成时间
-	PendedDate   string  `json:"pendedDate"`
-	MatchedTime  int64   `json:"matchedTime"` //撮合完成时间
-	MatchedDate  string  `json:"matchedDate"`
-	FinishedTime int64   `json:"finishedTime"` //交易完成时间
-	FinishedDate string  `json:"finishedDate"`
-	RawUUID      string  `json:"rawUUID"`   //母单UUID
-	Metadata     string  `json:"metadata"`  //存放其他数据，如挂单锁定失败信息
-	FinalCost    float64 `json:"finalCost"` //源币的最终消耗数量，主要用于买完（IsBuyAll=true）的最后一笔交易计算结余，此时SrcCount有可能大于FinalCost
-	Status       int     `json:"status"`    //状态 0：待交易，1：完成，2：过期，3：撤单
+	UUID          string  `json:"uuid"`        //UUID
+	Account       string  `json:"account"`     //账户
+	SrcCurrency   string  `json:"srcCurrency"` //源币种代码
+	SrcCount      float64 `json:"srcCount"`    //源币种交易数量
+	DesCurrency   string  `json:"desCurrency"` //目标币种代码
+	DesCount      float64 `json:"desCount"`    //目标币种交易数量
+	IsBuyAll      bool    `json:"isBuyAll"`    //是否买入所有，即为true是以目标币全部兑完为主,否则算部分成交,买完为止；为false则是以源币全部兑完为主,否则算部分成交，卖完为止
+	ExpiredTime   int64   `json:"expiredTime"` //超时时间
+	ExpiredDate   string  `json:"expiredDate"`
+	PendingTime   int64   `json:"PendingTime"` //挂单时间
+	PendingDate   string  `json:"pendingDate"`
+	PendedTime    int64   `json:"PendedTime"` //挂单完成时间
+	PendedDate    string  `json:"pendedDate"`
+	MatchedTime   int64   `json:"matchedTime"` //撮合完成时间
+	MatchedDate   string  `json:"matchedDate"`
+	FinishedTime  int64   `json:"finishedTime"` //交易完成时间
+	FinishedDate  string  `json:"finishedDate"`
+	RawUUID       string  `json:"rawUUID"`       //母单UUID
+	Metadata      string  `json:"metadata"`      //存放其他数据，如挂单锁定失败信息
+	FinalCost     float64 `json:"finalCost"`     //源币的最终消耗数量，主要用于买完（IsBuyAll=true）的最后一笔交易计算结余，此时SrcCount有可能大于FinalCost
+	Status        int     `json:"status"`        //状态 0：待交易，1：完成，2：过期，3：撤单
+	Type          string  `json:"type"`          //挂单类型 limit：限价单，market：市价单
+	Slippage      float64 `json:"slippage"`      //市价单允许的最大滑点
+	TimeInForce   string  `json:"timeInForce"`   //有效期类型 GTC，IOC，FOK，GTD
+	Reason        string  `json:"reason"`        //撤单或过期的原因
+	StopPrice     float64 `json:"stopPrice"`     //止损价，最新成交价跌到此价格及以下时触发
+	DisplayCount  float64 `json:"displayCount"`  //冰山单每次显示的数量
+	HiddenCount   float64 `json:"hiddenCount"`   //冰山单隐藏的剩余数量
+	ClientOrderID string  `json:"clientOrderId"` //客户端挂单ID，重复提交时返回原挂单
 }
 
 func GetMyTxs(user string) ([]Order, error) {
@@ -147,6 +155,61 @@ func TxCancel(id string) (string, error) {
 	return result.OK, nil
 }
 
+// TxAmend TxAmend
+func TxAmend(uuid string, srcCount, desCount float64) (string, error) {
+	urlstr := getHTTPURL("tx/amend")
+
+	request, _ := json.Marshal(map[string]interface{}{"uuid": uuid, "srcCount": srcCount, "desCount": desCount})
+	response, err := performHTTPPost(urlstr, request)
+	if err != nil {
+		logger.Errorf("TxAmend failed: %v", err)
+		return "", err
+	}
+
+	logger.Debugf("TxAmend: url=%v request=%v response=%v", urlstr, string(request), string(response))
+
+	var result AppResponse
+	err = json.Unmarshal(response, &result)
+	if err != nil {
+		logger.Errorf("TxAmend failed: %v", err)
+		return "", err
+	}
+
+	if len(result.OK) == 0 {
+		logger.Errorf("TxAmend failed: %v", result.Err)
+		return "", fmt.Errorf(result.Err)
+	}
+
+	return result.OK, nil
+}
+
+// CheckAmend CheckAmend
+func CheckAmend(id string) (string, error) {
+	urlstr := getHTTPURL("tx/amend/check/" + id)
+
+	response, err := performHTTPGet(urlstr)
+	if err != nil {
+		logger.Errorf("CheckAmend failed: %v", err)
+		return "", err
+	}
+
+	logger.Debugf("CheckAmend: url=%v request=%v response=%v", urlstr, id, string(response))
+
+	var result AppResponse
+	err = json.Unmarshal(response, &result)
+	if err != nil {
+		logger.Errorf("CheckAmend failed: %v", err)
+		return "", err
+	}
+
+	if len(result.Err) != 0 {
+		logger.Errorf("CheckAmend failed: %v", result.Err)
+		return "", fmt.Errorf(result.Err)
+	}
+
+	return result.OK, nil
+}
+
 // CheckCancel CheckCancel
 func CheckCancel(uuid string) (string, error) {
 	// Create New Fund
@@ -28,4 +28,7 @@ func init() {
 
 	beego.Router("/tx/cancel", &controllers.TxController{}, "post:Cancel")
 	beego.Router("/currency/cancel/check/:uuid(.*)", &controllers.TxController{}, "get:CancelCheck")
+
+	beego.Router("/tx/amend", &controllers.TxController{}, "post:Amend")
+	beego.Router("/tx/amend/check/:id(.*)", &controllers.TxController{}, "get:AmendCheck")
 }